@@ -0,0 +1,154 @@
+package main
+
+/*
+BRANDING of hosted channels:
+- hosts configure a color, a PNG icon and contact info with the hosted-channel-branding-* options
+- clients ask for it with ask_branding_info once a channel is open (or with hc-branding) and cache the answer
+*/
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/raphjaph/go-hosted-channels/hcwire"
+)
+
+const brandingTimeout = 30 * time.Second
+
+var pngSignature = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}
+
+// branding as hc-branding returns it
+type Branding struct {
+	HostID      string `json:"host_id"`
+	Color       string `json:"color"`
+	PNGIcon     string `json:"png_icon,omitempty"` // hex
+	ContactInfo string `json:"contact_info"`
+}
+
+func newBranding(host string, branding *hcwire.HostedChannelBranding) Branding {
+	return Branding{
+		HostID:      host,
+		Color:       "#" + hex.EncodeToString(branding.RGBColor[:]),
+		PNGIcon:     hex.EncodeToString(branding.PNGIcon),
+		ContactInfo: branding.ContactInfo,
+	}
+}
+
+// hc-branding calls waiting for a host to answer
+var brandingWaiters = newWaiters[string, *hcwire.HostedChannelBranding]()
+
+// the branding configured with our options; nil if there is none
+func getHostBranding(p *plugin.Plugin) (*hcwire.HostedChannelBranding, error) {
+	color := p.Args.Get("hosted-channel-branding-color").String()
+	iconPath := p.Args.Get("hosted-channel-branding-icon").String()
+	contactInfo := p.Args.Get("hosted-channel-branding-contact").String()
+	if color == "" && iconPath == "" && contactInfo == "" {
+		return nil, nil
+	}
+
+	branding := &hcwire.HostedChannelBranding{ContactInfo: contactInfo}
+
+	if color != "" {
+		rgb, err := hex.DecodeString(strings.TrimPrefix(color, "#"))
+		if err != nil || len(rgb) != 3 {
+			return nil, fmt.Errorf("invalid branding color %v, expected #rrggbb", color)
+		}
+		copy(branding.RGBColor[:], rgb)
+	}
+
+	if iconPath != "" {
+		icon, err := ioutil.ReadFile(iconPath)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.HasPrefix(icon, pngSignature) {
+			return nil, fmt.Errorf("branding icon %v isn't a PNG", iconPath)
+		}
+		if len(icon) > lnwire.MaxMsgBody {
+			return nil, fmt.Errorf("branding icon %v has %v bytes, more than a message can carry (%v)", iconPath, len(icon), lnwire.MaxMsgBody)
+		}
+		branding.PNGIcon = icon
+	}
+
+	// lightningd won't pass on a larger message so it could never be sent
+	body := new(bytes.Buffer)
+	if err := branding.Encode(body, hcwire.LatestProtocolVersion); err != nil {
+		return nil, fmt.Errorf("invalid branding: %v", err)
+	}
+	if body.Len() > lnwire.MaxMsgBody {
+		return nil, fmt.Errorf("branding icon %v and contact info take %v bytes, more than a message can carry (%v)", iconPath, body.Len(), lnwire.MaxMsgBody)
+	}
+
+	return branding, nil
+}
+
+func hostHandleAskBrandingInfo(p *plugin.Plugin, peer string, ask *hcwire.AskBrandingInfo) error {
+	if ask.ChainHash != getGenesisHash(p.Network) {
+		return fmt.Errorf("ask_branding_info for wrong chain: %x", ask.ChainHash)
+	}
+
+	branding, err := getHostBranding(p)
+	if err != nil {
+		return err
+	}
+	if branding == nil {
+		return fmt.Errorf("no branding configured")
+	}
+
+	return sendMessage(p, peer, branding)
+}
+
+func clientAskBranding(p *plugin.Plugin, host string) error {
+	return sendMessage(p, host, &hcwire.AskBrandingInfo{ChainHash: getGenesisHash(p.Network)})
+}
+
+func clientHandleBranding(p *plugin.Plugin, peer string, branding *hcwire.HostedChannelBranding) error {
+	asked := brandingWaiters.notify(peer, branding)
+
+	// only cache branding of our hosts or that we asked for
+	channel, err := store.getChannel(peer)
+	if err == errChannelNotFound && !asked {
+		return fmt.Errorf("unsolicited hosted_channel_branding")
+	}
+	if err != nil && err != errChannelNotFound {
+		return err
+	}
+	if err == nil && channel.IsHost {
+		return fmt.Errorf("hosted_channel_branding from our client")
+	}
+
+	return store.saveBranding(peer, branding)
+}
+
+// cached branding of host unless refresh is set or there is none yet
+func clientGetBranding(p *plugin.Plugin, host string, refresh bool) (Branding, error) {
+	if !refresh {
+		branding, err := store.getBranding(host)
+		if err == nil {
+			return newBranding(host, branding), nil
+		}
+		if err != errBrandingNotFound {
+			return Branding{}, err
+		}
+	}
+
+	waiter := brandingWaiters.add(host)
+	defer brandingWaiters.remove(host, waiter)
+
+	if err := clientAskBranding(p, host); err != nil {
+		return Branding{}, err
+	}
+
+	select {
+	case branding := <-waiter:
+		return newBranding(host, branding), nil
+	case <-time.After(brandingTimeout):
+		return Branding{}, fmt.Errorf("%v didn't send its branding", host)
+	}
+}
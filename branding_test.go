@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// a png signature followed by zeroes; size is the whole file
+func writeTestIcon(t *testing.T, size int) string {
+	icon := make([]byte, size)
+	copy(icon, pngSignature)
+
+	path := filepath.Join(t.TempDir(), "icon.png")
+	require.NoError(t, os.WriteFile(path, icon, 0600))
+	return path
+}
+
+func TestHostBrandingIconSize(t *testing.T) {
+	contact := "hello@example.com"
+	// color, icon flag and length, contact length
+	largest := lnwire.MaxMsgBody - 3 - 1 - 2 - 2 - len(contact)
+
+	tests := []struct {
+		name  string
+		size  int
+		valid bool
+	}{
+		{"small", 1000, true},
+		{"largest that fits", largest, true},
+		{"with the contact info too large", largest + 1, false},
+		{"larger than a message", lnwire.MaxMsgBody + 1, false},
+		{"larger than a length prefix", 70000, false},
+	}
+
+	for _, test := range tests {
+		node := newTestNode(t, optionFlags{
+			"hosted-channel-branding-icon":    writeTestIcon(t, test.size),
+			"hosted-channel-branding-contact": contact,
+		})
+
+		branding, err := getHostBranding(node.p)
+		if !test.valid {
+			require.Error(t, err, test.name)
+			assert.Contains(t, err.Error(), "more than a message can carry", test.name)
+			continue
+		}
+		require.NoError(t, err, test.name)
+		assert.Len(t, branding.PNGIcon, test.size, test.name)
+	}
+}
+
+func TestHostSendsBranding(t *testing.T) {
+	client := newTestNode(t, optionFlags{})
+	host := newTestNode(t, optionFlags{
+		"hosted-channel-branding-icon":  writeTestIcon(t, 1000),
+		"hosted-channel-branding-color": "#ff8800",
+	})
+	openTestChannel(t, client, host)
+
+	// the client asked once the channel was open and cached the answer
+	client.use()
+	branding, err := store.getBranding(host.id)
+	require.NoError(t, err)
+	assert.Equal(t, [3]byte{0xff, 0x88, 0x00}, branding.RGBColor)
+	assert.Len(t, branding.PNGIcon, 1000)
+}
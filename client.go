@@ -0,0 +1,287 @@
+package main
+
+/*
+CLIENT VIEW of the channel state machine:
+
+	hc-invoke --> invoke_hosted_channel --> [invoked]
+	init_hosted_channel --> sign first state --> state_update
+	state_update from host --> [open]
+
+- re-establishment: host answers invoke_hosted_channel with its last_cross_signed_state
+  and we answer with ours
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcutil"
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+	"github.com/raphjaph/go-hosted-channels/hcwire"
+)
+
+const invokeTimeout = 60 * time.Second
+
+// hc-invoke calls waiting for the handshake with a host to finish
+var invokeWaiters = newWaiters[string, error]()
+
+func addressToScriptPubKey(address string, network string) ([]byte, error) {
+	addr, err := btcutil.DecodeAddress(address, getChainParams(network))
+	if err != nil {
+		return nil, err
+	}
+
+	return txscript.PayToAddrScript(addr)
+}
+
+// checks the parameters offered by the host against our configured limits
+func validateInitHostedChannel(p *plugin.Plugin, initHC *hcwire.InitHostedChannel) error {
+	if initHC.InitialClientBalanceMSat > initHC.ChannelCapacityMSat {
+		return fmt.Errorf("initial client balance %v is larger than capacity %v", initHC.InitialClientBalanceMSat, initHC.ChannelCapacityMSat)
+	}
+
+	if minCapacity := p.Args.Get("hosted-channel-min-capacity").Uint() * 1000; initHC.ChannelCapacityMSat < minCapacity {
+		return fmt.Errorf("channel capacity %v is below our minimum of %v", initHC.ChannelCapacityMSat, minCapacity)
+	}
+
+	if minDeadline := p.Args.Get("hosted-channel-min-liability-deadline").Uint(); uint64(initHC.LiabilityDeadlineBlockdays) < minDeadline {
+		return fmt.Errorf("liability deadline of %v blockdays is below our minimum of %v", initHC.LiabilityDeadlineBlockdays, minDeadline)
+	}
+
+	if maxHTLCMinimum := p.Args.Get("hosted-channel-max-htlc-minimum").Uint(); initHC.HTLCMinimumMSat > maxHTLCMinimum {
+		return fmt.Errorf("htlc minimum %v is above our maximum of %v", initHC.HTLCMinimumMSat, maxHTLCMinimum)
+	}
+
+	if initHC.MaxAcceptedHTLCs == 0 || initHC.MaxAcceptedHTLCs > 483 {
+		return fmt.Errorf("max accepted htlcs %v not in [1, 483]", initHC.MaxAcceptedHTLCs)
+	}
+
+	return nil
+}
+
+// invokes a hosted channel and blocks until it is open (or failed)
+func clientInvokeHostedChannel(p *plugin.Plugin, peer string, refundScriptPubKey []byte, secret []byte) (Channel, error) {
+	if err := clientStartInvoke(p, peer, refundScriptPubKey); err != nil {
+		return Channel{}, err
+	}
+
+	waiter := invokeWaiters.add(peer)
+	defer invokeWaiters.remove(peer, waiter)
+
+	invokeHC := &hcwire.InvokeHostedChannel{
+		ChainHash:          getGenesisHash(p.Network),
+		RefundScriptPubKey: refundScriptPubKey,
+		Secret:             secret,
+	}
+	if err := invokeHC.SetFeatures(supportedFeatures); err != nil {
+		return Channel{}, err
+	}
+	if err := invokeHC.SetProtocolVersion(hcwire.LatestProtocolVersion); err != nil {
+		return Channel{}, err
+	}
+	if err := sendMessage(p, peer, invokeHC); err != nil {
+		return Channel{}, err
+	}
+
+	select {
+	case err := <-waiter:
+		if err != nil {
+			return Channel{}, err
+		}
+	case <-time.After(invokeTimeout):
+		return Channel{}, fmt.Errorf("timed out waiting for host %v", peer)
+	}
+
+	return store.getChannel(peer)
+}
+
+// stores the channel as invoked unless we have one with peer already; a channel
+// that never opened starts over
+func clientStartInvoke(p *plugin.Plugin, peer string, refundScriptPubKey []byte) error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	channel, err := store.getChannel(peer)
+	if err == nil && channel.IsHost {
+		return fmt.Errorf("we are already hosting a channel for %v", peer)
+	}
+	if err != errChannelNotFound && (err != nil || channel.Status != StatusInvoked) {
+		return err
+	}
+
+	channelID, err := getChannelID(p, peer, refundScriptPubKey)
+	if err != nil {
+		return err
+	}
+
+	return store.saveChannel(Channel{
+		ChannelID: channelID,
+		PeerID:    peer,
+		IsHost:    false,
+		Status:    StatusInvoked,
+		LastCrossSignedState: hcwire.LastCrossSignedState{
+			IsHost:                 false,
+			LastRefundScriptPubKey: refundScriptPubKey,
+		},
+	})
+}
+
+// the host accepted our invoke_hosted_channel; sign the first state
+func clientHandleInitHostedChannel(p *plugin.Plugin, peer string, initHC *hcwire.InitHostedChannel) error {
+	channel, err := store.getChannel(peer)
+	if err != nil {
+		return err
+	}
+	if channel.IsHost || channel.Status != StatusInvoked {
+		return fmt.Errorf("unexpected init_hosted_channel in channel status %v", channel.Status)
+	}
+
+	features, err := hcwire.NegotiateFeatures(supportedFeatures, initHC.Features)
+	if err == nil {
+		err = validateInitHostedChannel(p, initHC)
+	}
+	var hostVersion uint32
+	if err == nil {
+		hostVersion, err = initHC.ProtocolVersion()
+	}
+	if err != nil {
+		store.deleteChannel(peer)
+		invokeWaiters.notify(peer, err)
+		return denyChannel(p, peer, err)
+	}
+
+	blockday, err := getBlockday(p)
+	if err != nil {
+		return err
+	}
+
+	state := channel.LastCrossSignedState
+	state.InitHostedChannel = *initHC
+	state.Blockday = blockday
+	state.LocalBalanceMSat = initHC.InitialClientBalanceMSat
+	state.RemoteBalanceMSat = initHC.ChannelCapacityMSat - initHC.InitialClientBalanceMSat
+
+	nodeKey, err := getNodeKey(p)
+	if err != nil {
+		return err
+	}
+	if err := state.SignRemote(nodeKey); err != nil {
+		return err
+	}
+
+	channel.InitHostedChannel = *initHC
+	channel.Features = features
+	channel.ProtocolVersion = hcwire.NegotiateProtocolVersion(hcwire.LatestProtocolVersion, hostVersion)
+	channel.LastCrossSignedState = state
+	if err := store.saveChannel(channel); err != nil {
+		return err
+	}
+
+	return sendMessage(p, peer, state.StateUpdate())
+}
+
+// the host signed the first state; the channel is open
+func clientHandleStateUpdate(p *plugin.Plugin, channel Channel, stateUpdate *hcwire.StateUpdate) error {
+	if channel.Status != StatusInvoked && channel.Status != StatusSuspended {
+		return fmt.Errorf("unexpected state_update in channel status %v", channel.Status)
+	}
+
+	state := channel.LastCrossSignedState
+	if stateUpdate.Blockday != state.Blockday ||
+		stateUpdate.LocalUpdates != state.RemoteUpdates ||
+		stateUpdate.RemoteUpdates != state.LocalUpdates {
+		err := fmt.Errorf("state_update doesn't match our state")
+		invokeWaiters.notify(channel.PeerID, err)
+		return err
+	}
+
+	state.RemoteSigOfLocal = stateUpdate.LocalSigOfRemote
+	hostKey, err := parseNodeID(channel.PeerID)
+	if err != nil {
+		return err
+	}
+	ok, err := state.VerifyRemoteSig(hostKey)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errorChannel(p, channel, newChannelError(hcwire.ErrWrongRemoteSig, "signature of the first state"))
+	}
+
+	channel.LastCrossSignedState = state
+	channel.Status = StatusOpen
+	if err := store.saveChannel(channel); err != nil {
+		return err
+	}
+
+	invokeWaiters.notify(channel.PeerID, nil)
+
+	if channel.HasFeature(hcwire.BrandingOptional) {
+		if _, err := store.getBranding(channel.PeerID); err == errBrandingNotFound {
+			return clientAskBranding(p, channel.PeerID)
+		}
+	}
+
+	return nil
+}
+
+// the host answered our invoke_hosted_channel with its state of an existing channel
+func clientHandleLastCrossSignedState(p *plugin.Plugin, channel Channel, remote *hcwire.LastCrossSignedState) error {
+	// the host may have been updated since we last talked
+	hostVersion, err := remote.ProtocolVersion()
+	if err != nil {
+		return err
+	}
+	channel.ProtocolVersion = hcwire.NegotiateProtocolVersion(hcwire.LatestProtocolVersion, hostVersion)
+
+	if channel.Status == StatusErrored {
+		// only a state override brings the channel back
+		err := fmt.Errorf("channel is errored: %v", channel.ErrorReason)
+		invokeWaiters.notify(channel.PeerID, err)
+		if dbErr := store.saveChannel(channel); dbErr != nil {
+			return dbErr
+		}
+		return err
+	}
+
+	if !remote.IsHost {
+		return errorChannel(p, channel, fmt.Errorf("host claims to be the client"))
+	}
+	if err := remote.Validate(); err != nil {
+		return errorChannel(p, channel, fmt.Errorf("invalid last_cross_signed_state: %v", err))
+	}
+
+	// the host's state from our point of view
+	state := remote.Reverse()
+	if err := verifySignatures(p, channel.PeerID, state); err != nil {
+		return errorChannel(p, channel, err)
+	}
+
+	local := channel.LastCrossSignedState
+	if channel.Status == StatusInvoked ||
+		state.LocalUpdates+state.RemoteUpdates > local.LocalUpdates+local.RemoteUpdates {
+		// we lost our state or missed the last update
+		channel.LastCrossSignedState = *state
+		channel.InitHostedChannel = state.InitHostedChannel
+		features, err := hcwire.NegotiateFeatures(supportedFeatures, state.InitHostedChannel.Features)
+		if err != nil {
+			return errorChannel(p, channel, err)
+		}
+		channel.Features = features
+	} else if state.LocalUpdates+state.RemoteUpdates == local.LocalUpdates+local.RemoteUpdates &&
+		(!bytes.Equal(state.LastRefundScriptPubKey, local.LastRefundScriptPubKey) ||
+			state.LocalBalanceMSat != local.LocalBalanceMSat ||
+			state.RemoteBalanceMSat != local.RemoteBalanceMSat) {
+		return errorChannel(p, channel, fmt.Errorf("host has a different state with the same number of updates"))
+	}
+
+	// the host opens the channel after it has seen our state
+	channel.Status = StatusSuspended
+	if err := store.saveChannel(channel); err != nil {
+		return err
+	}
+
+	return sendMessage(p, channel.PeerID, &channel.LastCrossSignedState)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/raphjaph/go-hosted-channels/hcwire"
+	"github.com/stretchr/testify/assert"
+)
+
+func messageTypes(msgs []hcwire.Message) []hcwire.MessageType {
+	var types []hcwire.MessageType
+	for _, msg := range msgs {
+		types = append(types, msg.MsgType())
+	}
+	return types
+}
+
+func TestEstablishment(t *testing.T) {
+	client := newTestNode(t, optionFlags{})
+	host := newTestNode(t, optionFlags{})
+
+	delivered := openTestChannel(t, client, host)
+	assert.Equal(t, []hcwire.MessageType{
+		hcwire.MsgInvokeHostedChannel, hcwire.MsgInitHostedChannel,
+		hcwire.MsgStateUpdate, hcwire.MsgStateUpdate, hcwire.MsgAskBrandingInfo,
+	}, messageTypes(delivered))
+
+	assertSameState(t, client, host)
+
+	hostChannel := host.channel(t, client)
+	clientChannel := client.channel(t, host)
+	assert.Equal(t, hostChannel.ChannelID, clientChannel.ChannelID)
+	assert.True(t, hostChannel.IsHost)
+	assert.False(t, clientChannel.IsHost)
+	assert.Equal(t, hostChannel.Features, clientChannel.Features)
+	assert.Equal(t, hostChannel.ProtocolVersion, clientChannel.ProtocolVersion)
+
+	// the whole channel is on the host's side
+	state := hostChannel.LastCrossSignedState
+	assert.Equal(t, uint64(1000000000), state.LocalBalanceMSat)
+	assert.Equal(t, uint64(0), state.RemoteBalanceMSat)
+	assert.Equal(t, uint32(0), state.LocalUpdates)
+	assert.Equal(t, uint32(0), state.RemoteUpdates)
+	assert.Equal(t, uint32(testBlockheight/144), state.Blockday)
+}
+
+func TestReestablishment(t *testing.T) {
+	client := newTestNode(t, optionFlags{})
+	host := newTestNode(t, optionFlags{})
+	openTestChannel(t, client, host)
+	payTestHTLC(t, client, host)
+
+	// the client reconnects and both compare their last states
+	sendTestInvoke(t, client, host)
+	delivered := exchange(t, client, host)
+	assert.Equal(t, []hcwire.MessageType{
+		hcwire.MsgInvokeHostedChannel, hcwire.MsgLastCrossedSignedState,
+		hcwire.MsgLastCrossedSignedState, hcwire.MsgStateUpdate, hcwire.MsgAskBrandingInfo,
+	}, messageTypes(delivered))
+
+	assert.Equal(t, StatusOpen, client.channel(t, host).Status)
+	assert.Equal(t, StatusOpen, host.channel(t, client).Status)
+	assertSameState(t, client, host)
+}
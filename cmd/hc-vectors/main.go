@@ -0,0 +1,30 @@
+package main
+
+/*
+prints the hcwire golden vectors as json:
+  go run ./cmd/hc-vectors > test-data/hcwire-vectors.json
+other implementations decode them and check they get the same bytes back
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/raphjaph/go-hosted-channels/hcwire"
+)
+
+func main() {
+	vectors, err := hcwire.GoldenVectors()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(vectors); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -1,9 +1,422 @@
 package main
 
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/raphjaph/go-hosted-channels/hcwire"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+/*
+KEYS:
+- channel/<peer_id>        -> channel: its hosted_state plus what only we keep about it
+- channel-id/<channel_id>  -> peer_id (index for lookups by channel id)
+- short-channel-id/<scid>  -> peer_id (index for lookups by short channel id)
+- invoice/<payment_hash>   -> invoice forwarded to us by a client
+- preimage/<payment_hash>  -> preimage of a settled htlc
+- resize-payment/<payment_hash> -> peer_id of the resize it's reserved for, empty once used
+- branding/<peer_id>       -> hosted_channel_branding of a host
+*/
+
+const (
+	channelPrefix   = "channel/"
+	channelIDPrefix = "channel-id/"
+	shortIDPrefix   = "short-channel-id/"
+	invoicePrefix   = "invoice/"
+	preimagePrefix  = "preimage/"
+	resizePrefix    = "resize-payment/"
+	brandingPrefix  = "branding/"
+)
+
+// messages are stored in the same encoding whatever version the peer speaks
+const storageProtocolVersion = hcwire.ProtocolVersion1
+
+var errChannelNotFound = fmt.Errorf("channel not found")
+var errBrandingNotFound = fmt.Errorf("branding not found")
+
 type DB struct {
+	mu      sync.Mutex // makes read-modify-write of channels atomic
+	leveldb *leveldb.DB
+	logf    func(string, ...interface{})
+}
+
+// how a channel is stored: channel id, pending updates and last cross signed
+// state as a hcwire.HostedState, the same snapshot a host gives a client as
+// backup; the rest of Channel (status, errors, features...) next to it
+type channelRecord struct {
+	Channel     Channel
+	HostedState []byte
+}
+
+func openDB(path string, logf func(string, ...interface{})) (*DB, error) {
+	ldb, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &DB{leveldb: ldb, logf: logf}
+	if err := db.indexShortChannelIDs(); err != nil {
+		ldb.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// databases from before the short channel id index only have channel-id/
+func (db *DB) indexShortChannelIDs() error {
+	channels, err := db.listChannels()
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	for _, channel := range channels {
+		if channel.ChannelID == (lnwire.ChannelID{}) {
+			continue
+		}
+		key := shortChannelIDKey(channel.ShortChannelID())
+		if ok, err := db.leveldb.Has(key, nil); err != nil {
+			return err
+		} else if !ok {
+			batch.Put(key, []byte(channel.PeerID))
+		}
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	return db.leveldb.Write(batch, &opt.WriteOptions{Sync: true})
+}
+
+func (db *DB) Close() error {
+	return db.leveldb.Close()
+}
+
+func channelKey(peerID string) []byte {
+	return []byte(channelPrefix + peerID)
+}
+
+func channelIDKey(channelID lnwire.ChannelID) []byte {
+	return []byte(channelIDPrefix + hex.EncodeToString(channelID[:]))
+}
+
+func shortChannelIDKey(shortChannelID lnwire.ShortChannelID) []byte {
+	return []byte(shortIDPrefix + shortChannelID.String())
 }
 
 func (db *DB) getChannel(peerID string) (Channel, error) {
+	b, err := db.leveldb.Get(channelKey(peerID), nil)
+	if err == leveldb.ErrNotFound {
+		return Channel{}, errChannelNotFound
+	}
+	if err != nil {
+		return Channel{}, err
+	}
+
+	return decodeChannel(b)
+}
+
+func (db *DB) getChannelByID(channelID lnwire.ChannelID) (Channel, error) {
+	peerID, err := db.leveldb.Get(channelIDKey(channelID), nil)
+	if err == leveldb.ErrNotFound {
+		return Channel{}, errChannelNotFound
+	}
+	if err != nil {
+		return Channel{}, err
+	}
+
+	return db.getChannel(string(peerID))
+}
+
+func (db *DB) getChannelByShortChannelID(shortChannelID lnwire.ShortChannelID) (Channel, error) {
+	peerID, err := db.leveldb.Get(shortChannelIDKey(shortChannelID), nil)
+	if err == leveldb.ErrNotFound {
+		return Channel{}, errChannelNotFound
+	}
+	if err != nil {
+		return Channel{}, err
+	}
+
+	return db.getChannel(string(peerID))
+}
+
+func (db *DB) listChannels() ([]Channel, error) {
+	channels := []Channel{}
+
+	iter := db.leveldb.NewIterator(util.BytesPrefix([]byte(channelPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		// one channel we can't read shouldn't take all the others with it
+		channel, err := decodeChannel(iter.Value())
+		if err != nil {
+			db.logf("skipping %s: %v", iter.Key(), err)
+			continue
+		}
+		channels = append(channels, channel)
+	}
+
+	return channels, iter.Error()
+}
+
+func (db *DB) saveChannel(channel Channel) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.putChannel(channel)
+}
+
+// updateChannel loads the channel of peerID, applies f and stores the result;
+// nothing is written if f fails
+func (db *DB) updateChannel(peerID string, f func(*Channel) error) (Channel, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	channel, err := db.getChannel(peerID)
+	if err != nil {
+		return Channel{}, err
+	}
+
+	if err := f(&channel); err != nil {
+		return Channel{}, err
+	}
+
+	return channel, db.putChannel(channel)
+}
+
+func (db *DB) deleteChannel(peerID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	channel, err := db.getChannel(peerID)
+	if err == errChannelNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	batch.Delete(channelKey(peerID))
+	if channel.ChannelID != (lnwire.ChannelID{}) {
+		batch.Delete(channelIDKey(channel.ChannelID))
+		batch.Delete(shortChannelIDKey(channel.ShortChannelID()))
+	}
+
+	return db.leveldb.Write(batch, &opt.WriteOptions{Sync: true})
+}
+
+// writes the channel and its indexes in one batch; caller holds db.mu
+func (db *DB) putChannel(channel Channel) error {
+	b, err := encodeChannel(channel)
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	// a channel that's invoked again with another refund script gets another id
+	previous, err := db.getChannel(channel.PeerID)
+	if err != nil && err != errChannelNotFound {
+		return err
+	}
+	if err == nil && previous.ChannelID != channel.ChannelID {
+		batch.Delete(channelIDKey(previous.ChannelID))
+		batch.Delete(shortChannelIDKey(previous.ShortChannelID()))
+	}
+	batch.Put(channelKey(channel.PeerID), b)
+	if channel.ChannelID != (lnwire.ChannelID{}) {
+		batch.Put(channelIDKey(channel.ChannelID), []byte(channel.PeerID))
+		batch.Put(shortChannelIDKey(channel.ShortChannelID()), []byte(channel.PeerID))
+	}
+
+	return db.leveldb.Write(batch, &opt.WriteOptions{Sync: true})
+}
+
+func encodeChannel(channel Channel) ([]byte, error) {
+	state := hcwire.HostedState{
+		ChannelID:            channel.ChannelID,
+		NextLocalUpdates:     channel.NextLocalUpdates,
+		NextRemoteUpdates:    channel.NextRemoteUpdates,
+		LastCrossSignedState: channel.LastCrossSignedState,
+	}
+	stateBuf := new(bytes.Buffer)
+	if err := state.Encode(stateBuf, storageProtocolVersion); err != nil {
+		return nil, err
+	}
+
+	record := channelRecord{Channel: channel, HostedState: stateBuf.Bytes()}
+	record.Channel.ChannelID = lnwire.ChannelID{}
+	record.Channel.NextLocalUpdates = nil
+	record.Channel.NextRemoteUpdates = nil
+	record.Channel.LastCrossSignedState = hcwire.LastCrossSignedState{}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(record); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decodeChannel(b []byte) (Channel, error) {
+	var record channelRecord
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&record); err != nil {
+		return Channel{}, err
+	}
+
+	var state hcwire.HostedState
+	if err := state.Decode(bytes.NewReader(record.HostedState), storageProtocolVersion); err != nil {
+		return Channel{}, fmt.Errorf("could not decode hosted_state of %v: %v", record.Channel.PeerID, err)
+	}
+
+	channel := record.Channel
+	channel.ChannelID = state.ChannelID
+	channel.NextLocalUpdates = state.NextLocalUpdates
+	channel.NextRemoteUpdates = state.NextRemoteUpdates
+	channel.LastCrossSignedState = state.LastCrossSignedState
+
+	return channel, nil
+}
+
+func (db *DB) saveForwardedInvoice(invoice ForwardedInvoice) error {
+	b, err := json.Marshal(invoice)
+	if err != nil {
+		return err
+	}
+
+	return db.leveldb.Put([]byte(invoicePrefix+invoice.PaymentHash), b, &opt.WriteOptions{Sync: true})
+}
+
+func (db *DB) listForwardedInvoices() ([]ForwardedInvoice, error) {
+	invoices := []ForwardedInvoice{}
+
+	iter := db.leveldb.NewIterator(util.BytesPrefix([]byte(invoicePrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var invoice ForwardedInvoice
+		if err := json.Unmarshal(iter.Value(), &invoice); err != nil {
+			return nil, err
+		}
+		invoices = append(invoices, invoice)
+	}
+
+	return invoices, iter.Error()
+}
+
+func (db *DB) savePreimage(preimage [32]byte) error {
+	hash := sha256.Sum256(preimage[:])
+
+	return db.leveldb.Put([]byte(preimagePrefix+hex.EncodeToString(hash[:])), preimage[:], &opt.WriteOptions{Sync: true})
+}
+
+func (db *DB) getPreimage(paymentHash [32]byte) ([32]byte, error) {
+	var preimage [32]byte
+
+	b, err := db.leveldb.Get([]byte(preimagePrefix+hex.EncodeToString(paymentHash[:])), nil)
+	if err != nil {
+		return preimage, err
+	}
+	copy(preimage[:], b)
+
+	return preimage, nil
+}
+
+func resizePaymentKey(paymentHash [32]byte) []byte {
+	return []byte(resizePrefix + hex.EncodeToString(paymentHash[:]))
+}
+
+// holds the payment for the pending resize of peerID's channel so no other resize can use it
+func (db *DB) reserveResizePayment(paymentHash [32]byte, peerID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	owner, err := db.leveldb.Get(resizePaymentKey(paymentHash), nil)
+	if err == leveldb.ErrNotFound {
+		return db.leveldb.Put(resizePaymentKey(paymentHash), []byte(peerID), &opt.WriteOptions{Sync: true})
+	}
+	if err != nil {
+		return err
+	}
+	if len(owner) == 0 {
+		return fmt.Errorf("payment %x was already used for a resize", paymentHash)
+	}
+	if string(owner) != peerID {
+		return fmt.Errorf("payment %x is reserved for another resize", paymentHash)
+	}
+
+	return nil
+}
+
+// the resize of peerID's channel failed; the payment can pay for another one
+func (db *DB) releaseResizePayment(paymentHash [32]byte, peerID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	owner, err := db.leveldb.Get(resizePaymentKey(paymentHash), nil)
+	if err == leveldb.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if string(owner) != peerID {
+		return nil
+	}
+
+	return db.leveldb.Delete(resizePaymentKey(paymentHash), &opt.WriteOptions{Sync: true})
+}
+
+func (db *DB) markResizePaymentUsed(paymentHash [32]byte) error {
+	return db.leveldb.Put(resizePaymentKey(paymentHash), []byte{}, &opt.WriteOptions{Sync: true})
+}
+
+func (db *DB) isResizePaymentUsed(paymentHash [32]byte) (bool, error) {
+	owner, err := db.leveldb.Get(resizePaymentKey(paymentHash), nil)
+	if err == leveldb.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return len(owner) == 0, nil
+}
+
+func (db *DB) saveBranding(peerID string, branding *hcwire.HostedChannelBranding) error {
+	buf := new(bytes.Buffer)
+	if _, err := hcwire.WriteMessage(buf, branding, storageProtocolVersion); err != nil {
+		return err
+	}
+
+	return db.leveldb.Put([]byte(brandingPrefix+peerID), buf.Bytes(), &opt.WriteOptions{Sync: true})
+}
+
+func (db *DB) getBranding(peerID string) (*hcwire.HostedChannelBranding, error) {
+	b, err := db.leveldb.Get([]byte(brandingPrefix+peerID), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, errBrandingNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := hcwire.ReadMessage(bytes.NewReader(b), storageProtocolVersion)
+	if err != nil {
+		return nil, err
+	}
+	branding, ok := msg.(*hcwire.HostedChannelBranding)
+	if !ok {
+		return nil, fmt.Errorf("stored branding of %v is a %v", peerID, msg.MsgType())
+	}
 
-	return Channel{}, nil
+	return branding, nil
 }
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/sha256"
+	"path/filepath"
+	"testing"
+
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/raphjaph/go-hosted-channels/hcwire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getTestDB(t *testing.T) (*DB, string) {
+	path := filepath.Join(t.TempDir(), "hc-database")
+	db, err := openDB(path, t.Logf)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	return db, path
+}
+
+// an errored host channel with everything Channel can hold set
+func getTestChannel() Channel {
+	channelID := lnwire.ChannelID{1, 2, 3}
+	add := &hcwire.UpdateAddHTLC{
+		UpdateAddHTLC: lnwire.UpdateAddHTLC{
+			ChanID:      channelID,
+			ID:          4,
+			Amount:      100000,
+			PaymentHash: sha256.Sum256([]byte{7}),
+			Expiry:      testBlockheight + 144,
+		},
+	}
+
+	return Channel{
+		ChannelID: channelID,
+		PeerID:    "02ab",
+		IsHost:    true,
+		Status:    StatusErrored,
+		ErrorReason: &ChannelError{
+			Code:     hcwire.ErrChannelDenied,
+			Details:  "state_update with blockday 5012, ours is 5014",
+			FromPeer: true,
+		},
+		StateOverride: &hcwire.StateOverride{
+			Blockday:         5014,
+			LocalBalanceMSat: 750000000,
+			LocalUpdates:     13,
+			RemoteUpdates:    12,
+			LocalSigOfRemote: [64]byte{2},
+		},
+		InitHostedChannel: hcwire.InitHostedChannel{
+			MaxHTLCValueInFlightMSat: 100000000,
+			HTLCMinimumMSat:          1000,
+			MaxAcceptedHTLCs:         30,
+			ChannelCapacityMSat:      1000000000,
+		},
+		Features:        supportedFeatures,
+		ProtocolVersion: hcwire.ProtocolVersion2,
+		LastCrossSignedState: hcwire.LastCrossSignedState{
+			IsHost:                 true,
+			LastRefundScriptPubKey: getTestRefundScriptPubKey(),
+			Blockday:               5014,
+			LocalBalanceMSat:       999900000,
+			RemoteBalanceMSat:      0,
+			LocalUpdates:           5,
+			RemoteUpdates:          3,
+			OutgoingHTLCs:          []lnwire.UpdateAddHTLC{add.UpdateAddHTLC},
+			RemoteSigOfLocal:       [64]byte{3},
+			LocalSigOfRemote:       [64]byte{4},
+		},
+		NextLocalUpdates: []hcwire.Message{add},
+		NextRemoteUpdates: []hcwire.Message{&hcwire.UpdateFulfillHTLC{
+			UpdateFulfillHTLC: lnwire.UpdateFulfillHTLC{ChanID: channelID, ID: 4, PaymentPreimage: [32]byte{7}},
+		}},
+		SentStateUpdate: true,
+		ForwardedHTLCs:  map[uint64]IncomingHTLC{4: {ShortChannelID: "800000x1x0", ID: 9}},
+	}
+}
+
+// reads what was written back the way encodeChannel leaves it
+func assertSameChannel(t *testing.T, expected, actual Channel) {
+	expectedBytes, err := encodeChannel(expected)
+	require.NoError(t, err)
+	reencoded, err := decodeChannel(expectedBytes)
+	require.NoError(t, err)
+
+	assert.Equal(t, reencoded, actual)
+}
+
+func TestChannelRoundTrip(t *testing.T) {
+	channel := getTestChannel()
+
+	b, err := encodeChannel(channel)
+	require.NoError(t, err)
+	decoded, err := decodeChannel(b)
+	require.NoError(t, err)
+
+	// gob drops what's empty so check the fields it could lose one by one
+	assert.Equal(t, channel.ChannelID, decoded.ChannelID)
+	assert.Equal(t, channel.ErrorReason, decoded.ErrorReason)
+	assert.Equal(t, channel.StateOverride, decoded.StateOverride)
+	assert.Equal(t, channel.ProtocolVersion, decoded.ProtocolVersion)
+	assert.Equal(t, channel.Features, decoded.Features)
+	assert.Equal(t, channel.SentStateUpdate, decoded.SentStateUpdate)
+	assert.Equal(t, channel.ForwardedHTLCs, decoded.ForwardedHTLCs)
+
+	expectedHash, err := channel.LastCrossSignedState.HostedSigHash()
+	require.NoError(t, err)
+	decodedHash, err := decoded.LastCrossSignedState.HostedSigHash()
+	require.NoError(t, err)
+	assert.Equal(t, expectedHash, decodedHash)
+	assert.Equal(t, channel.LastCrossSignedState.RemoteSigOfLocal, decoded.LastCrossSignedState.RemoteSigOfLocal)
+	assert.Equal(t, channel.LastCrossSignedState.LocalSigOfRemote, decoded.LastCrossSignedState.LocalSigOfRemote)
+
+	require.Len(t, decoded.NextLocalUpdates, 1)
+	assert.Equal(t, channel.NextLocalUpdates[0].(*hcwire.UpdateAddHTLC).PaymentHash, decoded.NextLocalUpdates[0].(*hcwire.UpdateAddHTLC).PaymentHash)
+	require.Len(t, decoded.NextRemoteUpdates, 1)
+	assert.Equal(t, channel.NextRemoteUpdates[0].(*hcwire.UpdateFulfillHTLC).PaymentPreimage, decoded.NextRemoteUpdates[0].(*hcwire.UpdateFulfillHTLC).PaymentPreimage)
+
+	// and a second trip changes nothing
+	assertSameChannel(t, decoded, decoded)
+}
+
+func TestChannelSurvivesReopen(t *testing.T) {
+	db, path := getTestDB(t)
+	channel := getTestChannel()
+	require.NoError(t, db.saveChannel(channel))
+	require.NoError(t, db.Close())
+
+	db, err := openDB(path, t.Logf)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	stored, err := db.getChannel(channel.PeerID)
+	require.NoError(t, err)
+	assertSameChannel(t, channel, stored)
+
+	byID, err := db.getChannelByID(channel.ChannelID)
+	require.NoError(t, err)
+	assert.Equal(t, stored, byID)
+
+	byShortChannelID, err := db.getChannelByShortChannelID(channel.ShortChannelID())
+	require.NoError(t, err)
+	assert.Equal(t, stored, byShortChannelID)
+}
+
+func TestUpdateChannel(t *testing.T) {
+	db, _ := getTestDB(t)
+	channel := getTestChannel()
+	require.NoError(t, db.saveChannel(channel))
+
+	updated, err := db.updateChannel(channel.PeerID, func(c *Channel) error {
+		c.Status = StatusOpen
+		c.ErrorReason = nil
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, StatusOpen, updated.Status)
+
+	stored, err := db.getChannel(channel.PeerID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusOpen, stored.Status)
+	assert.Nil(t, stored.ErrorReason)
+
+	// nothing is written when f fails
+	_, err = db.updateChannel(channel.PeerID, func(c *Channel) error {
+		c.Status = StatusSuspended
+		return errChannelNotFound
+	})
+	assert.Error(t, err)
+	stored, err = db.getChannel(channel.PeerID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusOpen, stored.Status)
+
+	_, err = db.updateChannel("03cd", func(c *Channel) error { return nil })
+	assert.Equal(t, errChannelNotFound, err)
+}
+
+func TestListAndDeleteChannels(t *testing.T) {
+	db, _ := getTestDB(t)
+	channel := getTestChannel()
+	other := getTestChannel()
+	other.PeerID = "03cd"
+	other.ChannelID = lnwire.ChannelID{4, 5, 6}
+	require.NoError(t, db.saveChannel(channel))
+	require.NoError(t, db.saveChannel(other))
+
+	channels, err := db.listChannels()
+	require.NoError(t, err)
+	assert.Len(t, channels, 2)
+
+	require.NoError(t, db.deleteChannel(channel.PeerID))
+	_, err = db.getChannel(channel.PeerID)
+	assert.Equal(t, errChannelNotFound, err)
+	_, err = db.getChannelByID(channel.ChannelID)
+	assert.Equal(t, errChannelNotFound, err)
+
+	channels, err = db.listChannels()
+	require.NoError(t, err)
+	assert.Len(t, channels, 1)
+
+	// deleting what isn't there is fine
+	assert.NoError(t, db.deleteChannel(channel.PeerID))
+
+	// a record that doesn't decode is left out of the list
+	require.NoError(t, db.leveldb.Put(channelKey("04ef"), []byte{1, 2, 3}, nil))
+	channels, err = db.listChannels()
+	require.NoError(t, err)
+	require.Len(t, channels, 1)
+	assert.Equal(t, other.PeerID, channels[0].PeerID)
+}
+
+func TestShortChannelIDIndex(t *testing.T) {
+	db, path := getTestDB(t)
+	channel := getTestChannel()
+	require.NoError(t, db.saveChannel(channel))
+
+	stored, err := db.getChannelByShortChannelID(channel.ShortChannelID())
+	require.NoError(t, err)
+	assert.Equal(t, channel.PeerID, stored.PeerID)
+
+	// invoked again with another refund script: the old ids point nowhere
+	previous := channel.ShortChannelID()
+	channel.ChannelID = lnwire.ChannelID{7, 8, 9}
+	require.NoError(t, db.saveChannel(channel))
+	_, err = db.getChannelByShortChannelID(previous)
+	assert.Equal(t, errChannelNotFound, err)
+	_, err = db.getChannelByID(lnwire.ChannelID{1, 2, 3})
+	assert.Equal(t, errChannelNotFound, err)
+	stored, err = db.getChannelByShortChannelID(channel.ShortChannelID())
+	require.NoError(t, err)
+	assert.Equal(t, channel.ChannelID, stored.ChannelID)
+
+	// a database from before the index gets it when opened
+	require.NoError(t, db.leveldb.Delete(shortChannelIDKey(channel.ShortChannelID()), nil))
+	require.NoError(t, db.Close())
+	db, err = openDB(path, t.Logf)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	stored, err = db.getChannelByShortChannelID(channel.ShortChannelID())
+	require.NoError(t, err)
+	assert.Equal(t, channel.PeerID, stored.PeerID)
+
+	require.NoError(t, db.deleteChannel(channel.PeerID))
+	_, err = db.getChannelByShortChannelID(channel.ShortChannelID())
+	assert.Equal(t, errChannelNotFound, err)
+}
+
+func TestPreimagesAndResizePayments(t *testing.T) {
+	db, _ := getTestDB(t)
+	preimage := [32]byte{7}
+	hash := sha256.Sum256(preimage[:])
+
+	_, err := db.getPreimage(hash)
+	assert.Error(t, err)
+	require.NoError(t, db.savePreimage(preimage))
+	stored, err := db.getPreimage(hash)
+	require.NoError(t, err)
+	assert.Equal(t, preimage, stored)
+
+	used, err := db.isResizePaymentUsed(hash)
+	require.NoError(t, err)
+	assert.False(t, used)
+
+	// reserved by one peer until it's released or used
+	require.NoError(t, db.reserveResizePayment(hash, "02ab"))
+	require.NoError(t, db.reserveResizePayment(hash, "02ab"))
+	assert.Error(t, db.reserveResizePayment(hash, "03cd"))
+	require.NoError(t, db.releaseResizePayment(hash, "03cd"))
+	assert.Error(t, db.reserveResizePayment(hash, "03cd"))
+	require.NoError(t, db.releaseResizePayment(hash, "02ab"))
+	require.NoError(t, db.reserveResizePayment(hash, "03cd"))
+	used, err = db.isResizePaymentUsed(hash)
+	require.NoError(t, err)
+	assert.False(t, used)
+
+	require.NoError(t, db.markResizePaymentUsed(hash))
+	used, err = db.isResizePaymentUsed(hash)
+	require.NoError(t, err)
+	assert.True(t, used)
+	assert.Error(t, db.reserveResizePayment(hash, "03cd"))
+}
+
+func TestBranding(t *testing.T) {
+	db, _ := getTestDB(t)
+
+	_, err := db.getBranding("02ab")
+	assert.Equal(t, errBrandingNotFound, err)
+
+	branding := &hcwire.HostedChannelBranding{RGBColor: [3]byte{1, 2, 3}, ContactInfo: "hello@example.com"}
+	require.NoError(t, db.saveBranding("02ab", branding))
+	stored, err := db.getBranding("02ab")
+	require.NoError(t, err)
+	assert.Equal(t, branding.RGBColor, stored.RGBColor)
+	assert.Equal(t, branding.ContactInfo, stored.ContactInfo)
+}
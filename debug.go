@@ -0,0 +1,113 @@
+package main
+
+/*
+DEBUGGING custommsg traffic from lightning-cli:
+- hc-decode turns a payload as the custommsg hook has it (type + message, hex) into json
+- hc-encode does the opposite; the payload can be sent with sendcustommsg
+- both use the protocol_version they're given, else the one negotiated with node_id,
+  else version 1; only error messages differ between versions
+*/
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+	"github.com/raphjaph/go-hosted-channels/hcwire"
+	"github.com/tidwall/gjson"
+)
+
+// null is what lightning-cli passes for a positional parameter that's left out
+func isParamSet(r gjson.Result) bool {
+	return r.Exists() && r.Type != gjson.Null
+}
+
+func parseProtocolVersion(r gjson.Result) (uint32, error) {
+	if !isParamSet(r) {
+		return hcwire.ProtocolVersion1, nil
+	}
+
+	version := uint32(r.Uint())
+	if version < hcwire.ProtocolVersion1 || version > hcwire.LatestProtocolVersion {
+		return 0, fmt.Errorf("unknown protocol_version %v", r.Raw)
+	}
+
+	return version, nil
+}
+
+func decodeMessage(payload string, pver uint32) (hcwire.Message, error) {
+	b, err := hex.DecodeString(payload)
+	if err != nil {
+		return nil, fmt.Errorf("payload isn't hex: %v", err)
+	}
+
+	return hcwire.ReadMessage(bytes.NewReader(b), pver)
+}
+
+func encodeMessage(message []byte, pver uint32) (string, error) {
+	msg, err := hcwire.UnmarshalJSONMessage(message)
+	if err != nil {
+		return "", err
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := hcwire.WriteMessage(buf, msg, pver); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf.Bytes()), nil
+}
+
+// the version messages from/to node_id are encoded with unless protocol_version is given
+func getDebugProtocolVersion(params plugin.Params) (uint32, error) {
+	nodeID := params.Get("node_id")
+	if isParamSet(params.Get("protocol_version")) || !isParamSet(nodeID) {
+		return parseProtocolVersion(params.Get("protocol_version"))
+	}
+
+	if _, err := parseNodeID(nodeID.String()); err != nil {
+		return 0, fmt.Errorf("invalid node_id: %v", err)
+	}
+
+	// the version changes while messages are handled
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	return getProtocolVersion(nodeID.String()), nil
+}
+
+func hcDecode(p *plugin.Plugin, params plugin.Params) (interface{}, int, error) {
+	pver, err := getDebugProtocolVersion(params)
+	if err != nil {
+		return nil, 1, err
+	}
+
+	msg, err := decodeMessage(params.Get("payload").String(), pver)
+	if err != nil {
+		return nil, 1, err
+	}
+
+	return msg, 0, nil
+}
+
+func hcEncode(p *plugin.Plugin, params plugin.Params) (interface{}, int, error) {
+	pver, err := getDebugProtocolVersion(params)
+	if err != nil {
+		return nil, 1, err
+	}
+
+	// lightning-cli passes json objects as they are but quoted ones as strings
+	message := params.Get("message")
+	raw := message.Raw
+	if message.Type == gjson.String {
+		raw = message.String()
+	}
+
+	payload, err := encodeMessage([]byte(raw), pver)
+	if err != nil {
+		return nil, 1, err
+	}
+
+	return map[string]interface{}{"payload": payload}, 0, nil
+}
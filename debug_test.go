@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+	"github.com/raphjaph/go-hosted-channels/hcwire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeWithNodeVersion(t *testing.T) {
+	client := newTestNode(t, optionFlags{})
+	host := newTestNode(t, optionFlags{})
+	openTestChannel(t, client, host)
+	require.Equal(t, hcwire.ProtocolVersion2, client.channel(t, host).ProtocolVersion)
+
+	// only errors differ between versions
+	channelError := hcwire.NewChannelError(client.channel(t, host).ChannelID, hcwire.ErrChannelDenied, "no")
+	buf := new(bytes.Buffer)
+	_, err := hcwire.WriteMessage(buf, channelError, hcwire.ProtocolVersion2)
+	require.NoError(t, err)
+	payload := hex.EncodeToString(buf.Bytes())
+
+	tests := []struct {
+		name   string
+		params plugin.Params
+		pver   uint32
+	}{
+		{"version of the channel", plugin.Params{"payload": payload, "node_id": host.id}, hcwire.ProtocolVersion2},
+		{"left out positionally", plugin.Params{"payload": payload, "protocol_version": nil, "node_id": host.id}, hcwire.ProtocolVersion2},
+		{"given version wins", plugin.Params{"payload": payload, "protocol_version": 1, "node_id": host.id}, hcwire.ProtocolVersion1},
+		{"no channel", plugin.Params{"payload": payload, "node_id": client.id}, hcwire.ProtocolVersion1},
+		{"neither", plugin.Params{"payload": payload}, hcwire.ProtocolVersion1},
+	}
+
+	client.use()
+	for _, test := range tests {
+		pver, err := getDebugProtocolVersion(test.params)
+		require.NoError(t, err, test.name)
+		assert.Equal(t, test.pver, pver, test.name)
+	}
+
+	decoded, _, err := hcDecode(client.p, plugin.Params{"payload": payload, "node_id": host.id})
+	require.NoError(t, err)
+	assert.Equal(t, channelError, decoded)
+
+	encoded, _, err := hcEncode(client.p, plugin.Params{"message": channelError, "node_id": host.id})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"payload": payload}, encoded)
+
+	_, _, err = hcDecode(client.p, plugin.Params{"payload": payload, "node_id": "nope"})
+	assert.Error(t, err)
+}
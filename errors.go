@@ -0,0 +1,137 @@
+package main
+
+/*
+ERRORS:
+- protocol violations error the channel: we send the peer an error message with a
+  code from the RFC and keep the reason on the channel until a state override
+- errors from the peer error the channel the same way (or drop it if it wasn't open yet)
+- htlcs we can't add to a hosted channel are failed upstream with BOLT 4 failures
+*/
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/raphjaph/go-hosted-channels/hcwire"
+)
+
+// why a channel is errored
+type ChannelError struct {
+	Code     hcwire.ErrorCode // empty for violations without a code in the RFC
+	Details  string
+	FromPeer bool // the peer sent it; otherwise we did
+}
+
+func newChannelError(code hcwire.ErrorCode, format string, args ...interface{}) *ChannelError {
+	return &ChannelError{Code: code, Details: fmt.Sprintf(format, args...)}
+}
+
+func (e *ChannelError) Error() string {
+	if e.Code == "" {
+		return e.Details
+	}
+
+	return fmt.Sprintf("%v: %v", e.Code, e.Details)
+}
+
+// marks the channel as errored, tells the peer and passes the error on
+func errorChannel(p *plugin.Plugin, channel Channel, err error) error {
+	chanErr, ok := err.(*ChannelError)
+	if !ok {
+		chanErr = &ChannelError{Details: err.Error()}
+	}
+
+	channel.Status = StatusErrored
+	channel.ErrorReason = chanErr
+	if dbErr := store.saveChannel(channel); dbErr != nil {
+		return dbErr
+	}
+
+	if sendErr := sendChannelError(p, channel); sendErr != nil {
+		p.Logf("couldn't send error to %v: %v", channel.PeerID, sendErr)
+	}
+	invokeWaiters.notify(channel.PeerID, chanErr)
+	resizeWaiters.notify(channel.PeerID, chanErr)
+	failUnsignedHTLCWaiters(channel)
+	releaseResizePayments(p, channel, channel.NextRemoteUpdates)
+
+	return chanErr
+}
+
+// (re)sends the reason we errored the channel
+func sendChannelError(p *plugin.Plugin, channel Channel) error {
+	if channel.ErrorReason == nil || channel.ErrorReason.FromPeer {
+		return nil
+	}
+
+	return sendMessage(p, channel.PeerID, hcwire.NewChannelError(channel.ChannelID, channel.ErrorReason.Code, channel.ErrorReason.Details))
+}
+
+// refuses to open a channel with peer; there is no channel id to refer to yet
+func denyChannel(p *plugin.Plugin, peer string, err error) error {
+	if sendErr := sendMessage(p, peer, hcwire.NewChannelError(lnwire.ChannelID{}, hcwire.ErrChannelDenied, err.Error())); sendErr != nil {
+		p.Logf("couldn't send error to %v: %v", peer, sendErr)
+	}
+
+	return err
+}
+
+// the peer errored our channel
+func handleRemoteError(p *plugin.Plugin, peer string, remoteErr *hcwire.Error) error {
+	channel, err := store.getChannel(peer)
+	if err != nil {
+		return err
+	}
+	if remoteErr.ChanID != (lnwire.ChannelID{}) && remoteErr.ChanID != channel.ChannelID {
+		return fmt.Errorf("error for unknown channel %v", remoteErr.ChanID)
+	}
+
+	chanErr := &ChannelError{Code: remoteErr.Code(), Details: remoteErr.Details(), FromPeer: true}
+	p.Logf("%v errored channel %v: %v", peer, channel.ChannelID, chanErr)
+	invokeWaiters.notify(peer, chanErr)
+	resizeWaiters.notify(peer, chanErr)
+	failUnsignedHTLCWaiters(channel)
+	releaseResizePayments(p, channel, channel.NextRemoteUpdates)
+
+	// the peer refused to open the channel; nothing was signed yet
+	if channel.Status == StatusInvoked {
+		return store.deleteChannel(peer)
+	}
+
+	channel.Status = StatusErrored
+	channel.ErrorReason = chanErr
+
+	return store.saveChannel(channel)
+}
+
+// htlcs of an errored channel that were never cross signed can't end up in a state
+// anymore; signed ones wait for the override or their preimage
+func failUnsignedHTLCWaiters(channel Channel) {
+	for _, htlc := range unsignedOutgoingHTLCs(channel) {
+		htlcWaiters.notify(htlcKey{htlc.ChanID, htlc.ID}, htlcResult{})
+	}
+}
+
+// BOLT 4 failure for an htlc we couldn't add to a hosted channel
+func channelFailure(err error) lnwire.FailureMessage {
+	if _, ok := err.(*ChannelError); ok {
+		// errored channels stay that way until the host overrides the state
+		return &lnwire.FailPermanentChannelFailure{}
+	}
+
+	return lnwire.NewTemporaryChannelFailure(nil)
+}
+
+// htlc_accepted response failing the htlc; lightningd wraps the failure in an onion
+func failHTLC(failure lnwire.FailureMessage) map[string]interface{} {
+	buf := new(bytes.Buffer)
+	if err := lnwire.EncodeFailure(buf, failure, 0); err != nil {
+		// temporary_node_failure
+		return map[string]interface{}{"result": "fail", "failure_message": "2002"}
+	}
+
+	return map[string]interface{}{"result": "fail", "failure_message": hex.EncodeToString(buf.Bytes())}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/raphjaph/go-hosted-channels/hcwire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorChannel(t *testing.T) {
+	client := newTestNode(t, optionFlags{})
+	host := newTestNode(t, optionFlags{})
+	openTestChannel(t, client, host)
+
+	// an htlc the client never gets
+	host.use()
+	stateMu.Lock()
+	add := getTestHTLC(host.channel(t, client), [32]byte{8})
+	htlcWaiter, err := addLocalHTLC(host.p, host.channel(t, client), add)
+	stateMu.Unlock()
+	require.NoError(t, err)
+	host.ln.takeSent()
+	resizeWaiter := resizeWaiters.add(host.id)
+	defer resizeWaiters.remove(host.id, resizeWaiter)
+
+	err = errorChannel(host.p, host.channel(t, client), newChannelError(hcwire.ErrManualSuspend, "bye"))
+	assert.Equal(t, &ChannelError{Code: hcwire.ErrManualSuspend, Details: "bye"}, err)
+	select {
+	case result := <-htlcWaiter:
+		assert.Equal(t, htlcResult{}, result)
+	case <-time.After(time.Second):
+		t.Fatal("the htlc wasn't failed")
+	}
+
+	delivered := exchange(t, host, client)
+	require.Len(t, delivered, 1)
+	remoteErr, ok := delivered[0].(*hcwire.Error)
+	require.True(t, ok, "%v", delivered[0])
+	assert.Equal(t, hcwire.ErrManualSuspend, remoteErr.Code())
+
+	channel := host.channel(t, client)
+	assert.Equal(t, StatusErrored, channel.Status)
+	assert.Equal(t, &ChannelError{Code: hcwire.ErrManualSuspend, Details: "bye"}, channel.ErrorReason)
+	channel = client.channel(t, host)
+	assert.Equal(t, StatusErrored, channel.Status)
+	assert.Equal(t, &ChannelError{Code: hcwire.ErrManualSuspend, Details: "bye", FromPeer: true}, channel.ErrorReason)
+	select {
+	case err := <-resizeWaiter:
+		assert.Equal(t, channel.ErrorReason, err)
+	case <-time.After(time.Second):
+		t.Fatal("the resize wasn't failed")
+	}
+
+	// only the side that errored the channel resends the error
+	host.use()
+	require.NoError(t, sendChannelError(host.p, host.channel(t, client)))
+	assert.Len(t, host.ln.takeSent(), 1)
+	client.use()
+	require.NoError(t, sendChannelError(client.p, client.channel(t, host)))
+	assert.Empty(t, client.ln.takeSent())
+}
+
+func TestChannelDenied(t *testing.T) {
+	client := newTestNode(t, optionFlags{})
+	host := newTestNode(t, optionFlags{})
+
+	client.use()
+	require.NoError(t, clientStartInvoke(client.p, host.id, getTestRefundScriptPubKey()))
+	invokeWaiter := invokeWaiters.add(host.id)
+	defer invokeWaiters.remove(host.id, invokeWaiter)
+
+	host.use()
+	assert.Error(t, denyChannel(host.p, client.id, fmt.Errorf("no more channels")))
+	exchange(t, host, client)
+
+	select {
+	case err := <-invokeWaiter:
+		assert.Equal(t, &ChannelError{Code: hcwire.ErrChannelDenied, Details: "no more channels", FromPeer: true}, err)
+	case <-time.After(time.Second):
+		t.Fatal("the invoke wasn't failed")
+	}
+
+	// nothing was signed so the channel is gone
+	client.use()
+	_, err := store.getChannel(host.id)
+	assert.Equal(t, errChannelNotFound, err)
+}
+
+func TestChannelFailure(t *testing.T) {
+	assert.Equal(t, &lnwire.FailPermanentChannelFailure{}, channelFailure(newChannelError(hcwire.ErrWrongBlockday, "")))
+	assert.Equal(t, lnwire.NewTemporaryChannelFailure(nil), channelFailure(fmt.Errorf("channel is invoked")))
+}
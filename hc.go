@@ -1,33 +1,172 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
-	"fmt"
-	"math/rand"
 
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
 	"github.com/lightningnetwork/lnd/lnwire"
 	"github.com/raphjaph/go-hosted-channels/hcwire"
 )
 
+type ChannelStatus string
+
+const (
+	StatusInvoked   ChannelStatus = "invoked"   // waiting for the signatures of the first state
+	StatusOpen      ChannelStatus = "open"      // both signatures of the last state exist
+	StatusSuspended ChannelStatus = "suspended" // re-establishment in progress or states couldn't be reconciled
+	StatusErrored   ChannelStatus = "errored"   // protocol violation; only a state override can reopen it
+)
+
 type Channel struct {
 	ChannelID            lnwire.ChannelID
 	PeerID               string
+	IsHost               bool
+	Status               ChannelStatus
+	ErrorReason          *ChannelError               // why the channel is errored
+	StateOverride        *hcwire.StateOverride       // new state for an errored channel the host proposed
 	InitHostedChannel    hcwire.InitHostedChannel    // parameters of the channel: size, refund_addr, etc.
+	Features             hcwire.FeatureVector        // extensions negotiated during establishment
+	ProtocolVersion      uint32                      // version of the messages exchanged with the peer; 0 for version 1
 	LastCrossSignedState hcwire.LastCrossSignedState // current state; similar to committment transaction + revokation key
+
+	// htlc updates sent by us/the peer that are not part of LastCrossSignedState yet
+	NextLocalUpdates  []hcwire.Message
+	NextRemoteUpdates []hcwire.Message
+	SentStateUpdate   bool // we signed the state including all pending updates
+
+	// our pending htlcs that forward one lightningd holds, by our htlc id
+	ForwardedHTLCs map[uint64]IncomingHTLC
 }
 
-func getGenesisHash() [32]byte {
+// an htlc lightningd passed to htlc_accepted; the same one may be passed again after a restart
+type IncomingHTLC struct {
+	ShortChannelID string
+	ID             uint64
+}
+
+// hosted channel extensions this plugin implements; offered to every peer
+var supportedFeatures = hcwire.NewFeatureVector(hcwire.ResizableChannelsOptional, hcwire.BrandingOptional, hcwire.PreimageQueriesOptional)
+
+func (c *Channel) HasFeature(bit hcwire.FeatureBit) bool {
+	return c.Features.HasFeature(bit)
+}
+
+// network names as given by lightningd
+func getChainParams(network string) *chaincfg.Params {
+	switch network {
+	case "testnet":
+		return &chaincfg.TestNet3Params
+	case "regtest":
+		return &chaincfg.RegressionNetParams
+	case "signet":
+		return &chaincfg.SigNetParams
+	default:
+		return &chaincfg.MainNetParams
+	}
+}
+
+func getGenesisHash(network string) [32]byte {
 	var genesisHash [32]byte
-	hash, _ := hex.DecodeString("000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f")
-	copy(genesisHash[:], hash)
+	copy(genesisHash[:], getChainParams(network).GenesisHash[:])
 	return genesisHash
 }
 
-func getRandomShortChannelID() string {
-	rand.Seed(42)
-	return fmt.Sprintf("%vx%vx%v", rand.Intn(1000), rand.Intn(1000), rand.Intn(1000))
+// channel id = sha256(lexicographically smaller pubkey || larger pubkey || refund_scriptpubkey)
+// so host and client derive the same id without exchanging it
+func deriveChannelID(pubKey1, pubKey2 *btcec.PublicKey, refundScriptPubKey []byte) lnwire.ChannelID {
+	key1 := pubKey1.SerializeCompressed()
+	key2 := pubKey2.SerializeCompressed()
+	if bytes.Compare(key1, key2) > 0 {
+		key1, key2 = key2, key1
+	}
+
+	h := sha256.New()
+	h.Write(key1)
+	h.Write(key2)
+	h.Write(refundScriptPubKey)
+
+	var channelID lnwire.ChannelID
+	copy(channelID[:], h.Sum(nil))
+	return channelID
+}
+
+// hosted channels have no funding transaction so the short channel id used in
+// routing hints is derived from the channel id; the highest bit of the block
+// height is set so it can't collide with a real channel
+func deriveShortChannelID(channelID lnwire.ChannelID) lnwire.ShortChannelID {
+	scid := lnwire.NewShortChanIDFromInt(binary.BigEndian.Uint64(channelID[:8]))
+	scid.BlockHeight |= 1 << 23
+	return scid
+}
+
+func (c *Channel) ShortChannelID() lnwire.ShortChannelID {
+	return deriveShortChannelID(c.ChannelID)
+}
+
+func getChannelID(p *plugin.Plugin, peer string, refundScriptPubKey []byte) (lnwire.ChannelID, error) {
+	nodeKey, err := getNodeKey(p)
+	if err != nil {
+		return lnwire.ChannelID{}, err
+	}
+
+	peerKey, err := parseNodeID(peer)
+	if err != nil {
+		return lnwire.ChannelID{}, err
+	}
+
+	return deriveChannelID(nodeKey.PubKey(), peerKey, refundScriptPubKey), nil
 }
 
-func getNodeKey() {
+// private key of the lightningd node we're running on; it's read from the
+// hsm_secret so this doesn't work with an encrypted hsm_secret
+func getNodeKey(p *plugin.Plugin) (*btcec.PrivateKey, error) {
+	return p.Client.GetPrivateKey()
+}
+
+func parseNodeID(nodeID string) (*btcec.PublicKey, error) {
+	b, err := hex.DecodeString(nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	return btcec.ParsePubKey(b, btcec.S256())
+}
+
+// the RFC measures time in blockdays (block height / 144)
+func getBlockday(p *plugin.Plugin) (uint32, error) {
+	info, err := p.Client.Call("getinfo")
+	if err != nil {
+		return 0, err
+	}
+
+	return uint32(info.Get("blockheight").Int() / 144), nil
+}
+
+// version 1 until a channel with peer negotiated another one
+func getProtocolVersion(peer string) uint32 {
+	channel, err := store.getChannel(peer)
+	if err != nil || channel.ProtocolVersion == 0 {
+		return hcwire.ProtocolVersion1
+	}
+
+	return channel.ProtocolVersion
+}
+
+func sendMessage(p *plugin.Plugin, peer string, msg hcwire.Message) error {
+	buf := new(bytes.Buffer)
+	if _, err := hcwire.WriteMessage(buf, msg, getProtocolVersion(peer)); err != nil {
+		return err
+	}
+	payload := hex.EncodeToString(buf.Bytes())
+
+	p.Logf("sending %v to %v", msg.MsgType(), peer)
+	recordMessage(p, peer, directionOut, payload)
+	_, err := p.Client.Call("sendcustommsg", peer, payload)
 
+	return err
 }
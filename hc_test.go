@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/raphjaph/go-hosted-channels/hcwire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+)
+
+const testBlockheight = 800000
+
+// a node running the plugin against a fake lightningd; the state machine has a
+// single global store so only one node is active at a time (see use)
+type testNode struct {
+	p            *plugin.Plugin
+	db           *DB
+	ln           *fakeLightningd
+	id           string
+	lightningDir string
+}
+
+func newTestNode(t *testing.T, options optionFlags) *testNode {
+	dir := t.TempDir()
+
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "hsm_secret"), secret, 0600))
+
+	db, err := openDB(filepath.Join(dir, "hc-database"), t.Logf)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	args, err := replayArgs(options)
+	require.NoError(t, err)
+
+	p := &plugin.Plugin{
+		Client: &lightning.Client{
+			Path:         filepath.Join(dir, "lightning-rpc"),
+			LightningDir: dir,
+			CallTimeout:  5 * time.Second,
+		},
+		Network: "regtest",
+		Args:    args,
+		Log:     t.Log,
+		Logf:    t.Logf,
+	}
+
+	key, err := getNodeKey(p)
+	require.NoError(t, err)
+	id := hex.EncodeToString(key.PubKey().SerializeCompressed())
+
+	ln, err := startFakeLightningd(p.Client.Path, id)
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.listener.Close() })
+	ln.setBlockheight(testBlockheight)
+
+	node := &testNode{p: p, db: db, ln: ln, id: id, lightningDir: dir}
+	t.Cleanup(func() { store = nil })
+
+	return node
+}
+
+// answers method with handler instead of the defaults; tests use it for the
+// parts of lightningd a replay can't have
+func (ln *fakeLightningd) handle(method string, handler func(params gjson.Result) (interface{}, error)) {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+
+	if ln.methods == nil {
+		ln.methods = make(map[string]func(gjson.Result) (interface{}, error))
+	}
+	ln.methods[method] = handler
+}
+
+// makes the global store the node's
+func (n *testNode) use() {
+	store = n.db
+}
+
+func (n *testNode) channel(t *testing.T, peer *testNode) Channel {
+	n.use()
+	channel, err := store.getChannel(peer.id)
+	require.NoError(t, err)
+	return channel
+}
+
+// hands what from sent to to's custommsg hook until neither has anything left to say;
+// returns the messages in the order they were delivered
+func exchange(t *testing.T, a, b *testNode) []hcwire.Message {
+	var delivered []hcwire.Message
+	for {
+		sentA, sentB := a.ln.takeSent(), b.ln.takeSent()
+		if len(sentA) == 0 && len(sentB) == 0 {
+			return delivered
+		}
+
+		for _, pair := range []struct {
+			from, to *testNode
+			sent     []sentMessage
+		}{{a, b, sentA}, {b, a, sentB}} {
+			for _, sent := range pair.sent {
+				require.Equal(t, pair.to.id, sent.peer)
+
+				pair.to.use()
+				msg, err := decodeMessage(sent.payload, getProtocolVersion(pair.from.id))
+				require.NoError(t, err)
+				delivered = append(delivered, msg)
+
+				handlePeerMessage(pair.to.p, pair.from.id, sent.payload, false)
+			}
+		}
+	}
+}
+
+func getTestRefundScriptPubKey() []byte {
+	script, _ := hex.DecodeString("0014751e76e8199196d454941c45d1b3a323f1433bd6")
+	return script
+}
+
+// the invoke_hosted_channel hc-invoke and reconnecting clients send
+func sendTestInvoke(t *testing.T, client, host *testNode) {
+	client.use()
+	invokeHC := &hcwire.InvokeHostedChannel{
+		ChainHash:          getGenesisHash(client.p.Network),
+		RefundScriptPubKey: getTestRefundScriptPubKey(),
+	}
+	require.NoError(t, invokeHC.SetFeatures(supportedFeatures))
+	require.NoError(t, invokeHC.SetProtocolVersion(hcwire.LatestProtocolVersion))
+	require.NoError(t, sendMessage(client.p, host.id, invokeHC))
+}
+
+// client invokes a channel with host and both run the establishment; returns what they sent
+func openTestChannel(t *testing.T, client, host *testNode) []hcwire.Message {
+	client.use()
+	require.NoError(t, clientStartInvoke(client.p, host.id, getTestRefundScriptPubKey()))
+	sendTestInvoke(t, client, host)
+
+	delivered := exchange(t, client, host)
+
+	require.Equal(t, StatusOpen, client.channel(t, host).Status)
+	require.Equal(t, StatusOpen, host.channel(t, client).Status)
+
+	return delivered
+}
+
+// node sends update to peer the way hc-pay, htlc_accepted or a resolved htlc would
+func sendTestUpdate(t *testing.T, node, peer *testNode, update hcwire.Message) {
+	node.use()
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	channel, err := store.getChannel(peer.id)
+	require.NoError(t, err)
+	require.NoError(t, sendLocalUpdate(node.p, &channel, update))
+	require.NoError(t, store.saveChannel(channel))
+}
+
+func getTestHTLC(channel Channel, preimage [32]byte) *hcwire.UpdateAddHTLC {
+	return &hcwire.UpdateAddHTLC{
+		UpdateAddHTLC: lnwire.UpdateAddHTLC{
+			ChanID:      channel.ChannelID,
+			ID:          nextLocalHTLCID(channel),
+			Amount:      lnwire.MilliSatoshi(100000),
+			PaymentHash: sha256.Sum256(preimage[:]),
+			Expiry:      testBlockheight + 144,
+		},
+	}
+}
+
+// host adds an htlc to the open channel and client fulfills it
+func payTestHTLC(t *testing.T, client, host *testNode) {
+	preimage := [32]byte{7}
+	add := getTestHTLC(host.channel(t, client), preimage)
+	sendTestUpdate(t, host, client, add)
+	exchange(t, host, client)
+
+	channel := client.channel(t, host)
+	require.Len(t, channel.LastCrossSignedState.IncomingHTLCs, 1)
+
+	sendTestUpdate(t, client, host, &hcwire.UpdateFulfillHTLC{
+		UpdateFulfillHTLC: lnwire.UpdateFulfillHTLC{
+			ChanID:          channel.ChannelID,
+			ID:              add.ID,
+			PaymentPreimage: preimage,
+		},
+	})
+	exchange(t, client, host)
+}
+
+// both sides signed the same state
+func assertSameState(t *testing.T, client, host *testNode) {
+	clientState := client.channel(t, host).LastCrossSignedState
+	hostChannel := host.channel(t, client)
+	hostState := hostChannel.LastCrossSignedState.Reverse()
+
+	clientHash, err := clientState.HostedSigHash()
+	require.NoError(t, err)
+	hostHash, err := hostState.HostedSigHash()
+	require.NoError(t, err)
+	assert.Equal(t, hostHash, clientHash)
+
+	assert.Equal(t, hostState.LocalBalanceMSat, clientState.LocalBalanceMSat)
+	assert.Equal(t, hostState.LocalUpdates, clientState.LocalUpdates)
+	assert.Equal(t, hostState.RemoteUpdates, clientState.RemoteUpdates)
+	assert.Equal(t, hostState.RemoteSigOfLocal, clientState.RemoteSigOfLocal)
+	assert.Equal(t, hostState.LocalSigOfRemote, clientState.LocalSigOfRemote)
+}
+
+func TestDeriveChannelID(t *testing.T) {
+	key1, err := btcec.NewPrivateKey(btcec.S256())
+	require.NoError(t, err)
+	key2, err := btcec.NewPrivateKey(btcec.S256())
+	require.NoError(t, err)
+	script := getTestRefundScriptPubKey()
+
+	// host and client get the same id whichever key is theirs
+	channelID := deriveChannelID(key1.PubKey(), key2.PubKey(), script)
+	assert.Equal(t, channelID, deriveChannelID(key2.PubKey(), key1.PubKey(), script))
+	assert.NotEqual(t, channelID, deriveChannelID(key1.PubKey(), key2.PubKey(), append(script, 0)))
+
+	// and both ends of an established channel agree
+	client := newTestNode(t, optionFlags{})
+	host := newTestNode(t, optionFlags{})
+	openTestChannel(t, client, host)
+	assert.Equal(t, host.channel(t, client).ChannelID, client.channel(t, host).ChannelID)
+}
+
+func TestDeriveShortChannelID(t *testing.T) {
+	// set whether or not the id has it so it never collides with a real channel
+	for _, channelID := range []lnwire.ChannelID{{}, {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, {1, 2, 3, 4, 5, 6, 7, 8}} {
+		scid := deriveShortChannelID(channelID)
+		assert.NotZero(t, scid.BlockHeight&(1<<23), "%x", channelID)
+		assert.Equal(t, scid, deriveShortChannelID(channelID))
+	}
+
+	assert.NotEqual(t, deriveShortChannelID(lnwire.ChannelID{1}), deriveShortChannelID(lnwire.ChannelID{2}))
+}
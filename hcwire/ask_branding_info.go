@@ -0,0 +1,41 @@
+package hcwire
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/lightningnetwork/lnd/lnwire"
+)
+
+// sent by a client to get the branding of its host
+type AskBrandingInfo struct {
+	ChainHash [32]byte
+	ExtraData lnwire.ExtraOpaqueData
+}
+
+func NewAskBrandingInfo() *AskBrandingInfo {
+	return &AskBrandingInfo{}
+}
+
+var _ Message = (*AskBrandingInfo)(nil)
+
+func (c *AskBrandingInfo) Decode(r io.Reader, pver uint32) error {
+	if _, err := io.ReadFull(r, c.ChainHash[:]); err != nil {
+		return fmt.Errorf("could not parse chain_hash: %v", err)
+	}
+
+	return readExtraData(r, &c.ExtraData)
+}
+
+func (c *AskBrandingInfo) Encode(buf *bytes.Buffer, pver uint32) error {
+	if _, err := buf.Write(c.ChainHash[:]); err != nil {
+		return err
+	}
+
+	return writeExtraData(buf, c.ExtraData)
+}
+
+func (c *AskBrandingInfo) MsgType() MessageType {
+	return MsgAskBrandingInfo
+}
@@ -0,0 +1,175 @@
+package hcwire
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/lightningnetwork/lnd/lnwire"
+)
+
+// ErrorCode is the tag hosted channel errors start with: 4 ascii digits, the
+// rest of the data is a description for humans.
+type ErrorCode string
+
+const (
+	ErrWrongBlockday        ErrorCode = "0001"
+	ErrWrongLocalSig        ErrorCode = "0002" // the sender's own signature in the state it got is invalid
+	ErrWrongRemoteSig       ErrorCode = "0003" // the receiver's signature is invalid
+	ErrClosedByRemotePeer   ErrorCode = "0004"
+	ErrTimedOutOutgoingHTLC ErrorCode = "0005"
+	ErrHTLCExternalFulfill  ErrorCode = "0006"
+	ErrChannelDenied        ErrorCode = "0007"
+	ErrManualSuspend        ErrorCode = "0008"
+	ErrInvalidResize        ErrorCode = "0009"
+	ErrMissingChannel       ErrorCode = "0010"
+	ErrTooManyStateUpdates  ErrorCode = "0011" // not in the RFC: a state_update covering updates we never got
+)
+
+const errorCodeLength = 4
+
+var errorCodeDescriptions = map[ErrorCode]string{
+	ErrWrongBlockday:        "wrong blockday",
+	ErrWrongLocalSig:        "wrong local signature",
+	ErrWrongRemoteSig:       "wrong remote signature",
+	ErrClosedByRemotePeer:   "channel closed by remote peer",
+	ErrTimedOutOutgoingHTLC: "timed out outgoing htlc",
+	ErrHTLCExternalFulfill:  "htlc fulfilled outside of the channel",
+	ErrChannelDenied:        "channel denied",
+	ErrManualSuspend:        "channel suspended manually",
+	ErrInvalidResize:        "invalid resize",
+	ErrMissingChannel:       "missing channel",
+	ErrTooManyStateUpdates:  "too many state updates",
+}
+
+func (c ErrorCode) String() string {
+	description, ok := errorCodeDescriptions[c]
+	if !ok {
+		return string(c)
+	}
+
+	return fmt.Sprintf("%s (%s)", string(c), description)
+}
+
+// Error is lnwire's error message sent as a custom message. errors of hosted
+// channels are all fatal: the channel stays errored until a state override.
+type Error struct {
+	ChanID    lnwire.ChannelID
+	Data      lnwire.ErrorData
+	ExtraData lnwire.ExtraOpaqueData
+}
+
+func NewError() *Error {
+	return &Error{}
+}
+
+// NewChannelError builds an error with code (if any) followed by details
+func NewChannelError(chanID lnwire.ChannelID, code ErrorCode, details string) *Error {
+	data := string(code)
+	if data != "" && details != "" {
+		data += " "
+	}
+
+	return &Error{ChanID: chanID, Data: lnwire.ErrorData(data + details)}
+}
+
+var _ Message = (*Error)(nil)
+
+// in version 1 the code is part of the data; since version 2 it's a u16 before
+// the rest of the data (0 if there is none)
+func (c *Error) Decode(r io.Reader, pver uint32) error {
+	if pver < ProtocolVersion2 {
+		if err := lnwire.ReadElements(r, &c.ChanID, &c.Data); err != nil {
+			return err
+		}
+
+		return readExtraData(r, &c.ExtraData)
+	}
+
+	if _, err := io.ReadFull(r, c.ChanID[:]); err != nil {
+		return fmt.Errorf("could not parse chan_id: %v", err)
+	}
+
+	var code uint16
+	if err := ReadElement(r, &code); err != nil {
+		return err
+	}
+	details, err := ReadVarBytes(r, 65535, "data")
+	if err != nil {
+		return err
+	}
+
+	c.Data = details
+	if code != 0 {
+		c.Data = append([]byte(fmt.Sprintf("%04d", code)), details...)
+	}
+
+	return readExtraData(r, &c.ExtraData)
+}
+
+func (c *Error) Encode(buf *bytes.Buffer, pver uint32) error {
+	if err := lnwire.WriteBytes(buf, c.ChanID[:]); err != nil {
+		return err
+	}
+
+	if pver < ProtocolVersion2 {
+		if err := lnwire.WriteErrorData(buf, c.Data); err != nil {
+			return err
+		}
+
+		return writeExtraData(buf, c.ExtraData)
+	}
+
+	var code uint64
+	details := []byte(c.Data)
+	if c.Code() != "" {
+		code, _ = strconv.ParseUint(string(c.Code()), 10, 16)
+		details = details[errorCodeLength:]
+	}
+	if err := lnwire.WriteUint16(buf, uint16(code)); err != nil {
+		return err
+	}
+	if err := WriteVarBytes(buf, details); err != nil {
+		return err
+	}
+
+	return writeExtraData(buf, c.ExtraData)
+}
+
+func (c *Error) MsgType() MessageType {
+	return MsgError
+}
+
+// Code is the code the data starts with; empty if it's one we don't know
+func (c *Error) Code() ErrorCode {
+	if len(c.Data) < errorCodeLength {
+		return ""
+	}
+
+	code := ErrorCode(c.Data[:errorCodeLength])
+	if _, ok := errorCodeDescriptions[code]; !ok {
+		return ""
+	}
+
+	return code
+}
+
+// Details is the data after the code
+func (c *Error) Details() string {
+	details := string(c.Data)
+	if c.Code() != "" {
+		details = details[errorCodeLength:]
+	}
+
+	return strings.TrimSpace(details)
+}
+
+func (c *Error) Error() string {
+	if code := c.Code(); code != "" {
+		return fmt.Sprintf("chan_id=%v, err=%v: %v", c.ChanID, code, c.Details())
+	}
+
+	return fmt.Sprintf("chan_id=%v, err=%v", c.ChanID, c.Details())
+}
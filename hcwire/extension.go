@@ -0,0 +1,116 @@
+package hcwire
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/tlv"
+)
+
+/*
+every message may end with a tlv stream carrying fields that other (or newer)
+implementations added. following BOLT 1 ("it's OK to be odd"):
+- unknown odd types are ignored but kept in ExtraData so the message encodes to the same bytes again
+- unknown even types are required by the sender and fail decoding
+*/
+
+// returned when a tlv stream contains an even type we don't understand
+type ErrUnknownRequiredType tlv.Type
+
+func (e ErrUnknownRequiredType) Error() string {
+	return fmt.Sprintf("unknown required tlv type %d", tlv.Type(e))
+}
+
+// reads the rest of the message as its extension stream; left nil if there is none
+func readExtraData(r io.Reader, extraData *lnwire.ExtraOpaqueData, known ...tlv.Type) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	*extraData = nil
+	if len(b) > 0 {
+		*extraData = b
+	}
+
+	return ValidateExtraData(*extraData, known...)
+}
+
+func writeExtraData(buf *bytes.Buffer, extraData lnwire.ExtraOpaqueData, known ...tlv.Type) error {
+	if err := ValidateExtraData(extraData, known...); err != nil {
+		return err
+	}
+
+	_, err := buf.Write(extraData)
+
+	return err
+}
+
+// ValidateExtraData checks that extraData is a canonical tlv stream without even
+// types other than the known ones.
+func ValidateExtraData(extraData lnwire.ExtraOpaqueData, known ...tlv.Type) error {
+	stream, err := tlv.NewStream()
+	if err != nil {
+		return err
+	}
+
+	types, err := stream.DecodeWithParsedTypes(bytes.NewReader(extraData))
+	if err != nil {
+		return fmt.Errorf("invalid tlv extension: %v", err)
+	}
+
+	for typ := range types {
+		if typ%2 == 0 && !isKnownType(typ, known) {
+			return ErrUnknownRequiredType(typ)
+		}
+	}
+
+	return nil
+}
+
+// setExtensionRecord returns extraData with record added (or replaced); the
+// other records are kept as they are
+func setExtensionRecord(extraData lnwire.ExtraOpaqueData, record tlv.Record) (lnwire.ExtraOpaqueData, error) {
+	stream, err := tlv.NewStream()
+	if err != nil {
+		return nil, err
+	}
+	types, err := stream.DecodeWithParsedTypes(bytes.NewReader(extraData))
+	if err != nil {
+		return nil, fmt.Errorf("invalid tlv extension: %v", err)
+	}
+
+	records := []tlv.Record{record}
+	for typ, value := range types {
+		if typ == record.Type() {
+			continue
+		}
+		value := value
+		records = append(records, tlv.MakePrimitiveRecord(typ, &value))
+	}
+	tlv.SortRecords(records)
+
+	stream, err = tlv.NewStream(records...)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if err := stream.Encode(buf); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func isKnownType(typ tlv.Type, known []tlv.Type) bool {
+	for _, k := range known {
+		if typ == k {
+			return true
+		}
+	}
+
+	return false
+}
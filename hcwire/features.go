@@ -0,0 +1,168 @@
+package hcwire
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/lightningnetwork/lnd/tlv"
+)
+
+// hosted channel extensions. as in BOLT 9 every feature has a pair of bits:
+// the even one means the sender requires it, the odd one that it supports it.
+type FeatureBit uint16
+
+const (
+	ResizableChannelsRequired FeatureBit = 0
+	ResizableChannelsOptional FeatureBit = 1
+	FiatChannelsRequired      FeatureBit = 2
+	FiatChannelsOptional      FeatureBit = 3
+	BrandingRequired          FeatureBit = 4
+	BrandingOptional          FeatureBit = 5
+	PreimageQueriesRequired   FeatureBit = 6
+	PreimageQueriesOptional   FeatureBit = 7
+)
+
+var featureNames = map[FeatureBit]string{
+	ResizableChannelsRequired: "resizable-channels",
+	ResizableChannelsOptional: "resizable-channels",
+	FiatChannelsRequired:      "fiat-channels",
+	FiatChannelsOptional:      "fiat-channels",
+	BrandingRequired:          "branding",
+	BrandingOptional:          "branding",
+	PreimageQueriesRequired:   "preimage-queries",
+	PreimageQueriesOptional:   "preimage-queries",
+}
+
+func (b FeatureBit) IsRequired() bool {
+	return b%2 == 0
+}
+
+func (b FeatureBit) String() string {
+	name, ok := featureNames[b]
+	if !ok {
+		name = "unknown"
+	}
+	if b.IsRequired() {
+		return fmt.Sprintf("%s(%d, required)", name, uint16(b))
+	}
+
+	return fmt.Sprintf("%s(%d, optional)", name, uint16(b))
+}
+
+// init_hosted_channel has room for 104 feature bits
+const MaxFeaturesLength = 13
+
+// FeatureVector is a set of feature bits in its wire encoding: big endian, bit 0
+// is the lowest bit of the last byte.
+type FeatureVector []byte
+
+func NewFeatureVector(bits ...FeatureBit) FeatureVector {
+	fv := FeatureVector{}
+	for _, bit := range bits {
+		fv = fv.Set(bit)
+	}
+
+	return fv
+}
+
+func (fv FeatureVector) IsSet(bit FeatureBit) bool {
+	i := len(fv) - 1 - int(bit/8)
+	if i < 0 {
+		return false
+	}
+
+	return fv[i]&(1<<(bit%8)) != 0
+}
+
+// Set returns a copy of the vector with bit set
+func (fv FeatureVector) Set(bit FeatureBit) FeatureVector {
+	length := len(fv)
+	if int(bit/8)+1 > length {
+		length = int(bit/8) + 1
+	}
+
+	set := make(FeatureVector, length)
+	copy(set[length-len(fv):], fv)
+	set[length-1-int(bit/8)] |= 1 << (bit % 8)
+
+	return set
+}
+
+// HasFeature tells whether either bit of the feature is set
+func (fv FeatureVector) HasFeature(bit FeatureBit) bool {
+	return fv.IsSet(bit&^1) || fv.IsSet(bit|1)
+}
+
+// Bits returns the set bits in ascending order
+func (fv FeatureVector) Bits() []FeatureBit {
+	var bits []FeatureBit
+	for bit := FeatureBit(0); int(bit) < len(fv)*8; bit++ {
+		if fv.IsSet(bit) {
+			bits = append(bits, bit)
+		}
+	}
+
+	return bits
+}
+
+func (fv FeatureVector) String() string {
+	return fmt.Sprintf("%v", fv.Bits())
+}
+
+// NegotiateFeatures returns the features both sides support. it fails if one
+// side requires a feature the other one doesn't know.
+func NegotiateFeatures(local, remote FeatureVector) (FeatureVector, error) {
+	for _, bit := range remote.Bits() {
+		if bit.IsRequired() && !local.HasFeature(bit) {
+			return nil, fmt.Errorf("peer requires unknown feature %v", bit)
+		}
+	}
+	for _, bit := range local.Bits() {
+		if bit.IsRequired() && !remote.HasFeature(bit) {
+			return nil, fmt.Errorf("peer doesn't support required feature %v", bit)
+		}
+	}
+
+	// required if either side requires it, optional otherwise
+	negotiated := FeatureVector{}
+	for _, bit := range local.Bits() {
+		if !remote.HasFeature(bit) {
+			continue
+		}
+		if local.IsSet(bit&^1) || remote.IsSet(bit&^1) {
+			negotiated = negotiated.Set(bit &^ 1)
+		} else {
+			negotiated = negotiated.Set(bit | 1)
+		}
+	}
+
+	return negotiated, nil
+}
+
+// clients announce their features in this odd (so optional) record of
+// invoke_hosted_channel's extension; hosts that don't know it ignore it
+const invokeFeaturesType tlv.Type = 1
+
+func (c *InvokeHostedChannel) Features() (FeatureVector, error) {
+	var features []byte
+	record := tlv.MakePrimitiveRecord(invokeFeaturesType, &features)
+
+	stream, err := tlv.NewStream(record)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.Decode(bytes.NewReader(c.ExtraData)); err != nil {
+		return nil, err
+	}
+	if len(features) > MaxFeaturesLength {
+		return nil, fmt.Errorf("features are %v bytes, at most %v allowed", len(features), MaxFeaturesLength)
+	}
+
+	return FeatureVector(features), nil
+}
+
+func (c *InvokeHostedChannel) SetFeatures(features FeatureVector) (err error) {
+	b := []byte(features)
+	c.ExtraData, err = setExtensionRecord(c.ExtraData, tlv.MakePrimitiveRecord(invokeFeaturesType, &b))
+	return err
+}
@@ -0,0 +1,172 @@
+package hcwire
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+peers can send us anything: whatever the decoders get they must not panic, and
+what they accept has to encode again to a message that decodes the same.
+the test fixtures are the seed corpus; run one target with e.g.
+
+	go test ./hcwire -run '^$' -fuzz FuzzReadMessage -fuzztime 1m
+*/
+
+var fuzzVersions = []uint32{ProtocolVersion1, ProtocolVersion2}
+
+func checkRoundTrip(t *testing.T, msg Message, pver uint32) {
+	b := new(bytes.Buffer)
+	if _, err := WriteMessage(b, msg, pver); err != nil {
+		t.Fatalf("can't encode decoded %v: %v", msg.MsgType(), err)
+	}
+
+	decoded, err := ReadMessage(bytes.NewReader(b.Bytes()), pver)
+	if err != nil {
+		t.Fatalf("can't decode encoded %v: %v", msg.MsgType(), err)
+	}
+	assert.Equal(t, msg, decoded)
+}
+
+func FuzzReadMessage(f *testing.F) {
+	for _, msg := range getTestMessages() {
+		for _, pver := range fuzzVersions {
+			b := new(bytes.Buffer)
+			if _, err := WriteMessage(b, msg, pver); err != nil {
+				f.Fatal(err)
+			}
+			f.Add(b.Bytes())
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, pver := range fuzzVersions {
+			msg, err := ReadMessage(bytes.NewReader(data), pver)
+			if err != nil {
+				continue
+			}
+
+			checkRoundTrip(t, msg, pver)
+		}
+	})
+}
+
+// decodes message bodies of seed's type
+func fuzzMessage(f *testing.F, seed Message) {
+	for _, pver := range fuzzVersions {
+		b := new(bytes.Buffer)
+		if err := seed.Encode(b, pver); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b.Bytes())
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, pver := range fuzzVersions {
+			msg, err := makeEmptyMessage(seed.MsgType())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := msg.Decode(bytes.NewReader(data), pver); err != nil {
+				continue
+			}
+
+			checkRoundTrip(t, msg, pver)
+		}
+	})
+}
+
+func FuzzInvokeHostedChannel(f *testing.F) {
+	fuzzMessage(f, getTestInvokeHC())
+}
+
+func FuzzInitHostedChannel(f *testing.F) {
+	fuzzMessage(f, getTestInitHC())
+}
+
+func FuzzLastCrossSignedState(f *testing.F) {
+	fuzzMessage(f, getTestLassCSS())
+}
+
+func FuzzStateUpdate(f *testing.F) {
+	fuzzMessage(f, getTestStateUpdate())
+}
+
+func FuzzStateOverride(f *testing.F) {
+	fuzzMessage(f, getTestStateOverride())
+}
+
+func FuzzInvoiceForward(f *testing.F) {
+	fuzzMessage(f, getTestInvoiceForward())
+}
+
+func FuzzHostedState(f *testing.F) {
+	for _, pver := range fuzzVersions {
+		b := new(bytes.Buffer)
+		if err := getTestHostedState().Encode(b, pver); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b.Bytes())
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, pver := range fuzzVersions {
+			state := NewHostedState()
+			if err := state.Decode(bytes.NewReader(data), pver); err != nil {
+				continue
+			}
+
+			b := new(bytes.Buffer)
+			if err := state.Encode(b, pver); err != nil {
+				t.Fatalf("can't encode decoded hosted_state: %v", err)
+			}
+			decoded := NewHostedState()
+			if err := decoded.Decode(bytes.NewReader(b.Bytes()), pver); err != nil {
+				t.Fatalf("can't decode encoded hosted_state: %v", err)
+			}
+			assert.Equal(t, state, decoded)
+		}
+	})
+}
+
+func FuzzUpdateAddHTLC(f *testing.F) {
+	fuzzMessage(f, getTestUpdateAddHTLC())
+}
+
+func FuzzUpdateFulfillHTLC(f *testing.F) {
+	fuzzMessage(f, getTestUpdateFulfillHTLC())
+}
+
+func FuzzUpdateFailHTLC(f *testing.F) {
+	fuzzMessage(f, getTestUpdateFailHTLC())
+}
+
+func FuzzUpdateFailMalformedHTLC(f *testing.F) {
+	fuzzMessage(f, getTestUpdateFailMalformedHTLC())
+}
+
+func FuzzResizeChannel(f *testing.F) {
+	fuzzMessage(f, getTestResizeChannel())
+}
+
+func FuzzAskBrandingInfo(f *testing.F) {
+	fuzzMessage(f, getTestAskBrandingInfo())
+}
+
+func FuzzHostedChannelBranding(f *testing.F) {
+	fuzzMessage(f, getTestHostedChannelBranding())
+}
+
+func FuzzQueryPreimages(f *testing.F) {
+	fuzzMessage(f, getTestQueryPreimages())
+}
+
+func FuzzReplyPreimages(f *testing.F) {
+	fuzzMessage(f, getTestReplyPreimages())
+}
+
+func FuzzError(f *testing.F) {
+	fuzzMessage(f, getTestError())
+}
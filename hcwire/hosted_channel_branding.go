@@ -0,0 +1,84 @@
+package hcwire
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"github.com/lightningnetwork/lnd/lnwire"
+)
+
+// longest contact info we accept; it's meant for a url or an email address
+const MaxContactInfoLength = 512
+
+// what a host wants wallets to show for its channels
+type HostedChannelBranding struct {
+	RGBColor    [3]byte
+	PNGIcon     []byte // optional
+	ContactInfo string // utf8
+	ExtraData   lnwire.ExtraOpaqueData
+}
+
+func NewHostedChannelBranding() *HostedChannelBranding {
+	return &HostedChannelBranding{}
+}
+
+var _ Message = (*HostedChannelBranding)(nil)
+
+func (c *HostedChannelBranding) Decode(r io.Reader, pver uint32) (err error) {
+	if _, err := io.ReadFull(r, c.RGBColor[:]); err != nil {
+		return fmt.Errorf("could not parse rgb_color: %v", err)
+	}
+
+	var hasIcon bool
+	if err := ReadElement(r, &hasIcon); err != nil {
+		return err
+	}
+	c.PNGIcon = nil
+	if hasIcon {
+		c.PNGIcon, err = ReadVarBytes(r, 65535, "png_icon")
+		if err != nil {
+			return err
+		}
+	}
+
+	contactInfo, err := ReadVarBytes(r, MaxContactInfoLength, "contact_info")
+	if err != nil {
+		return err
+	}
+	if !utf8.Valid(contactInfo) {
+		return fmt.Errorf("contact_info isn't utf8")
+	}
+	c.ContactInfo = string(contactInfo)
+
+	return readExtraData(r, &c.ExtraData)
+}
+
+func (c *HostedChannelBranding) Encode(buf *bytes.Buffer, pver uint32) error {
+	if _, err := buf.Write(c.RGBColor[:]); err != nil {
+		return err
+	}
+
+	if err := lnwire.WriteBool(buf, c.PNGIcon != nil); err != nil {
+		return err
+	}
+	if c.PNGIcon != nil {
+		if err := WriteVarBytes(buf, c.PNGIcon); err != nil {
+			return err
+		}
+	}
+
+	if len(c.ContactInfo) > MaxContactInfoLength {
+		return fmt.Errorf("contact_info too long: %v bytes", len(c.ContactInfo))
+	}
+	if err := WriteVarBytes(buf, []byte(c.ContactInfo)); err != nil {
+		return err
+	}
+
+	return writeExtraData(buf, c.ExtraData)
+}
+
+func (c *HostedChannelBranding) MsgType() MessageType {
+	return MsgHostedChannelBranding
+}
@@ -2,34 +2,153 @@ package hcwire
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 
 	"github.com/lightningnetwork/lnd/lnwire"
 )
 
-//
+// snapshot of a hosted channel: the last cross signed state plus the updates
+// that aren't signed yet. a host hands it to a client as its state backup and
+// we use it to store channels. it's not a message peers send each other so it
+// has no type and Read/WriteMessage don't know it; use Encode and Decode.
 type HostedState struct {
 	ChannelID            lnwire.ChannelID
-	NumNextLocalUpdates  uint16
-	NextLocalUpdates     []byte // have to define new type here; some other fields still missing here as well
+	NextLocalUpdates     []Message // update_add/fulfill/fail/fail_malformed_htlc and resize_channel
+	NextRemoteUpdates    []Message
 	LastCrossSignedState LastCrossSignedState
+	ExtraData            lnwire.ExtraOpaqueData
 }
 
 func NewHostedState() *HostedState {
 	return &HostedState{}
 }
 
-var _ Message = (*HostedState)(nil)
+var _ lnwire.Serializable = (*HostedState)(nil)
 
-func (c *HostedState) Decode(r io.Reader, pver uint32) error {
+func (c *HostedState) Decode(r io.Reader, pver uint32) (err error) {
+	_, err = io.ReadFull(r, c.ChannelID[:])
+	if err != nil {
+		return fmt.Errorf("could not parse channel_id: %v", err)
+	}
 
-	return nil
+	c.NextLocalUpdates, err = readUpdates(r, pver, "next_local_updates")
+	if err != nil {
+		return err
+	}
+
+	c.NextRemoteUpdates, err = readUpdates(r, pver, "next_remote_updates")
+	if err != nil {
+		return err
+	}
+
+	if err := c.LastCrossSignedState.decodeFields(r); err != nil {
+		return err
+	}
+
+	return readExtraData(r, &c.ExtraData)
+}
+
+func (c *HostedState) Encode(buf *bytes.Buffer, pver uint32) error {
+	if _, err := buf.Write(c.ChannelID[:]); err != nil {
+		return err
+	}
+
+	if err := writeUpdates(buf, c.NextLocalUpdates, pver, "next_local_updates"); err != nil {
+		return err
+	}
+
+	if err := writeUpdates(buf, c.NextRemoteUpdates, pver, "next_remote_updates"); err != nil {
+		return err
+	}
+
+	if err := c.LastCrossSignedState.encodeFields(buf); err != nil {
+		return err
+	}
+
+	return writeExtraData(buf, c.ExtraData)
+}
+
+func isUpdateMessage(msgType MessageType) bool {
+	switch msgType {
+	case MsgUpdateAddHTLC, MsgUpdateFulfillHTLC, MsgUpdateFailHTLC, MsgUpdateFailMalformedHTLC, MsgResizeChannel:
+		return true
+	default:
+		return false
+	}
 }
 
-func (c *HostedState) Encode(w *bytes.Buffer, pver uint32) error {
+// a side can have an add for each of its htlcs, a fulfill or fail for each of
+// the other side's htlcs and a resize pending; more than that is never written
+// nor read
+const MaxPendingUpdates = 2*MaxHTLCsPerDirection + 1
+
+// each update is written as type, uint16 length and body so it can't read
+// past its own bytes
+func writeUpdates(buf *bytes.Buffer, updates []Message, pver uint32, fieldName string) error {
+	if len(updates) > MaxPendingUpdates {
+		return fmt.Errorf("%s: %v updates, at most %v allowed", fieldName, len(updates), MaxPendingUpdates)
+	}
+	if err := lnwire.WriteUint16(buf, uint16(len(updates))); err != nil {
+		return err
+	}
+
+	for _, update := range updates {
+		if !isUpdateMessage(update.MsgType()) {
+			return fmt.Errorf("%v is not an update message", update.MsgType())
+		}
+
+		body := new(bytes.Buffer)
+		if err := update.Encode(body, pver); err != nil {
+			return err
+		}
+
+		if err := lnwire.WriteUint16(buf, uint16(update.MsgType())); err != nil {
+			return err
+		}
+		if err := WriteVarBytes(buf, body.Bytes()); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (c *HostedState) MsgType() MessageType {
-	return 0
+func readUpdates(r io.Reader, pver uint32, fieldName string) ([]Message, error) {
+	var num uint16
+	if err := ReadElement(r, &num); err != nil {
+		return nil, err
+	}
+
+	if num > MaxPendingUpdates {
+		return nil, fmt.Errorf("%s: %v updates, at most %v allowed", fieldName, num, MaxPendingUpdates)
+	}
+
+	var updates []Message
+	for i := uint16(0); i < num; i++ {
+		var msgType uint16
+		if err := ReadElement(r, &msgType); err != nil {
+			return nil, err
+		}
+		if !isUpdateMessage(MessageType(msgType)) {
+			return nil, fmt.Errorf("%s: %v is not an update message", fieldName, MessageType(msgType))
+		}
+
+		body, err := ReadVarBytes(r, 65535, fieldName)
+		if err != nil {
+			return nil, err
+		}
+
+		update, err := makeEmptyMessage(MessageType(msgType))
+		if err != nil {
+			return nil, err
+		}
+		if err := update.Decode(bytes.NewReader(body), pver); err != nil {
+			return nil, fmt.Errorf("%s: %v", fieldName, err)
+		}
+
+		updates = append(updates, update)
+	}
+
+	return updates, nil
 }
@@ -17,7 +17,8 @@ type InitHostedChannel struct {
 	LiabilityDeadlineBlockdays         uint16
 	MinimalOnChainRefundAmountSatoshis uint64
 	InitialClientBalanceMSat           uint64
-	Features                           []byte
+	Features                           FeatureVector
+	ExtraData                          lnwire.ExtraOpaqueData // not part of last_cross_signed_state
 }
 
 func NewInitHostedChannel() *InitHostedChannel {
@@ -27,6 +28,24 @@ func NewInitHostedChannel() *InitHostedChannel {
 var _ Message = (*InitHostedChannel)(nil)
 
 func (c *InitHostedChannel) Decode(r io.Reader, pver uint32) error {
+	if err := c.decodeFields(r); err != nil {
+		return err
+	}
+
+	return readExtraData(r, &c.ExtraData)
+}
+
+func (c *InitHostedChannel) Encode(buf *bytes.Buffer, pver uint32) error {
+	if err := c.encodeFields(buf); err != nil {
+		return err
+	}
+
+	return writeExtraData(buf, c.ExtraData)
+}
+
+// the fields without the extension stream; this is how init_hosted_channel is
+// embedded in last_cross_signed_state
+func (c *InitHostedChannel) decodeFields(r io.Reader) error {
 	//TODO: make for loop or something more elegant
 	if err := ReadElement(r, &c.MaxHTLCValueInFlightMSat); err != nil {
 		return err
@@ -56,15 +75,13 @@ func (c *InitHostedChannel) Decode(r io.Reader, pver uint32) error {
 		return err
 	}
 
-	// TODO:  what is max size of features field; 13 bytes?
-	var err error
-	c.Features, err = ReadVarBytes(r, 13, "features")
+	features, err := ReadVarBytes(r, MaxFeaturesLength, "features")
+	c.Features = FeatureVector(features)
 
 	return err
 }
 
-func (c *InitHostedChannel) Encode(buf *bytes.Buffer, pver uint32) error {
-
+func (c *InitHostedChannel) encodeFields(buf *bytes.Buffer) error {
 	if err := lnwire.WriteUint64(buf, c.MaxHTLCValueInFlightMSat); err != nil {
 		return err
 	}
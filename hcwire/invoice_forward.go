@@ -0,0 +1,56 @@
+package hcwire
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/lightningnetwork/lnd/lnwire"
+)
+
+// largest bolt11 invoice that still fits in a QR code
+const MaxInvoiceLength = 7089
+
+// sent by a client to hand a bolt11 invoice to the host, which presents it
+// to payers so the client doesn't have to expose its route hints itself
+type InvoiceForward struct {
+	ChainHash [32]byte
+	Invoice   []byte // bolt11 encoded invoice
+	ExtraData lnwire.ExtraOpaqueData
+}
+
+func NewInvoiceForward() *InvoiceForward {
+	return &InvoiceForward{}
+}
+
+var _ Message = (*InvoiceForward)(nil)
+
+func (c *InvoiceForward) Decode(r io.Reader, pver uint32) error {
+	_, err := io.ReadFull(r, c.ChainHash[:])
+	if err != nil {
+		return fmt.Errorf("could not parse chain_hash: %v", err)
+	}
+
+	c.Invoice, err = ReadVarBytes(r, MaxInvoiceLength, "invoice")
+	if err != nil {
+		return err
+	}
+
+	return readExtraData(r, &c.ExtraData)
+}
+
+func (c *InvoiceForward) Encode(buf *bytes.Buffer, pver uint32) error {
+	if _, err := buf.Write(c.ChainHash[:]); err != nil {
+		return err
+	}
+
+	if err := WriteVarBytes(buf, c.Invoice); err != nil {
+		return err
+	}
+
+	return writeExtraData(buf, c.ExtraData)
+}
+
+func (c *InvoiceForward) MsgType() MessageType {
+	return MsgInvoiceForward
+}
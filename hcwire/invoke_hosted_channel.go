@@ -7,12 +7,15 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+
+	"github.com/lightningnetwork/lnd/lnwire"
 )
 
 type InvokeHostedChannel struct {
 	ChainHash          [32]byte
 	RefundScriptPubKey []byte
 	Secret             []byte // optional data which can be used by Host to tweak channel parameters (non-zero initial Client balance, larger capacity, only allow Clients with secrets etc)
+	ExtraData          lnwire.ExtraOpaqueData
 }
 
 func NewInvokeHostedChannel() *InvokeHostedChannel {
@@ -37,8 +40,11 @@ func (c *InvokeHostedChannel) Decode(r io.Reader, pver uint32) error {
 	// read the custom TLV field (secret)
 	// Secret should not be longer than 64 bytes
 	c.Secret, err = ReadVarBytes(r, 64, "secret")
+	if err != nil {
+		return err
+	}
 
-	return err
+	return readExtraData(r, &c.ExtraData)
 }
 
 func (c *InvokeHostedChannel) Encode(buf *bytes.Buffer, pver uint32) error {
@@ -50,7 +56,11 @@ func (c *InvokeHostedChannel) Encode(buf *bytes.Buffer, pver uint32) error {
 		return err
 	}
 
-	return WriteVarBytes(buf, c.Secret)
+	if err := WriteVarBytes(buf, c.Secret); err != nil {
+		return err
+	}
+
+	return writeExtraData(buf, c.ExtraData)
 }
 
 func (c *InvokeHostedChannel) MsgType() MessageType {
@@ -0,0 +1,922 @@
+package hcwire
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lightningnetwork/lnd/lnwire"
+)
+
+/*
+JSON of the messages, for RPC output, logs and tools building messages by hand:
+- every message is an object with its name in "type" (as in MessageType.String)
+- hashes, signatures, scripts and other bytes are hex
+- amounts are strings with their unit like lightningd has them: "1000msat", "100000sat"
+- UnmarshalJSONMessage reads any message; unknown fields are an error so typos don't go unnoticed
+*/
+
+type hexBytes []byte
+
+func (b hexBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(b))
+}
+
+func (b *hexBytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	if len(decoded) == 0 {
+		decoded = nil
+	}
+	*b = decoded
+
+	return nil
+}
+
+// copies b into a fixed size field; the lengths have to match
+func (b hexBytes) copyTo(dst []byte, field string) error {
+	if len(b) != len(dst) {
+		return fmt.Errorf("%v has to be %v bytes, not %v", field, len(dst), len(b))
+	}
+	copy(dst, b)
+
+	return nil
+}
+
+// amount with its unit as suffix; plain numbers are read too
+type amount struct {
+	value uint64
+	unit  string
+}
+
+func (a amount) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatUint(a.value, 10) + a.unit)
+}
+
+func (a *amount) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		// not a string
+		return json.Unmarshal(data, &a.value)
+	}
+	if !strings.HasSuffix(s, a.unit) {
+		return fmt.Errorf("amount %q isn't in %v", s, a.unit)
+	}
+
+	value, err := strconv.ParseUint(strings.TrimSuffix(s, a.unit), 10, 64)
+	if err != nil {
+		return err
+	}
+	a.value = value
+
+	return nil
+}
+
+type msat struct{ amount }
+
+func newMSat(value uint64) msat {
+	return msat{amount{value, "msat"}}
+}
+
+func (m *msat) UnmarshalJSON(data []byte) error {
+	m.unit = "msat"
+	return m.amount.UnmarshalJSON(data)
+}
+
+type sat struct{ amount }
+
+func newSat(value uint64) sat {
+	return sat{amount{value, "sat"}}
+}
+
+func (s *sat) UnmarshalJSON(data []byte) error {
+	s.unit = "sat"
+	return s.amount.UnmarshalJSON(data)
+}
+
+// the fields of v with the message type in front
+func marshalMessageJSON(msgType MessageType, v interface{}) ([]byte, error) {
+	fields, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(map[string]string{"type": msgType.String()})
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) <= 2 {
+		return b, nil
+	}
+
+	// {"type":"..."} + , + fields without {
+	return append(append(b[:len(b)-1], ','), fields[1:]...), nil
+}
+
+// reads the fields of a message into v; type may be left out but can't be another one
+func unmarshalMessageJSON(data []byte, msgType MessageType, v interface{}) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	if rawType, ok := fields["type"]; ok {
+		var name string
+		if err := json.Unmarshal(rawType, &name); err != nil {
+			return err
+		}
+		if name != msgType.String() {
+			return fmt.Errorf("%v isn't a %v", name, msgType)
+		}
+		delete(fields, "type")
+	}
+
+	rest, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	return unmarshalStrict(rest, v)
+}
+
+func unmarshalStrict(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	return decoder.Decode(v)
+}
+
+// UnmarshalJSONMessage builds the message of the type named in the "type" field
+func UnmarshalJSONMessage(data []byte) (Message, error) {
+	var typed struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &typed); err != nil {
+		return nil, err
+	}
+	if typed.Type == "" {
+		return nil, fmt.Errorf("message without type")
+	}
+
+	msgType, err := ParseMessageType(typed.Type)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := makeEmptyMessage(msgType)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, fmt.Errorf("could not parse %v: %v", msgType, err)
+	}
+
+	return msg, nil
+}
+
+func unmarshalJSONMessages(raw []json.RawMessage) ([]Message, error) {
+	var msgs []Message
+	for _, data := range raw {
+		msg, err := UnmarshalJSONMessage(data)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
+func marshalJSONMessages(msgs []Message) []Message {
+	if msgs == nil {
+		return []Message{}
+	}
+
+	return msgs
+}
+
+func hashesToJSON(hashes [][32]byte) []hexBytes {
+	list := make([]hexBytes, 0, len(hashes))
+	for _, hash := range hashes {
+		list = append(list, hexBytes(append([]byte(nil), hash[:]...)))
+	}
+
+	return list
+}
+
+func hashesFromJSON(list []hexBytes, field string) ([][32]byte, error) {
+	var hashes [][32]byte
+	for _, b := range list {
+		var hash [32]byte
+		if err := b.copyTo(hash[:], field); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+
+	return hashes, nil
+}
+
+// invoke_hosted_channel
+
+type invokeHostedChannelJSON struct {
+	ChainHash          hexBytes `json:"chain_hash"`
+	RefundScriptPubKey hexBytes `json:"refund_scriptpubkey"`
+	Secret             hexBytes `json:"secret,omitempty"`
+	ExtraData          hexBytes `json:"extra_data,omitempty"`
+}
+
+func (c InvokeHostedChannel) MarshalJSON() ([]byte, error) {
+	return marshalMessageJSON(MsgInvokeHostedChannel, invokeHostedChannelJSON{
+		ChainHash:          c.ChainHash[:],
+		RefundScriptPubKey: c.RefundScriptPubKey,
+		Secret:             c.Secret,
+		ExtraData:          hexBytes(c.ExtraData),
+	})
+}
+
+func (c *InvokeHostedChannel) UnmarshalJSON(data []byte) error {
+	var j invokeHostedChannelJSON
+	if err := unmarshalMessageJSON(data, MsgInvokeHostedChannel, &j); err != nil {
+		return err
+	}
+
+	c.RefundScriptPubKey = j.RefundScriptPubKey
+	c.Secret = j.Secret
+	c.ExtraData = lnwire.ExtraOpaqueData(j.ExtraData)
+
+	return j.ChainHash.copyTo(c.ChainHash[:], "chain_hash")
+}
+
+// init_hosted_channel
+
+type initHostedChannelJSON struct {
+	MaxHTLCValueInFlightMSat           msat     `json:"max_htlc_value_in_flight_msat"`
+	HTLCMinimumMSat                    msat     `json:"htlc_minimum_msat"`
+	MaxAcceptedHTLCs                   uint16   `json:"max_accepted_htlcs"`
+	ChannelCapacityMSat                msat     `json:"channel_capacity_msat"`
+	LiabilityDeadlineBlockdays         uint16   `json:"liability_deadline_blockdays"`
+	MinimalOnChainRefundAmountSatoshis sat      `json:"minimal_onchain_refund_amount_satoshis"`
+	InitialClientBalanceMSat           msat     `json:"initial_client_balance_msat"`
+	Features                           hexBytes `json:"features"`
+	ExtraData                          hexBytes `json:"extra_data,omitempty"`
+}
+
+func newInitHostedChannelJSON(c InitHostedChannel) initHostedChannelJSON {
+	return initHostedChannelJSON{
+		MaxHTLCValueInFlightMSat:           newMSat(c.MaxHTLCValueInFlightMSat),
+		HTLCMinimumMSat:                    newMSat(c.HTLCMinimumMSat),
+		MaxAcceptedHTLCs:                   c.MaxAcceptedHTLCs,
+		ChannelCapacityMSat:                newMSat(c.ChannelCapacityMSat),
+		LiabilityDeadlineBlockdays:         c.LiabilityDeadlineBlockdays,
+		MinimalOnChainRefundAmountSatoshis: newSat(c.MinimalOnChainRefundAmountSatoshis),
+		InitialClientBalanceMSat:           newMSat(c.InitialClientBalanceMSat),
+		Features:                           hexBytes(c.Features),
+		ExtraData:                          hexBytes(c.ExtraData),
+	}
+}
+
+func (j initHostedChannelJSON) initHostedChannel() InitHostedChannel {
+	return InitHostedChannel{
+		MaxHTLCValueInFlightMSat:           j.MaxHTLCValueInFlightMSat.value,
+		HTLCMinimumMSat:                    j.HTLCMinimumMSat.value,
+		MaxAcceptedHTLCs:                   j.MaxAcceptedHTLCs,
+		ChannelCapacityMSat:                j.ChannelCapacityMSat.value,
+		LiabilityDeadlineBlockdays:         j.LiabilityDeadlineBlockdays,
+		MinimalOnChainRefundAmountSatoshis: j.MinimalOnChainRefundAmountSatoshis.value,
+		InitialClientBalanceMSat:           j.InitialClientBalanceMSat.value,
+		Features:                           FeatureVector(j.Features),
+		ExtraData:                          lnwire.ExtraOpaqueData(j.ExtraData),
+	}
+}
+
+func (c InitHostedChannel) MarshalJSON() ([]byte, error) {
+	return marshalMessageJSON(MsgInitHostedChannel, newInitHostedChannelJSON(c))
+}
+
+func (c *InitHostedChannel) UnmarshalJSON(data []byte) error {
+	var j initHostedChannelJSON
+	if err := unmarshalMessageJSON(data, MsgInitHostedChannel, &j); err != nil {
+		return err
+	}
+	*c = j.initHostedChannel()
+
+	return nil
+}
+
+// last_cross_signed_state
+
+type lastCrossSignedStateJSON struct {
+	IsHost                 bool                  `json:"is_host"`
+	LastRefundScriptPubKey hexBytes              `json:"last_refund_scriptpubkey"`
+	InitHostedChannel      initHostedChannelJSON `json:"init_hosted_channel"`
+	Blockday               uint32                `json:"blockday"`
+	LocalBalanceMSat       msat                  `json:"local_balance_msat"`
+	RemoteBalanceMSat      msat                  `json:"remote_balance_msat"`
+	LocalUpdates           uint32                `json:"local_updates"`
+	RemoteUpdates          uint32                `json:"remote_updates"`
+	IncomingHTLCs          []updateAddHTLCJSON   `json:"incoming_htlcs"`
+	OutgoingHTLCs          []updateAddHTLCJSON   `json:"outgoing_htlcs"`
+	RemoteSigOfLocal       hexBytes              `json:"remote_sig_of_local"`
+	LocalSigOfRemote       hexBytes              `json:"local_sig_of_remote"`
+	ExtraData              hexBytes              `json:"extra_data,omitempty"`
+}
+
+func htlcsToJSON(htlcs []lnwire.UpdateAddHTLC) []updateAddHTLCJSON {
+	list := make([]updateAddHTLCJSON, 0, len(htlcs))
+	for _, htlc := range htlcs {
+		list = append(list, newUpdateAddHTLCJSON(htlc))
+	}
+
+	return list
+}
+
+func htlcsFromJSON(list []updateAddHTLCJSON) ([]lnwire.UpdateAddHTLC, error) {
+	htlcs := []lnwire.UpdateAddHTLC{}
+	for _, j := range list {
+		htlc, err := j.updateAddHTLC()
+		if err != nil {
+			return nil, err
+		}
+		htlcs = append(htlcs, htlc)
+	}
+
+	return htlcs, nil
+}
+
+func newLastCrossSignedStateJSON(c LastCrossSignedState) lastCrossSignedStateJSON {
+	return lastCrossSignedStateJSON{
+		IsHost:                 c.IsHost,
+		LastRefundScriptPubKey: c.LastRefundScriptPubKey,
+		InitHostedChannel:      newInitHostedChannelJSON(c.InitHostedChannel),
+		Blockday:               c.Blockday,
+		LocalBalanceMSat:       newMSat(c.LocalBalanceMSat),
+		RemoteBalanceMSat:      newMSat(c.RemoteBalanceMSat),
+		LocalUpdates:           c.LocalUpdates,
+		RemoteUpdates:          c.RemoteUpdates,
+		IncomingHTLCs:          htlcsToJSON(c.IncomingHTLCs),
+		OutgoingHTLCs:          htlcsToJSON(c.OutgoingHTLCs),
+		RemoteSigOfLocal:       append([]byte(nil), c.RemoteSigOfLocal[:]...),
+		LocalSigOfRemote:       append([]byte(nil), c.LocalSigOfRemote[:]...),
+		ExtraData:              hexBytes(c.ExtraData),
+	}
+}
+
+func (j lastCrossSignedStateJSON) lastCrossSignedState() (LastCrossSignedState, error) {
+	c := LastCrossSignedState{
+		IsHost:                 j.IsHost,
+		LastRefundScriptPubKey: j.LastRefundScriptPubKey,
+		InitHostedChannel:      j.InitHostedChannel.initHostedChannel(),
+		Blockday:               j.Blockday,
+		LocalBalanceMSat:       j.LocalBalanceMSat.value,
+		RemoteBalanceMSat:      j.RemoteBalanceMSat.value,
+		LocalUpdates:           j.LocalUpdates,
+		RemoteUpdates:          j.RemoteUpdates,
+		ExtraData:              lnwire.ExtraOpaqueData(j.ExtraData),
+	}
+
+	var err error
+	if c.IncomingHTLCs, err = htlcsFromJSON(j.IncomingHTLCs); err != nil {
+		return c, err
+	}
+	if c.OutgoingHTLCs, err = htlcsFromJSON(j.OutgoingHTLCs); err != nil {
+		return c, err
+	}
+	if err := j.RemoteSigOfLocal.copyTo(c.RemoteSigOfLocal[:], "remote_sig_of_local"); err != nil {
+		return c, err
+	}
+	if err := j.LocalSigOfRemote.copyTo(c.LocalSigOfRemote[:], "local_sig_of_remote"); err != nil {
+		return c, err
+	}
+
+	return c, nil
+}
+
+func (c LastCrossSignedState) MarshalJSON() ([]byte, error) {
+	return marshalMessageJSON(MsgLastCrossedSignedState, newLastCrossSignedStateJSON(c))
+}
+
+func (c *LastCrossSignedState) UnmarshalJSON(data []byte) error {
+	var j lastCrossSignedStateJSON
+	if err := unmarshalMessageJSON(data, MsgLastCrossedSignedState, &j); err != nil {
+		return err
+	}
+
+	state, err := j.lastCrossSignedState()
+	if err != nil {
+		return err
+	}
+	*c = state
+
+	return nil
+}
+
+// state_update
+
+type stateUpdateJSON struct {
+	Blockday         uint32   `json:"blockday"`
+	LocalUpdates     uint32   `json:"local_updates"`
+	RemoteUpdates    uint32   `json:"remote_updates"`
+	LocalSigOfRemote hexBytes `json:"local_sig_of_remote"`
+	ExtraData        hexBytes `json:"extra_data,omitempty"`
+}
+
+func (c StateUpdate) MarshalJSON() ([]byte, error) {
+	return marshalMessageJSON(MsgStateUpdate, stateUpdateJSON{
+		Blockday:         c.Blockday,
+		LocalUpdates:     c.LocalUpdates,
+		RemoteUpdates:    c.RemoteUpdates,
+		LocalSigOfRemote: c.LocalSigOfRemote[:],
+		ExtraData:        hexBytes(c.ExtraData),
+	})
+}
+
+func (c *StateUpdate) UnmarshalJSON(data []byte) error {
+	var j stateUpdateJSON
+	if err := unmarshalMessageJSON(data, MsgStateUpdate, &j); err != nil {
+		return err
+	}
+
+	c.Blockday = j.Blockday
+	c.LocalUpdates = j.LocalUpdates
+	c.RemoteUpdates = j.RemoteUpdates
+	c.ExtraData = lnwire.ExtraOpaqueData(j.ExtraData)
+
+	return j.LocalSigOfRemote.copyTo(c.LocalSigOfRemote[:], "local_sig_of_remote")
+}
+
+// state_override
+
+type stateOverrideJSON struct {
+	Blockday         uint32   `json:"blockday"`
+	LocalBalanceMSat msat     `json:"local_balance_msat"`
+	LocalUpdates     uint32   `json:"local_updates"`
+	RemoteUpdates    uint32   `json:"remote_updates"`
+	LocalSigOfRemote hexBytes `json:"local_sig_of_remote"`
+	ExtraData        hexBytes `json:"extra_data,omitempty"`
+}
+
+func (c StateOverride) MarshalJSON() ([]byte, error) {
+	return marshalMessageJSON(MsgStateOverride, stateOverrideJSON{
+		Blockday:         c.Blockday,
+		LocalBalanceMSat: newMSat(c.LocalBalanceMSat),
+		LocalUpdates:     c.LocalUpdates,
+		RemoteUpdates:    c.RemoteUpdates,
+		LocalSigOfRemote: c.LocalSigOfRemote[:],
+		ExtraData:        hexBytes(c.ExtraData),
+	})
+}
+
+func (c *StateOverride) UnmarshalJSON(data []byte) error {
+	var j stateOverrideJSON
+	if err := unmarshalMessageJSON(data, MsgStateOverride, &j); err != nil {
+		return err
+	}
+
+	c.Blockday = j.Blockday
+	c.LocalBalanceMSat = j.LocalBalanceMSat.value
+	c.LocalUpdates = j.LocalUpdates
+	c.RemoteUpdates = j.RemoteUpdates
+	c.ExtraData = lnwire.ExtraOpaqueData(j.ExtraData)
+
+	return j.LocalSigOfRemote.copyTo(c.LocalSigOfRemote[:], "local_sig_of_remote")
+}
+
+// invoice_forward
+
+type invoiceForwardJSON struct {
+	ChainHash hexBytes `json:"chain_hash"`
+	Invoice   string   `json:"invoice"`
+	ExtraData hexBytes `json:"extra_data,omitempty"`
+}
+
+func (c InvoiceForward) MarshalJSON() ([]byte, error) {
+	return marshalMessageJSON(MsgInvoiceForward, invoiceForwardJSON{
+		ChainHash: c.ChainHash[:],
+		Invoice:   string(c.Invoice),
+		ExtraData: hexBytes(c.ExtraData),
+	})
+}
+
+func (c *InvoiceForward) UnmarshalJSON(data []byte) error {
+	var j invoiceForwardJSON
+	if err := unmarshalMessageJSON(data, MsgInvoiceForward, &j); err != nil {
+		return err
+	}
+
+	c.Invoice = []byte(j.Invoice)
+	c.ExtraData = lnwire.ExtraOpaqueData(j.ExtraData)
+
+	return j.ChainHash.copyTo(c.ChainHash[:], "chain_hash")
+}
+
+// resize_channel
+
+type resizeChannelJSON struct {
+	NewCapacity sat      `json:"new_capacity"`
+	ClientSig   hexBytes `json:"client_sig"`
+	ExtraData   hexBytes `json:"extra_data,omitempty"`
+}
+
+func (c ResizeChannel) MarshalJSON() ([]byte, error) {
+	return marshalMessageJSON(MsgResizeChannel, resizeChannelJSON{
+		NewCapacity: newSat(c.NewCapacitySat),
+		ClientSig:   c.ClientSig[:],
+		ExtraData:   hexBytes(c.ExtraData),
+	})
+}
+
+func (c *ResizeChannel) UnmarshalJSON(data []byte) error {
+	var j resizeChannelJSON
+	if err := unmarshalMessageJSON(data, MsgResizeChannel, &j); err != nil {
+		return err
+	}
+
+	c.NewCapacitySat = j.NewCapacity.value
+	c.ExtraData = lnwire.ExtraOpaqueData(j.ExtraData)
+
+	return j.ClientSig.copyTo(c.ClientSig[:], "client_sig")
+}
+
+// query_preimages
+
+type queryPreimagesJSON struct {
+	PaymentHashes []hexBytes `json:"payment_hashes"`
+	ExtraData     hexBytes   `json:"extra_data,omitempty"`
+}
+
+func (c QueryPreimages) MarshalJSON() ([]byte, error) {
+	return marshalMessageJSON(MsgQueryPreimages, queryPreimagesJSON{
+		PaymentHashes: hashesToJSON(c.PaymentHashes),
+		ExtraData:     hexBytes(c.ExtraData),
+	})
+}
+
+func (c *QueryPreimages) UnmarshalJSON(data []byte) error {
+	var j queryPreimagesJSON
+	if err := unmarshalMessageJSON(data, MsgQueryPreimages, &j); err != nil {
+		return err
+	}
+
+	hashes, err := hashesFromJSON(j.PaymentHashes, "payment_hash")
+	if err != nil {
+		return err
+	}
+	c.PaymentHashes = hashes
+	c.ExtraData = lnwire.ExtraOpaqueData(j.ExtraData)
+
+	return nil
+}
+
+// reply_preimages
+
+type replyPreimagesJSON struct {
+	Preimages []hexBytes `json:"preimages"`
+	ExtraData hexBytes   `json:"extra_data,omitempty"`
+}
+
+func (c ReplyPreimages) MarshalJSON() ([]byte, error) {
+	return marshalMessageJSON(MsgReplyPreimages, replyPreimagesJSON{
+		Preimages: hashesToJSON(c.Preimages),
+		ExtraData: hexBytes(c.ExtraData),
+	})
+}
+
+func (c *ReplyPreimages) UnmarshalJSON(data []byte) error {
+	var j replyPreimagesJSON
+	if err := unmarshalMessageJSON(data, MsgReplyPreimages, &j); err != nil {
+		return err
+	}
+
+	preimages, err := hashesFromJSON(j.Preimages, "preimage")
+	if err != nil {
+		return err
+	}
+	c.Preimages = preimages
+	c.ExtraData = lnwire.ExtraOpaqueData(j.ExtraData)
+
+	return nil
+}
+
+// ask_branding_info
+
+type askBrandingInfoJSON struct {
+	ChainHash hexBytes `json:"chain_hash"`
+	ExtraData hexBytes `json:"extra_data,omitempty"`
+}
+
+func (c AskBrandingInfo) MarshalJSON() ([]byte, error) {
+	return marshalMessageJSON(MsgAskBrandingInfo, askBrandingInfoJSON{
+		ChainHash: c.ChainHash[:],
+		ExtraData: hexBytes(c.ExtraData),
+	})
+}
+
+func (c *AskBrandingInfo) UnmarshalJSON(data []byte) error {
+	var j askBrandingInfoJSON
+	if err := unmarshalMessageJSON(data, MsgAskBrandingInfo, &j); err != nil {
+		return err
+	}
+
+	c.ExtraData = lnwire.ExtraOpaqueData(j.ExtraData)
+
+	return j.ChainHash.copyTo(c.ChainHash[:], "chain_hash")
+}
+
+// hosted_channel_branding
+
+type hostedChannelBrandingJSON struct {
+	RGBColor    hexBytes `json:"rgb_color"`
+	PNGIcon     hexBytes `json:"png_icon,omitempty"`
+	ContactInfo string   `json:"contact_info"`
+	ExtraData   hexBytes `json:"extra_data,omitempty"`
+}
+
+func (c HostedChannelBranding) MarshalJSON() ([]byte, error) {
+	return marshalMessageJSON(MsgHostedChannelBranding, hostedChannelBrandingJSON{
+		RGBColor:    c.RGBColor[:],
+		PNGIcon:     c.PNGIcon,
+		ContactInfo: c.ContactInfo,
+		ExtraData:   hexBytes(c.ExtraData),
+	})
+}
+
+func (c *HostedChannelBranding) UnmarshalJSON(data []byte) error {
+	var j hostedChannelBrandingJSON
+	if err := unmarshalMessageJSON(data, MsgHostedChannelBranding, &j); err != nil {
+		return err
+	}
+
+	c.PNGIcon = j.PNGIcon
+	c.ContactInfo = j.ContactInfo
+	c.ExtraData = lnwire.ExtraOpaqueData(j.ExtraData)
+
+	return j.RGBColor.copyTo(c.RGBColor[:], "rgb_color")
+}
+
+// hosted_state; a snapshot, not a message, so there's no type
+
+type hostedStateJSON struct {
+	ChannelID            hexBytes                 `json:"channel_id"`
+	NextLocalUpdates     []json.RawMessage        `json:"next_local_updates"`
+	NextRemoteUpdates    []json.RawMessage        `json:"next_remote_updates"`
+	LastCrossSignedState lastCrossSignedStateJSON `json:"last_cross_signed_state"`
+	ExtraData            hexBytes                 `json:"extra_data,omitempty"`
+}
+
+func (c HostedState) MarshalJSON() ([]byte, error) {
+	nextLocalUpdates, err := json.Marshal(marshalJSONMessages(c.NextLocalUpdates))
+	if err != nil {
+		return nil, err
+	}
+	nextRemoteUpdates, err := json.Marshal(marshalJSONMessages(c.NextRemoteUpdates))
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(struct {
+		ChannelID            hexBytes                 `json:"channel_id"`
+		NextLocalUpdates     json.RawMessage          `json:"next_local_updates"`
+		NextRemoteUpdates    json.RawMessage          `json:"next_remote_updates"`
+		LastCrossSignedState lastCrossSignedStateJSON `json:"last_cross_signed_state"`
+		ExtraData            hexBytes                 `json:"extra_data,omitempty"`
+	}{
+		ChannelID:            c.ChannelID[:],
+		NextLocalUpdates:     nextLocalUpdates,
+		NextRemoteUpdates:    nextRemoteUpdates,
+		LastCrossSignedState: newLastCrossSignedStateJSON(c.LastCrossSignedState),
+		ExtraData:            hexBytes(c.ExtraData),
+	})
+}
+
+func (c *HostedState) UnmarshalJSON(data []byte) error {
+	var j hostedStateJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+
+	var err error
+	if c.NextLocalUpdates, err = unmarshalJSONMessages(j.NextLocalUpdates); err != nil {
+		return err
+	}
+	if c.NextRemoteUpdates, err = unmarshalJSONMessages(j.NextRemoteUpdates); err != nil {
+		return err
+	}
+	if c.LastCrossSignedState, err = j.LastCrossSignedState.lastCrossSignedState(); err != nil {
+		return err
+	}
+	c.ExtraData = lnwire.ExtraOpaqueData(j.ExtraData)
+
+	return j.ChannelID.copyTo(c.ChannelID[:], "channel_id")
+}
+
+// update_add_htlc; also the htlcs of last_cross_signed_state
+
+type updateAddHTLCJSON struct {
+	ChanID             hexBytes `json:"channel_id"`
+	ID                 uint64   `json:"id"`
+	AmountMSat         msat     `json:"amount_msat"`
+	PaymentHash        hexBytes `json:"payment_hash"`
+	Expiry             uint32   `json:"cltv_expiry"`
+	OnionRoutingPacket hexBytes `json:"onion_routing_packet"`
+	ExtraData          hexBytes `json:"extra_data,omitempty"`
+}
+
+func newUpdateAddHTLCJSON(htlc lnwire.UpdateAddHTLC) updateAddHTLCJSON {
+	return updateAddHTLCJSON{
+		ChanID:             append([]byte(nil), htlc.ChanID[:]...),
+		ID:                 htlc.ID,
+		AmountMSat:         newMSat(uint64(htlc.Amount)),
+		PaymentHash:        append([]byte(nil), htlc.PaymentHash[:]...),
+		Expiry:             htlc.Expiry,
+		OnionRoutingPacket: append([]byte(nil), htlc.OnionBlob[:]...),
+		ExtraData:          hexBytes(htlc.ExtraData),
+	}
+}
+
+func (j updateAddHTLCJSON) updateAddHTLC() (lnwire.UpdateAddHTLC, error) {
+	htlc := lnwire.UpdateAddHTLC{
+		ID:        j.ID,
+		Amount:    lnwire.MilliSatoshi(j.AmountMSat.value),
+		Expiry:    j.Expiry,
+		ExtraData: lnwire.ExtraOpaqueData(j.ExtraData),
+	}
+
+	if err := j.ChanID.copyTo(htlc.ChanID[:], "channel_id"); err != nil {
+		return htlc, err
+	}
+	if err := j.PaymentHash.copyTo(htlc.PaymentHash[:], "payment_hash"); err != nil {
+		return htlc, err
+	}
+	if err := j.OnionRoutingPacket.copyTo(htlc.OnionBlob[:], "onion_routing_packet"); err != nil {
+		return htlc, err
+	}
+
+	return htlc, nil
+}
+
+func (c UpdateAddHTLC) MarshalJSON() ([]byte, error) {
+	return marshalMessageJSON(MsgUpdateAddHTLC, newUpdateAddHTLCJSON(c.UpdateAddHTLC))
+}
+
+func (c *UpdateAddHTLC) UnmarshalJSON(data []byte) error {
+	var j updateAddHTLCJSON
+	if err := unmarshalMessageJSON(data, MsgUpdateAddHTLC, &j); err != nil {
+		return err
+	}
+
+	htlc, err := j.updateAddHTLC()
+	if err != nil {
+		return err
+	}
+	c.UpdateAddHTLC = htlc
+
+	return nil
+}
+
+// update_fulfill_htlc
+
+type updateFulfillHTLCJSON struct {
+	ChanID          hexBytes `json:"channel_id"`
+	ID              uint64   `json:"id"`
+	PaymentPreimage hexBytes `json:"payment_preimage"`
+	ExtraData       hexBytes `json:"extra_data,omitempty"`
+}
+
+func (c UpdateFulfillHTLC) MarshalJSON() ([]byte, error) {
+	return marshalMessageJSON(MsgUpdateFulfillHTLC, updateFulfillHTLCJSON{
+		ChanID:          c.ChanID[:],
+		ID:              c.ID,
+		PaymentPreimage: c.PaymentPreimage[:],
+		ExtraData:       hexBytes(c.ExtraData),
+	})
+}
+
+func (c *UpdateFulfillHTLC) UnmarshalJSON(data []byte) error {
+	var j updateFulfillHTLCJSON
+	if err := unmarshalMessageJSON(data, MsgUpdateFulfillHTLC, &j); err != nil {
+		return err
+	}
+
+	c.ID = j.ID
+	c.ExtraData = lnwire.ExtraOpaqueData(j.ExtraData)
+	if err := j.ChanID.copyTo(c.ChanID[:], "channel_id"); err != nil {
+		return err
+	}
+
+	return j.PaymentPreimage.copyTo(c.PaymentPreimage[:], "payment_preimage")
+}
+
+// update_fail_htlc
+
+type updateFailHTLCJSON struct {
+	ChanID    hexBytes `json:"channel_id"`
+	ID        uint64   `json:"id"`
+	Reason    hexBytes `json:"reason"`
+	ExtraData hexBytes `json:"extra_data,omitempty"`
+}
+
+func (c UpdateFailHTLC) MarshalJSON() ([]byte, error) {
+	return marshalMessageJSON(MsgUpdateFailHTLC, updateFailHTLCJSON{
+		ChanID:    c.ChanID[:],
+		ID:        c.ID,
+		Reason:    hexBytes(c.Reason),
+		ExtraData: hexBytes(c.ExtraData),
+	})
+}
+
+func (c *UpdateFailHTLC) UnmarshalJSON(data []byte) error {
+	var j updateFailHTLCJSON
+	if err := unmarshalMessageJSON(data, MsgUpdateFailHTLC, &j); err != nil {
+		return err
+	}
+
+	c.ID = j.ID
+	c.Reason = lnwire.OpaqueReason(j.Reason)
+	c.ExtraData = lnwire.ExtraOpaqueData(j.ExtraData)
+
+	return j.ChanID.copyTo(c.ChanID[:], "channel_id")
+}
+
+// update_fail_malformed_htlc
+
+type updateFailMalformedHTLCJSON struct {
+	ChanID       hexBytes `json:"channel_id"`
+	ID           uint64   `json:"id"`
+	ShaOnionBlob hexBytes `json:"sha256_of_onion"`
+	FailureCode  uint16   `json:"failure_code"`
+	ExtraData    hexBytes `json:"extra_data,omitempty"`
+}
+
+func (c UpdateFailMalformedHTLC) MarshalJSON() ([]byte, error) {
+	return marshalMessageJSON(MsgUpdateFailMalformedHTLC, updateFailMalformedHTLCJSON{
+		ChanID:       c.ChanID[:],
+		ID:           c.ID,
+		ShaOnionBlob: c.ShaOnionBlob[:],
+		FailureCode:  uint16(c.FailureCode),
+		ExtraData:    hexBytes(c.ExtraData),
+	})
+}
+
+func (c *UpdateFailMalformedHTLC) UnmarshalJSON(data []byte) error {
+	var j updateFailMalformedHTLCJSON
+	if err := unmarshalMessageJSON(data, MsgUpdateFailMalformedHTLC, &j); err != nil {
+		return err
+	}
+
+	c.ID = j.ID
+	c.FailureCode = lnwire.FailCode(j.FailureCode)
+	c.ExtraData = lnwire.ExtraOpaqueData(j.ExtraData)
+	if err := j.ChanID.copyTo(c.ChanID[:], "channel_id"); err != nil {
+		return err
+	}
+
+	return j.ShaOnionBlob.copyTo(c.ShaOnionBlob[:], "sha256_of_onion")
+}
+
+// error; the data is split into code and details like NewChannelError puts them together
+
+type errorJSON struct {
+	ChanID    hexBytes  `json:"channel_id"`
+	Code      ErrorCode `json:"code,omitempty"`
+	Details   string    `json:"details"`
+	ExtraData hexBytes  `json:"extra_data,omitempty"`
+}
+
+func (c Error) MarshalJSON() ([]byte, error) {
+	return marshalMessageJSON(MsgError, errorJSON{
+		ChanID:    c.ChanID[:],
+		Code:      c.Code(),
+		Details:   c.Details(),
+		ExtraData: hexBytes(c.ExtraData),
+	})
+}
+
+func (c *Error) UnmarshalJSON(data []byte) error {
+	var j errorJSON
+	if err := unmarshalMessageJSON(data, MsgError, &j); err != nil {
+		return err
+	}
+	if _, ok := errorCodeDescriptions[j.Code]; j.Code != "" && !ok {
+		return fmt.Errorf("unknown error code %v", j.Code)
+	}
+
+	var chanID lnwire.ChannelID
+	if err := j.ChanID.copyTo(chanID[:], "channel_id"); err != nil {
+		return err
+	}
+	*c = *NewChannelError(chanID, j.Code, j.Details)
+	c.ExtraData = lnwire.ExtraOpaqueData(j.ExtraData)
+
+	return nil
+}
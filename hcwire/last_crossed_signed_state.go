@@ -2,12 +2,27 @@ package hcwire
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"sort"
 
+	"github.com/btcsuite/btcd/btcec"
 	"github.com/lightningnetwork/lnd/lnwire"
 )
 
+const (
+	// BOLT 2 max_accepted_htlcs; no state can have more htlcs in one direction
+	MaxHTLCsPerDirection = 483
+
+	// p2wsh and p2tr are the longest scripts (34 bytes)
+	maxRefundScriptLength = 34
+
+	// channel_id, id, amount_msat, payment_hash, cltv_expiry and onion_routing_packet
+	htlcLength = 32 + 8 + 8 + 32 + 4 + lnwire.OnionPacketSize
+)
+
 type LastCrossSignedState struct {
 	IsHost                 bool
 	LastRefundScriptPubKey []byte
@@ -21,6 +36,7 @@ type LastCrossSignedState struct {
 	OutgoingHTLCs          []lnwire.UpdateAddHTLC
 	RemoteSigOfLocal       [64]byte
 	LocalSigOfRemote       [64]byte
+	ExtraData              lnwire.ExtraOpaqueData // not covered by the signatures
 }
 
 func NewLastCrossedSignedState() *LastCrossSignedState {
@@ -29,19 +45,61 @@ func NewLastCrossedSignedState() *LastCrossSignedState {
 
 var _ Message = (*LastCrossSignedState)(nil)
 
-func (c *LastCrossSignedState) Decode(r io.Reader, pver uint32) (err error) {
+func (c *LastCrossSignedState) Decode(r io.Reader, pver uint32) error {
+	if err := c.decodeFields(r); err != nil {
+		return err
+	}
 
-	c.LastRefundScriptPubKey, err = ReadVarBytes(r, 34, "last_refund_scriptpubkey")
-	if err != nil {
+	return readExtraData(r, &c.ExtraData)
+}
+
+// DecodeStrict reads a last_cross_signed_state that has to be exactly its
+// fields, optionally followed by the host's protocol version and nothing else,
+// and passes Validate. signatures are made over these fields so anything else
+// is a sign the peer disagrees with us.
+func (c *LastCrossSignedState) DecodeStrict(r io.Reader, pver uint32) error {
+	if err := c.decodeFields(r); err != nil {
+		return err
+	}
+
+	if err := readExtraData(r, &c.ExtraData); err != nil {
+		return err
+	}
+	if err := checkOnlyProtocolVersion(c.ExtraData); err != nil {
+		return fmt.Errorf("last_cross_signed_state: %v", err)
+	}
+
+	return c.Validate()
+}
+
+func (c *LastCrossSignedState) Encode(buf *bytes.Buffer, pver uint32) error {
+	if err := c.encodeFields(buf); err != nil {
 		return err
 	}
 
-	initHC := NewInitHostedChannel()
-	err = initHC.Decode(r, 1)
+	return writeExtraData(buf, c.ExtraData)
+}
+
+// the fields without the extension stream, as embedded in hosted_state
+func (c *LastCrossSignedState) decodeFields(r io.Reader) (err error) {
+	// only 0 and 1 so there is a single encoding of every state
+	var isHost [1]byte
+	if _, err := io.ReadFull(r, isHost[:]); err != nil {
+		return fmt.Errorf("could not parse is_host: %v", err)
+	}
+	if isHost[0] > 1 {
+		return fmt.Errorf("invalid is_host byte %v", isHost[0])
+	}
+	c.IsHost = isHost[0] == 1
+
+	c.LastRefundScriptPubKey, err = ReadVarBytes(r, maxRefundScriptLength, "last_refund_scriptpubkey")
 	if err != nil {
 		return err
 	}
-	c.InitHostedChannel = *initHC
+
+	if err := c.InitHostedChannel.decodeFields(r); err != nil {
+		return err
+	}
 
 	if err := ReadElement(r, &c.Blockday); err != nil {
 		return err
@@ -63,28 +121,15 @@ func (c *LastCrossSignedState) Decode(r io.Reader, pver uint32) (err error) {
 		return err
 	}
 
-	var num uint16
-	if err := ReadElement(r, &num); err != nil {
+	c.IncomingHTLCs, err = readHTLCs(r, "incoming_htlcs")
+	if err != nil {
 		return err
 	}
-	c.IncomingHTLCs = make([]lnwire.UpdateAddHTLC, num)
-	for _, incoming := range c.IncomingHTLCs {
-		err := incoming.Decode(r, 1)
-		if err != nil {
-			return err
-		}
-	}
 
-	if err := lnwire.ReadElement(r, &num); err != nil {
+	c.OutgoingHTLCs, err = readHTLCs(r, "outgoing_htlcs")
+	if err != nil {
 		return err
 	}
-	c.OutgoingHTLCs = make([]lnwire.UpdateAddHTLC, num)
-	for _, outgoing := range c.OutgoingHTLCs {
-		err := outgoing.Decode(r, 1)
-		if err != nil {
-			return err
-		}
-	}
 
 	_, err = io.ReadFull(r, c.RemoteSigOfLocal[:])
 	if err != nil {
@@ -96,15 +141,22 @@ func (c *LastCrossSignedState) Decode(r io.Reader, pver uint32) (err error) {
 		return fmt.Errorf("could not parse local_sig_of_remote: %v", err)
 	}
 
-	return err
+	return nil
 }
 
-func (c *LastCrossSignedState) Encode(buf *bytes.Buffer, pver uint32) (err error) {
+func (c *LastCrossSignedState) encodeFields(buf *bytes.Buffer) error {
+	if err := lnwire.WriteBool(buf, c.IsHost); err != nil {
+		return err
+	}
+
+	if len(c.LastRefundScriptPubKey) > maxRefundScriptLength {
+		return fmt.Errorf("last_refund_scriptpubkey too long: %v bytes", len(c.LastRefundScriptPubKey))
+	}
 	if err := WriteVarBytes(buf, c.LastRefundScriptPubKey); err != nil {
 		return err
 	}
 
-	if err := c.InitHostedChannel.Encode(buf, 1); err != nil {
+	if err := c.InitHostedChannel.encodeFields(buf); err != nil {
 		return err
 	}
 
@@ -128,23 +180,13 @@ func (c *LastCrossSignedState) Encode(buf *bytes.Buffer, pver uint32) (err error
 		return err
 	}
 
-	if err := lnwire.WriteUint16(buf, uint16(len(c.IncomingHTLCs))); err != nil {
+	if err := writeHTLCs(buf, c.IncomingHTLCs, "incoming_htlcs"); err != nil {
 		return err
 	}
-	for _, incoming := range c.IncomingHTLCs {
-		if err := incoming.Encode(buf, 1); err != nil {
-			return err
-		}
-	}
 
-	if err := lnwire.WriteUint16(buf, uint16(len(c.OutgoingHTLCs))); err != nil {
+	if err := writeHTLCs(buf, c.OutgoingHTLCs, "outgoing_htlcs"); err != nil {
 		return err
 	}
-	for _, outgoing := range c.OutgoingHTLCs {
-		if err := outgoing.Encode(buf, 1); err != nil {
-			return err
-		}
-	}
 
 	if _, err := buf.Write(c.RemoteSigOfLocal[:]); err != nil {
 		return err
@@ -154,9 +196,266 @@ func (c *LastCrossSignedState) Encode(buf *bytes.Buffer, pver uint32) (err error
 		return err
 	}
 
-	return err
+	return nil
+}
+
+// Validate checks the state is one a channel can actually be in: htlcs within
+// the limits and all funds accounted for.
+func (c *LastCrossSignedState) Validate() error {
+	if len(c.LastRefundScriptPubKey) == 0 {
+		return fmt.Errorf("empty last_refund_scriptpubkey")
+	}
+
+	maxHTLCs := int(c.InitHostedChannel.MaxAcceptedHTLCs)
+	if maxHTLCs > MaxHTLCsPerDirection {
+		return fmt.Errorf("max_accepted_htlcs of %v is above %v", maxHTLCs, MaxHTLCsPerDirection)
+	}
+	if len(c.IncomingHTLCs) > maxHTLCs || len(c.OutgoingHTLCs) > maxHTLCs {
+		return fmt.Errorf("%v incoming and %v outgoing htlcs but only %v are allowed", len(c.IncomingHTLCs), len(c.OutgoingHTLCs), maxHTLCs)
+	}
+
+	total := c.LocalBalanceMSat
+	for _, amount := range []uint64{c.RemoteBalanceMSat, sumHTLCs(c.IncomingHTLCs), sumHTLCs(c.OutgoingHTLCs)} {
+		if total+amount < total {
+			return fmt.Errorf("balances overflow")
+		}
+		total += amount
+	}
+	if total != c.InitHostedChannel.ChannelCapacityMSat {
+		return fmt.Errorf("balances and htlcs add up to %v msat but capacity is %v msat", total, c.InitHostedChannel.ChannelCapacityMSat)
+	}
+
+	for _, htlcs := range [][]lnwire.UpdateAddHTLC{c.IncomingHTLCs, c.OutgoingHTLCs} {
+		ids := make(map[uint64]bool)
+		for _, htlc := range htlcs {
+			if htlc.Amount == 0 {
+				return fmt.Errorf("htlc %v has no amount", htlc.ID)
+			}
+			if ids[htlc.ID] {
+				return fmt.Errorf("duplicate htlc id %v", htlc.ID)
+			}
+			ids[htlc.ID] = true
+		}
+	}
+
+	return nil
+}
+
+// saturates instead of overflowing so Validate's check catches it
+func sumHTLCs(htlcs []lnwire.UpdateAddHTLC) uint64 {
+	var sum uint64
+	for _, htlc := range htlcs {
+		if sum+uint64(htlc.Amount) < sum {
+			return ^uint64(0)
+		}
+		sum += uint64(htlc.Amount)
+	}
+
+	return sum
+}
+
+// htlcs in a state are update_add_htlc without an extension so they have a fixed size
+func readHTLCs(r io.Reader, fieldName string) ([]lnwire.UpdateAddHTLC, error) {
+	var num uint16
+	if err := ReadElement(r, &num); err != nil {
+		return nil, err
+	}
+	if num > MaxHTLCsPerDirection {
+		return nil, fmt.Errorf("%s: %v htlcs, at most %v allowed", fieldName, num, MaxHTLCsPerDirection)
+	}
+
+	htlcs := make([]lnwire.UpdateAddHTLC, num)
+	for i := range htlcs {
+		var b [htlcLength]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, fmt.Errorf("%s: %v", fieldName, err)
+		}
+		if err := htlcs[i].Decode(bytes.NewReader(b[:]), 1); err != nil {
+			return nil, fmt.Errorf("%s: %v", fieldName, err)
+		}
+		htlcs[i].ExtraData = nil
+	}
+
+	return htlcs, nil
+}
+
+func writeHTLCs(buf *bytes.Buffer, htlcs []lnwire.UpdateAddHTLC, fieldName string) error {
+	if len(htlcs) > MaxHTLCsPerDirection {
+		return fmt.Errorf("%s: %v htlcs, at most %v allowed", fieldName, len(htlcs), MaxHTLCsPerDirection)
+	}
+
+	if err := lnwire.WriteUint16(buf, uint16(len(htlcs))); err != nil {
+		return err
+	}
+	for _, htlc := range htlcs {
+		if err := writeHTLC(buf, htlc); err != nil {
+			return fmt.Errorf("%s: %v", fieldName, err)
+		}
+	}
+
+	return nil
+}
+
+func writeHTLC(buf *bytes.Buffer, htlc lnwire.UpdateAddHTLC) error {
+	if len(htlc.ExtraData) > 0 {
+		return fmt.Errorf("htlc %v has extension data which can't be part of a state", htlc.ID)
+	}
+
+	return htlc.Encode(buf, 1)
 }
 
 func (c *LastCrossSignedState) MsgType() MessageType {
 	return MsgLastCrossedSignedState
 }
+
+// Reverse returns the state as seen by the other side of the channel: local and
+// remote fields are swapped and incoming HTLCs become outgoing ones. The slices
+// are copied so changing one view never changes the other.
+func (c *LastCrossSignedState) Reverse() *LastCrossSignedState {
+	return &LastCrossSignedState{
+		IsHost:                 !c.IsHost,
+		LastRefundScriptPubKey: copyBytes(c.LastRefundScriptPubKey),
+		InitHostedChannel:      c.InitHostedChannel,
+		Blockday:               c.Blockday,
+		LocalBalanceMSat:       c.RemoteBalanceMSat,
+		RemoteBalanceMSat:      c.LocalBalanceMSat,
+		LocalUpdates:           c.RemoteUpdates,
+		RemoteUpdates:          c.LocalUpdates,
+		IncomingHTLCs:          copyHTLCs(c.OutgoingHTLCs),
+		OutgoingHTLCs:          copyHTLCs(c.IncomingHTLCs),
+		RemoteSigOfLocal:       c.LocalSigOfRemote,
+		LocalSigOfRemote:       c.RemoteSigOfLocal,
+	}
+}
+
+// nil stays nil so a state reversed twice is equal to itself
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func copyHTLCs(htlcs []lnwire.UpdateAddHTLC) []lnwire.UpdateAddHTLC {
+	if htlcs == nil {
+		return nil
+	}
+	return append([]lnwire.UpdateAddHTLC{}, htlcs...)
+}
+
+// HostedSigHash is the digest both sides sign (see the RFC); integers are
+// little endian and HTLCs are sorted lexicographically by their encoding.
+func (c *LastCrossSignedState) HostedSigHash() ([32]byte, error) {
+	incoming, err := encodeSortedHTLCs(c.IncomingHTLCs)
+	if err != nil {
+		return [32]byte{}, err
+	}
+
+	outgoing, err := encodeSortedHTLCs(c.OutgoingHTLCs)
+	if err != nil {
+		return [32]byte{}, err
+	}
+
+	var b bytes.Buffer
+	b.Write(c.LastRefundScriptPubKey)
+	binary.Write(&b, binary.LittleEndian, c.InitHostedChannel.ChannelCapacityMSat)
+	binary.Write(&b, binary.LittleEndian, c.InitHostedChannel.InitialClientBalanceMSat)
+	binary.Write(&b, binary.LittleEndian, c.Blockday)
+	binary.Write(&b, binary.LittleEndian, c.LocalBalanceMSat)
+	binary.Write(&b, binary.LittleEndian, c.RemoteBalanceMSat)
+	binary.Write(&b, binary.LittleEndian, c.LocalUpdates)
+	binary.Write(&b, binary.LittleEndian, c.RemoteUpdates)
+	for _, htlc := range incoming {
+		b.Write(htlc)
+	}
+	for _, htlc := range outgoing {
+		b.Write(htlc)
+	}
+	if c.IsHost {
+		b.WriteByte(1)
+	} else {
+		b.WriteByte(0)
+	}
+
+	return sha256.Sum256(b.Bytes()), nil
+}
+
+func encodeSortedHTLCs(htlcs []lnwire.UpdateAddHTLC) ([][]byte, error) {
+	encoded := make([][]byte, 0, len(htlcs))
+	for _, htlc := range htlcs {
+		buf := new(bytes.Buffer)
+		if err := writeHTLC(buf, htlc); err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, buf.Bytes())
+	}
+
+	sort.Slice(encoded, func(i, j int) bool {
+		return bytes.Compare(encoded[i], encoded[j]) < 0
+	})
+
+	return encoded, nil
+}
+
+// SignRemote signs the remote view of this state with our node key and stores
+// the signature in LocalSigOfRemote.
+func (c *LastCrossSignedState) SignRemote(key *btcec.PrivateKey) error {
+	sig, err := c.Reverse().sign(key)
+	if err != nil {
+		return err
+	}
+	c.LocalSigOfRemote = sig
+
+	return nil
+}
+
+// VerifyRemoteSig checks that RemoteSigOfLocal is a signature of our view of
+// this state made by the remote node key.
+func (c *LastCrossSignedState) VerifyRemoteSig(pubKey *btcec.PublicKey) (bool, error) {
+	return c.verify(c.RemoteSigOfLocal, pubKey)
+}
+
+func (c *LastCrossSignedState) sign(key *btcec.PrivateKey) ([64]byte, error) {
+	hash, err := c.HostedSigHash()
+	if err != nil {
+		return [64]byte{}, err
+	}
+
+	sig, err := key.Sign(hash[:])
+	if err != nil {
+		return [64]byte{}, err
+	}
+
+	wireSig, err := lnwire.NewSigFromSignature(sig)
+	if err != nil {
+		return [64]byte{}, err
+	}
+
+	return wireSig, nil
+}
+
+func (c *LastCrossSignedState) verify(sig [64]byte, pubKey *btcec.PublicKey) (bool, error) {
+	hash, err := c.HostedSigHash()
+	if err != nil {
+		return false, err
+	}
+
+	wireSig := lnwire.Sig(sig)
+	signature, err := wireSig.ToSignature()
+	if err != nil {
+		return false, err
+	}
+
+	return signature.Verify(hash[:], pubKey), nil
+}
+
+// StateUpdate builds the state_update message announcing our signature of this
+// state to the remote peer.
+func (c *LastCrossSignedState) StateUpdate() *StateUpdate {
+	return &StateUpdate{
+		Blockday:         c.Blockday,
+		LocalUpdates:     c.LocalUpdates,
+		RemoteUpdates:    c.RemoteUpdates,
+		LocalSigOfRemote: c.LocalSigOfRemote,
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 
 	"github.com/lightningnetwork/lnd/lnwire"
 )
@@ -23,10 +24,16 @@ const (
 	MsgStateUpdate                         = 65529
 	MsgStateOverride                       = 65527
 	MsgInvoiceForward                      = 65525
+	MsgResizeChannel                       = 65521
+	MsgQueryPreimages                      = 65515
+	MsgReplyPreimages                      = 65513
+	MsgAskBrandingInfo                     = 65511
+	MsgHostedChannelBranding               = 65509
 	MsgUpdateAddHTLC                       = 63505
 	MsgUpdateFulfillHTLC                   = 63503
 	MsgUpdateFailHTLC                      = 63501
 	MsgUpdateFailMalformedHTLC             = 63499
+	MsgError                               = 63497
 )
 
 func (t MessageType) String() string {
@@ -41,6 +48,18 @@ func (t MessageType) String() string {
 		return "state_update"
 	case MsgStateOverride:
 		return "state_override"
+	case MsgInvoiceForward:
+		return "invoice_forward"
+	case MsgResizeChannel:
+		return "resize_channel"
+	case MsgQueryPreimages:
+		return "query_preimages"
+	case MsgReplyPreimages:
+		return "reply_preimages"
+	case MsgAskBrandingInfo:
+		return "ask_branding_info"
+	case MsgHostedChannelBranding:
+		return "hosted_channel_branding"
 	case MsgUpdateAddHTLC:
 		return "update_add_htlc"
 	case MsgUpdateFulfillHTLC:
@@ -49,11 +68,31 @@ func (t MessageType) String() string {
 		return "update_fail_htlc"
 	case MsgUpdateFailMalformedHTLC:
 		return "update_fail_malformed_htlc"
+	case MsgError:
+		return "error"
 	default:
 		return "<unknown>"
 	}
 }
 
+var messageTypes = []MessageType{
+	MsgInvokeHostedChannel, MsgInitHostedChannel, MsgLastCrossedSignedState, MsgStateUpdate,
+	MsgStateOverride, MsgInvoiceForward, MsgResizeChannel, MsgQueryPreimages, MsgReplyPreimages,
+	MsgAskBrandingInfo, MsgHostedChannelBranding, MsgUpdateAddHTLC,
+	MsgUpdateFulfillHTLC, MsgUpdateFailHTLC, MsgUpdateFailMalformedHTLC, MsgError,
+}
+
+// ParseMessageType is the inverse of String
+func ParseMessageType(name string) (MessageType, error) {
+	for _, t := range messageTypes {
+		if t.String() == name {
+			return t, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown message type %q", name)
+}
+
 // Not sure if I need this:
 /*
 type UnknownMessage struct {
@@ -86,10 +125,28 @@ func makeEmptyMessage(msgType MessageType) (Message, error) {
 		msg = &StateUpdate{}
 	case MsgStateOverride:
 		msg = &StateOverride{}
+	case MsgInvoiceForward:
+		msg = &InvoiceForward{}
+	case MsgResizeChannel:
+		msg = &ResizeChannel{}
+	case MsgQueryPreimages:
+		msg = &QueryPreimages{}
+	case MsgReplyPreimages:
+		msg = &ReplyPreimages{}
+	case MsgAskBrandingInfo:
+		msg = &AskBrandingInfo{}
+	case MsgHostedChannelBranding:
+		msg = &HostedChannelBranding{}
 	case MsgUpdateAddHTLC:
 		msg = &UpdateAddHTLC{}
 	case MsgUpdateFulfillHTLC:
 		msg = &UpdateFulfillHTLC{}
+	case MsgUpdateFailHTLC:
+		msg = &UpdateFailHTLC{}
+	case MsgUpdateFailMalformedHTLC:
+		msg = &UpdateFailMalformedHTLC{}
+	case MsgError:
+		msg = &Error{}
 	default:
 		return nil, fmt.Errorf("not a hosted channel message")
 	}
@@ -134,6 +191,17 @@ func WriteMessage(buf *bytes.Buffer, msg Message, pver uint32) (int, error) {
 }
 
 func ReadMessage(r io.Reader, pver uint32) (Message, error) {
+	// messages read their extension up to the end so don't let them read more
+	// than the largest message there can be
+	b, err := ioutil.ReadAll(io.LimitReader(r, lnwire.MaxSliceLength+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > lnwire.MaxSliceLength {
+		return nil, fmt.Errorf("message is larger than %v bytes", lnwire.MaxSliceLength)
+	}
+	r = bytes.NewReader(b)
+
 	// first two bites custom message type
 	var mType [2]byte
 	if _, err := io.ReadFull(r, mType[:]); err != nil {
@@ -0,0 +1,81 @@
+package hcwire
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/lightningnetwork/lnd/lnwire"
+)
+
+// as many 32 byte hashes as fit in a message
+const MaxPreimagesPerMessage = (lnwire.MaxMsgBody - 2 - 2) / 32
+
+// sent by a client to other hosts to learn preimages its own host won't settle with
+type QueryPreimages struct {
+	PaymentHashes [][32]byte
+	ExtraData     lnwire.ExtraOpaqueData
+}
+
+func NewQueryPreimages() *QueryPreimages {
+	return &QueryPreimages{}
+}
+
+var _ Message = (*QueryPreimages)(nil)
+
+func (c *QueryPreimages) Decode(r io.Reader, pver uint32) (err error) {
+	c.PaymentHashes, err = read32ByteList(r, "payment_hashes")
+	if err != nil {
+		return err
+	}
+
+	return readExtraData(r, &c.ExtraData)
+}
+
+func (c *QueryPreimages) Encode(buf *bytes.Buffer, pver uint32) error {
+	if err := write32ByteList(buf, c.PaymentHashes, "payment_hashes"); err != nil {
+		return err
+	}
+
+	return writeExtraData(buf, c.ExtraData)
+}
+
+func (c *QueryPreimages) MsgType() MessageType {
+	return MsgQueryPreimages
+}
+
+func read32ByteList(r io.Reader, fieldName string) ([][32]byte, error) {
+	var num uint16
+	if err := ReadElement(r, &num); err != nil {
+		return nil, err
+	}
+	if num > MaxPreimagesPerMessage {
+		return nil, fmt.Errorf("%s: %v entries, at most %v allowed", fieldName, num, MaxPreimagesPerMessage)
+	}
+
+	list := make([][32]byte, num)
+	for i := range list {
+		if _, err := io.ReadFull(r, list[i][:]); err != nil {
+			return nil, fmt.Errorf("could not parse %s: %v", fieldName, err)
+		}
+	}
+
+	return list, nil
+}
+
+func write32ByteList(buf *bytes.Buffer, list [][32]byte, fieldName string) error {
+	if len(list) > MaxPreimagesPerMessage {
+		return fmt.Errorf("%s: %v entries, at most %v allowed", fieldName, len(list), MaxPreimagesPerMessage)
+	}
+
+	if err := lnwire.WriteUint16(buf, uint16(len(list))); err != nil {
+		return err
+	}
+	for _, b := range list {
+		if _, err := buf.Write(b[:]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
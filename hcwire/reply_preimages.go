@@ -0,0 +1,41 @@
+package hcwire
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/lightningnetwork/lnd/lnwire"
+)
+
+// answer to query_preimages with the preimages the host knows; the others are left out
+type ReplyPreimages struct {
+	Preimages [][32]byte
+	ExtraData lnwire.ExtraOpaqueData
+}
+
+func NewReplyPreimages() *ReplyPreimages {
+	return &ReplyPreimages{}
+}
+
+var _ Message = (*ReplyPreimages)(nil)
+
+func (c *ReplyPreimages) Decode(r io.Reader, pver uint32) (err error) {
+	c.Preimages, err = read32ByteList(r, "preimages")
+	if err != nil {
+		return err
+	}
+
+	return readExtraData(r, &c.ExtraData)
+}
+
+func (c *ReplyPreimages) Encode(buf *bytes.Buffer, pver uint32) error {
+	if err := write32ByteList(buf, c.Preimages, "preimages"); err != nil {
+		return err
+	}
+
+	return writeExtraData(buf, c.ExtraData)
+}
+
+func (c *ReplyPreimages) MsgType() MessageType {
+	return MsgReplyPreimages
+}
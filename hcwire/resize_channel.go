@@ -0,0 +1,132 @@
+package hcwire
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/tlv"
+)
+
+// sent by a client to ask for a larger channel. it's a pending update like an
+// htlc: once both sides signed the next state the capacity is NewCapacitySat and
+// the host's balance grows by the difference.
+type ResizeChannel struct {
+	NewCapacitySat uint64
+	ClientSig      [64]byte // signature of sha256(new capacity as little endian uint64)
+	ExtraData      lnwire.ExtraOpaqueData
+}
+
+func NewResizeChannel() *ResizeChannel {
+	return &ResizeChannel{}
+}
+
+var _ Message = (*ResizeChannel)(nil)
+
+func (c *ResizeChannel) Decode(r io.Reader, pver uint32) error {
+	if err := ReadElement(r, &c.NewCapacitySat); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(r, c.ClientSig[:]); err != nil {
+		return fmt.Errorf("could not parse client_sig: %v", err)
+	}
+
+	return readExtraData(r, &c.ExtraData)
+}
+
+func (c *ResizeChannel) Encode(buf *bytes.Buffer, pver uint32) error {
+	if err := lnwire.WriteUint64(buf, c.NewCapacitySat); err != nil {
+		return err
+	}
+
+	if _, err := buf.Write(c.ClientSig[:]); err != nil {
+		return err
+	}
+
+	return writeExtraData(buf, c.ExtraData)
+}
+
+func (c *ResizeChannel) MsgType() MessageType {
+	return MsgResizeChannel
+}
+
+func (c *ResizeChannel) SigHash() [32]byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], c.NewCapacitySat)
+
+	return sha256.Sum256(b[:])
+}
+
+func (c *ResizeChannel) Sign(key *btcec.PrivateKey) error {
+	hash := c.SigHash()
+	sig, err := key.Sign(hash[:])
+	if err != nil {
+		return err
+	}
+
+	wireSig, err := lnwire.NewSigFromSignature(sig)
+	if err != nil {
+		return err
+	}
+	c.ClientSig = wireSig
+
+	return nil
+}
+
+func (c *ResizeChannel) VerifyClientSig(pubKey *btcec.PublicKey) (bool, error) {
+	wireSig := lnwire.Sig(c.ClientSig)
+	signature, err := wireSig.ToSignature()
+	if err != nil {
+		return false, err
+	}
+
+	hash := c.SigHash()
+
+	return signature.Verify(hash[:], pubKey), nil
+}
+
+// hosts that charge for resizing want the hash of a paid invoice; it goes in
+// this odd record of the extension
+const resizePaymentHashType tlv.Type = 1
+
+func (c *ResizeChannel) PaymentHash() (*[32]byte, error) {
+	var paymentHash [32]byte
+	record := tlv.MakePrimitiveRecord(resizePaymentHashType, &paymentHash)
+
+	stream, err := tlv.NewStream(record)
+	if err != nil {
+		return nil, err
+	}
+	types, err := stream.DecodeWithParsedTypes(bytes.NewReader(c.ExtraData))
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := types[resizePaymentHashType]; !ok {
+		return nil, nil
+	}
+
+	return &paymentHash, nil
+}
+
+// SetPaymentHash replaces the extension with one carrying the payment hash
+func (c *ResizeChannel) SetPaymentHash(paymentHash [32]byte) error {
+	record := tlv.MakePrimitiveRecord(resizePaymentHashType, &paymentHash)
+
+	stream, err := tlv.NewStream(record)
+	if err != nil {
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+	if err := stream.Encode(buf); err != nil {
+		return err
+	}
+	c.ExtraData = buf.Bytes()
+
+	return nil
+}
@@ -14,6 +14,7 @@ type StateOverride struct {
 	LocalUpdates     uint32
 	RemoteUpdates    uint32
 	LocalSigOfRemote [64]byte
+	ExtraData        lnwire.ExtraOpaqueData
 }
 
 func NewStateOverride() *StateOverride {
@@ -43,7 +44,7 @@ func (c *StateOverride) Decode(r io.Reader, pver uint32) error {
 		return fmt.Errorf("could not parse local_sig_of_remote: %v", err)
 	}
 
-	return nil
+	return readExtraData(r, &c.ExtraData)
 }
 
 func (c *StateOverride) Encode(buf *bytes.Buffer, pver uint32) error {
@@ -67,7 +68,7 @@ func (c *StateOverride) Encode(buf *bytes.Buffer, pver uint32) error {
 		return err
 	}
 
-	return nil
+	return writeExtraData(buf, c.ExtraData)
 }
 
 func (c *StateOverride) MsgType() MessageType {
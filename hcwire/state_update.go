@@ -13,6 +13,7 @@ type StateUpdate struct {
 	LocalUpdates     uint32
 	RemoteUpdates    uint32
 	LocalSigOfRemote [64]byte // sig of remote last_crossed_signed_state
+	ExtraData        lnwire.ExtraOpaqueData
 }
 
 func NewStateUpdate() *StateUpdate {
@@ -38,7 +39,7 @@ func (c *StateUpdate) Decode(r io.Reader, pver uint32) error {
 		return fmt.Errorf("could not parse local_sig_of_remote: %v", err)
 	}
 
-	return nil
+	return readExtraData(r, &c.ExtraData)
 }
 
 func (c *StateUpdate) Encode(buf *bytes.Buffer, pver uint32) error {
@@ -58,7 +59,7 @@ func (c *StateUpdate) Encode(buf *bytes.Buffer, pver uint32) error {
 		return err
 	}
 
-	return nil
+	return writeExtraData(buf, c.ExtraData)
 }
 
 func (c *StateUpdate) MsgType() MessageType {
@@ -19,11 +19,20 @@ func NewUpdateAddHTLC() *UpdateAddHTLC {
 
 var _ Message = (*UpdateAddHTLC)(nil)
 
+// lnwire keeps whatever follows the fields in ExtraData; make sure it's a valid extension
 func (c *UpdateAddHTLC) Decode(r io.Reader, pver uint32) error {
-	return c.UpdateAddHTLC.Decode(r, pver)
+	if err := c.UpdateAddHTLC.Decode(r, pver); err != nil {
+		return err
+	}
+
+	return ValidateExtraData(c.ExtraData)
 }
 
 func (c *UpdateAddHTLC) Encode(buf *bytes.Buffer, pver uint32) error {
+	if err := ValidateExtraData(c.ExtraData); err != nil {
+		return err
+	}
+
 	return c.UpdateAddHTLC.Encode(buf, pver)
 }
 
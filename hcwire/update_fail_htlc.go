@@ -0,0 +1,39 @@
+package hcwire
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/lightningnetwork/lnd/lnwire"
+)
+
+type UpdateFailHTLC struct {
+	lnwire.UpdateFailHTLC
+}
+
+func NewUpdateFailHTLC() *UpdateFailHTLC {
+	return &UpdateFailHTLC{}
+}
+
+var _ Message = (*UpdateFailHTLC)(nil)
+
+// lnwire keeps whatever follows the fields in ExtraData; make sure it's a valid extension
+func (c *UpdateFailHTLC) Decode(r io.Reader, pver uint32) error {
+	if err := c.UpdateFailHTLC.Decode(r, pver); err != nil {
+		return err
+	}
+
+	return ValidateExtraData(c.ExtraData)
+}
+
+func (c *UpdateFailHTLC) Encode(buf *bytes.Buffer, pver uint32) error {
+	if err := ValidateExtraData(c.ExtraData); err != nil {
+		return err
+	}
+
+	return c.UpdateFailHTLC.Encode(buf, pver)
+}
+
+func (c *UpdateFailHTLC) MsgType() MessageType {
+	return MsgUpdateFailHTLC
+}
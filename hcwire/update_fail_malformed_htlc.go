@@ -0,0 +1,39 @@
+package hcwire
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/lightningnetwork/lnd/lnwire"
+)
+
+type UpdateFailMalformedHTLC struct {
+	lnwire.UpdateFailMalformedHTLC
+}
+
+func NewUpdateFailMalformedHTLC() *UpdateFailMalformedHTLC {
+	return &UpdateFailMalformedHTLC{}
+}
+
+var _ Message = (*UpdateFailMalformedHTLC)(nil)
+
+// lnwire keeps whatever follows the fields in ExtraData; make sure it's a valid extension
+func (c *UpdateFailMalformedHTLC) Decode(r io.Reader, pver uint32) error {
+	if err := c.UpdateFailMalformedHTLC.Decode(r, pver); err != nil {
+		return err
+	}
+
+	return ValidateExtraData(c.ExtraData)
+}
+
+func (c *UpdateFailMalformedHTLC) Encode(buf *bytes.Buffer, pver uint32) error {
+	if err := ValidateExtraData(c.ExtraData); err != nil {
+		return err
+	}
+
+	return c.UpdateFailMalformedHTLC.Encode(buf, pver)
+}
+
+func (c *UpdateFailMalformedHTLC) MsgType() MessageType {
+	return MsgUpdateFailMalformedHTLC
+}
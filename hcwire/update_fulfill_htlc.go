@@ -17,11 +17,20 @@ func NewUpdateFulfillHTLC() *UpdateFulfillHTLC {
 
 var _ Message = (*UpdateFulfillHTLC)(nil)
 
+// lnwire keeps whatever follows the fields in ExtraData; make sure it's a valid extension
 func (c *UpdateFulfillHTLC) Decode(r io.Reader, pver uint32) error {
-	return c.UpdateFulfillHTLC.Decode(r, pver)
+	if err := c.UpdateFulfillHTLC.Decode(r, pver); err != nil {
+		return err
+	}
+
+	return ValidateExtraData(c.ExtraData)
 }
 
 func (c *UpdateFulfillHTLC) Encode(buf *bytes.Buffer, pver uint32) error {
+	if err := ValidateExtraData(c.ExtraData); err != nil {
+		return err
+	}
+
 	return c.UpdateFulfillHTLC.Encode(buf, pver)
 }
 
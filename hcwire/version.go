@@ -0,0 +1,110 @@
+package hcwire
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/tlv"
+)
+
+/*
+PROTOCOL VERSIONS are what Encode/Decode get as pver:
+- both sides announce the highest version they speak in an odd record of
+  invoke_hosted_channel (client) and init_hosted_channel/last_cross_signed_state (host)
+- the channel uses the lower one; peers that don't announce one speak version 1
+- invoke_hosted_channel, init_hosted_channel and last_cross_signed_state are the
+  same in all versions since they are sent before the version is known
+- version 2 only changes how error is encoded; every other message is the same
+  in both versions
+*/
+
+const (
+	ProtocolVersion1 uint32 = 1 // the RFC as deployed in the first wallets
+	ProtocolVersion2 uint32 = 2 // error codes are a field of their own instead of ascii at the start of the data
+)
+
+const LatestProtocolVersion = ProtocolVersion2
+
+// NegotiateProtocolVersion returns the highest version both sides speak; 0
+// means the peer didn't announce one
+func NegotiateProtocolVersion(local, remote uint32) uint32 {
+	if remote == 0 {
+		remote = ProtocolVersion1
+	}
+	if remote < local {
+		return remote
+	}
+
+	return local
+}
+
+const protocolVersionType tlv.Type = 3
+
+func (c *InvokeHostedChannel) ProtocolVersion() (uint32, error) {
+	return getProtocolVersion(c.ExtraData)
+}
+
+func (c *InvokeHostedChannel) SetProtocolVersion(version uint32) (err error) {
+	c.ExtraData, err = setProtocolVersion(c.ExtraData, version)
+	return err
+}
+
+func (c *InitHostedChannel) ProtocolVersion() (uint32, error) {
+	return getProtocolVersion(c.ExtraData)
+}
+
+func (c *InitHostedChannel) SetProtocolVersion(version uint32) (err error) {
+	c.ExtraData, err = setProtocolVersion(c.ExtraData, version)
+	return err
+}
+
+func (c *LastCrossSignedState) ProtocolVersion() (uint32, error) {
+	return getProtocolVersion(c.ExtraData)
+}
+
+func (c *LastCrossSignedState) SetProtocolVersion(version uint32) (err error) {
+	c.ExtraData, err = setProtocolVersion(c.ExtraData, version)
+	return err
+}
+
+// 0 if the extension doesn't have the record
+func getProtocolVersion(extraData lnwire.ExtraOpaqueData) (uint32, error) {
+	var version uint32
+	record := tlv.MakePrimitiveRecord(protocolVersionType, &version)
+
+	stream, err := tlv.NewStream(record)
+	if err != nil {
+		return 0, err
+	}
+	if err := stream.Decode(bytes.NewReader(extraData)); err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+func setProtocolVersion(extraData lnwire.ExtraOpaqueData, version uint32) (lnwire.ExtraOpaqueData, error) {
+	return setExtensionRecord(extraData, tlv.MakePrimitiveRecord(protocolVersionType, &version))
+}
+
+// the extension has at most the protocol version record and that one is valid
+func checkOnlyProtocolVersion(extraData lnwire.ExtraOpaqueData) error {
+	stream, err := tlv.NewStream()
+	if err != nil {
+		return err
+	}
+	types, err := stream.DecodeWithParsedTypes(bytes.NewReader(extraData))
+	if err != nil {
+		return fmt.Errorf("invalid tlv extension: %v", err)
+	}
+
+	for typ := range types {
+		if typ != protocolVersionType {
+			return fmt.Errorf("unexpected extension record %v", typ)
+		}
+	}
+
+	_, err = getProtocolVersion(extraData)
+	return err
+}
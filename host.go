@@ -0,0 +1,267 @@
+package main
+
+/*
+HOST VIEW of the channel state machine:
+
+	invoke_hosted_channel --> [invoked] --state_update--> [open]
+	                                                        |
+	 invoke_hosted_channel (re-establish) <--> [suspended] -+
+	                                                        |
+	                     invalid signature/state --> [errored]
+
+- new client: reply with init_hosted_channel and wait for the client to sign the first state
+- known client: reply with our last_cross_signed_state and wait for the client's one
+*/
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+	"github.com/raphjaph/go-hosted-channels/hcwire"
+)
+
+// parameters the host offers to every new client
+func getHostInitHostedChannel(p *plugin.Plugin) *hcwire.InitHostedChannel {
+	capacitySat := p.Args.Get("hosted-channel-size").Uint()
+
+	return &hcwire.InitHostedChannel{
+		MaxHTLCValueInFlightMSat:           capacitySat * 1000 / 10,
+		HTLCMinimumMSat:                    1000,
+		MaxAcceptedHTLCs:                   30,
+		ChannelCapacityMSat:                capacitySat * 1000,
+		LiabilityDeadlineBlockdays:         360,
+		MinimalOnChainRefundAmountSatoshis: 100000,
+		InitialClientBalanceMSat:           0,
+		Features:                           supportedFeatures,
+	}
+}
+
+func hostHandleInvokeHostedChannel(p *plugin.Plugin, peer string, invokeHC *hcwire.InvokeHostedChannel) error {
+	if invokeHC.ChainHash != getGenesisHash(p.Network) {
+		return denyChannel(p, peer, fmt.Errorf("invoke_hosted_channel for wrong chain: %x", invokeHC.ChainHash))
+	}
+
+	if secret := p.Args.Get("hosted-channel-secret").String(); secret != "" && secret != string(invokeHC.Secret) {
+		return denyChannel(p, peer, fmt.Errorf("invoke_hosted_channel with wrong secret"))
+	}
+
+	clientVersion, err := invokeHC.ProtocolVersion()
+	if err != nil {
+		return denyChannel(p, peer, fmt.Errorf("invalid protocol version in invoke_hosted_channel: %v", err))
+	}
+	version := hcwire.NegotiateProtocolVersion(hcwire.LatestProtocolVersion, clientVersion)
+
+	channel, err := store.getChannel(peer)
+	if err == errChannelNotFound || (err == nil && channel.Status == StatusInvoked) {
+		// new client (or one that never signed the first state)
+		channelID, err := getChannelID(p, peer, invokeHC.RefundScriptPubKey)
+		if err != nil {
+			return err
+		}
+
+		// clients without features don't send any; that's just an empty vector
+		clientFeatures, err := invokeHC.Features()
+		if err != nil {
+			return denyChannel(p, peer, fmt.Errorf("invalid features in invoke_hosted_channel: %v", err))
+		}
+		features, err := hcwire.NegotiateFeatures(supportedFeatures, clientFeatures)
+		if err != nil {
+			return denyChannel(p, peer, err)
+		}
+
+		initHC := getHostInitHostedChannel(p)
+		channel = Channel{
+			ChannelID:         channelID,
+			PeerID:            peer,
+			IsHost:            true,
+			Status:            StatusInvoked,
+			InitHostedChannel: *initHC,
+			Features:          features,
+			ProtocolVersion:   version,
+			LastCrossSignedState: hcwire.LastCrossSignedState{
+				IsHost:                 true,
+				LastRefundScriptPubKey: invokeHC.RefundScriptPubKey,
+				InitHostedChannel:      *initHC,
+			},
+		}
+		if err := store.saveChannel(channel); err != nil {
+			return err
+		}
+
+		// the client learns our version from the extension
+		if err := initHC.SetProtocolVersion(hcwire.LatestProtocolVersion); err != nil {
+			return err
+		}
+
+		return sendMessage(p, peer, initHC)
+	}
+	if err != nil {
+		return err
+	}
+
+	// known client: re-establish by exchanging last_cross_signed_state
+	if channel.Status == StatusOpen {
+		channel.Status = StatusSuspended
+	}
+	channel.ProtocolVersion = version
+	if err := store.saveChannel(channel); err != nil {
+		return err
+	}
+
+	state := channel.LastCrossSignedState
+	if err := state.SetProtocolVersion(hcwire.LatestProtocolVersion); err != nil {
+		return err
+	}
+	if err := sendMessage(p, peer, &state); err != nil {
+		return err
+	}
+
+	// remind the client why the channel is errored and how it can be reopened
+	if err := sendChannelError(p, channel); err != nil {
+		return err
+	}
+	if channel.StateOverride != nil {
+		return sendMessage(p, peer, channel.StateOverride)
+	}
+
+	return nil
+}
+
+// the client signed the first state of a new channel
+func hostHandleStateUpdate(p *plugin.Plugin, channel Channel, stateUpdate *hcwire.StateUpdate) error {
+	if channel.Status != StatusInvoked {
+		return fmt.Errorf("unexpected state_update in channel status %v", channel.Status)
+	}
+
+	blockday, err := getBlockday(p)
+	if err != nil {
+		return err
+	}
+	if !isBlockdayAcceptable(blockday, stateUpdate.Blockday) {
+		return errorChannel(p, channel, newChannelError(hcwire.ErrWrongBlockday, "state_update with blockday %v, ours is %v", stateUpdate.Blockday, blockday))
+	}
+
+	if stateUpdate.LocalUpdates != 0 || stateUpdate.RemoteUpdates != 0 {
+		return fmt.Errorf("first state_update must not contain updates")
+	}
+
+	initHC := channel.InitHostedChannel
+	state := channel.LastCrossSignedState
+	state.Blockday = stateUpdate.Blockday
+	state.LocalBalanceMSat = initHC.ChannelCapacityMSat - initHC.InitialClientBalanceMSat
+	state.RemoteBalanceMSat = initHC.InitialClientBalanceMSat
+	state.RemoteSigOfLocal = stateUpdate.LocalSigOfRemote
+
+	if err := verifyAndSign(p, channel.PeerID, &state); err != nil {
+		return errorChannel(p, channel, err)
+	}
+
+	channel.LastCrossSignedState = state
+	channel.Status = StatusOpen
+	if err := store.saveChannel(channel); err != nil {
+		return err
+	}
+
+	return sendMessage(p, channel.PeerID, state.StateUpdate())
+}
+
+// the client replied to our last_cross_signed_state during re-establishment
+func hostHandleLastCrossSignedState(p *plugin.Plugin, channel Channel, remote *hcwire.LastCrossSignedState) error {
+	if channel.Status != StatusSuspended {
+		return fmt.Errorf("unexpected last_cross_signed_state in channel status %v", channel.Status)
+	}
+
+	if remote.IsHost {
+		return errorChannel(p, channel, fmt.Errorf("client claims to be the host"))
+	}
+	if err := remote.Validate(); err != nil {
+		return errorChannel(p, channel, fmt.Errorf("invalid last_cross_signed_state: %v", err))
+	}
+
+	// the client's state from our point of view; both signatures have to be valid
+	state := remote.Reverse()
+	if err := verifySignatures(p, channel.PeerID, state); err != nil {
+		return errorChannel(p, channel, err)
+	}
+
+	local := channel.LastCrossSignedState
+	if state.LocalUpdates+state.RemoteUpdates > local.LocalUpdates+local.RemoteUpdates {
+		// client has a more recent state that we signed but didn't store
+		channel.LastCrossSignedState = *state
+	} else if !bytes.Equal(state.LastRefundScriptPubKey, local.LastRefundScriptPubKey) ||
+		state.LocalBalanceMSat != local.LocalBalanceMSat ||
+		state.RemoteBalanceMSat != local.RemoteBalanceMSat ||
+		state.LocalUpdates+state.RemoteUpdates < local.LocalUpdates+local.RemoteUpdates {
+		// client is behind; it has to catch up with the state we sent
+		return sendMessage(p, channel.PeerID, &local)
+	}
+
+	channel.Status = StatusOpen
+	if err := store.saveChannel(channel); err != nil {
+		return err
+	}
+
+	return sendMessage(p, channel.PeerID, channel.LastCrossSignedState.StateUpdate())
+}
+
+// checks the remote signature of our view of the state and adds our signature
+// of the remote view
+func verifyAndSign(p *plugin.Plugin, peer string, state *hcwire.LastCrossSignedState) error {
+	peerKey, err := parseNodeID(peer)
+	if err != nil {
+		return err
+	}
+
+	ok, err := state.VerifyRemoteSig(peerKey)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return newChannelError(hcwire.ErrWrongRemoteSig, "signature of state with %v/%v updates", state.RemoteUpdates, state.LocalUpdates)
+	}
+
+	nodeKey, err := getNodeKey(p)
+	if err != nil {
+		return err
+	}
+
+	return state.SignRemote(nodeKey)
+}
+
+// checks that a state the peer sent us is signed by both sides
+func verifySignatures(p *plugin.Plugin, peer string, state *hcwire.LastCrossSignedState) error {
+	peerKey, err := parseNodeID(peer)
+	if err != nil {
+		return err
+	}
+
+	nodeKey, err := getNodeKey(p)
+	if err != nil {
+		return err
+	}
+
+	ok, err := state.VerifyRemoteSig(peerKey)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return newChannelError(hcwire.ErrWrongRemoteSig, "last_cross_signed_state with %v/%v updates", state.RemoteUpdates, state.LocalUpdates)
+	}
+
+	// our own signature is the remote signature of the reversed state
+	ok, err = state.Reverse().VerifyRemoteSig(nodeKey.PubKey())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return newChannelError(hcwire.ErrWrongLocalSig, "last_cross_signed_state with %v/%v updates", state.RemoteUpdates, state.LocalUpdates)
+	}
+
+	return nil
+}
+
+// blockdays of both sides may differ by one around the day boundary
+func isBlockdayAcceptable(local, remote uint32) bool {
+	return remote+1 >= local && remote <= local+1
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/raphjaph/go-hosted-channels/hcwire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// a client that is just a key: it answers init_hosted_channel with a state_update
+// it signed itself
+func TestHostWithFakeClient(t *testing.T) {
+	tests := []struct {
+		name      string
+		signature func(t *testing.T, client *testNode, state *hcwire.LastCrossSignedState)
+		status    ChannelStatus
+	}{
+		{"valid signature", func(t *testing.T, client *testNode, state *hcwire.LastCrossSignedState) {
+			key, err := getNodeKey(client.p)
+			require.NoError(t, err)
+			require.NoError(t, state.SignRemote(key))
+		}, StatusOpen},
+		{"wrong signature", func(t *testing.T, client *testNode, state *hcwire.LastCrossSignedState) {
+			key, err := btcec.NewPrivateKey(btcec.S256())
+			require.NoError(t, err)
+			require.NoError(t, state.SignRemote(key))
+		}, StatusErrored},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newTestNode(t, optionFlags{})
+			host := newTestNode(t, optionFlags{})
+
+			sendTestInvoke(t, client, host)
+			host.use()
+			handlePeerMessage(host.p, client.id, client.ln.takeSent()[0].payload, false)
+
+			sent := host.ln.takeSent()
+			require.Len(t, sent, 1)
+			msg, err := decodeMessage(sent[0].payload, hcwire.ProtocolVersion1)
+			require.NoError(t, err)
+			initHC, ok := msg.(*hcwire.InitHostedChannel)
+			require.True(t, ok)
+
+			// the first state as the client sees it
+			state := &hcwire.LastCrossSignedState{
+				LastRefundScriptPubKey: getTestRefundScriptPubKey(),
+				InitHostedChannel:      *initHC,
+				Blockday:               testBlockheight / 144,
+				LocalBalanceMSat:       initHC.InitialClientBalanceMSat,
+				RemoteBalanceMSat:      initHC.ChannelCapacityMSat - initHC.InitialClientBalanceMSat,
+			}
+			test.signature(t, client, state)
+
+			buf := new(bytes.Buffer)
+			_, err = hcwire.WriteMessage(buf, state.StateUpdate(), hcwire.ProtocolVersion1)
+			require.NoError(t, err)
+			host.use()
+			handlePeerMessage(host.p, client.id, hex.EncodeToString(buf.Bytes()), false)
+
+			channel := host.channel(t, client)
+			assert.Equal(t, test.status, channel.Status)
+
+			sent = host.ln.takeSent()
+			require.Len(t, sent, 1)
+			host.use()
+			msg, err = decodeMessage(sent[0].payload, getProtocolVersion(client.id))
+			require.NoError(t, err)
+			if test.status != StatusOpen {
+				assert.Equal(t, hcwire.ErrWrongRemoteSig, channel.ErrorReason.Code)
+				assert.Equal(t, hcwire.MessageType(hcwire.MsgError), msg.MsgType())
+				return
+			}
+
+			// the host's signature is of the state the client has
+			hostKey, err := parseNodeID(host.id)
+			require.NoError(t, err)
+			state.RemoteSigOfLocal = msg.(*hcwire.StateUpdate).LocalSigOfRemote
+			ok, err = state.VerifyRemoteSig(hostKey)
+			require.NoError(t, err)
+			assert.True(t, ok)
+		})
+	}
+}
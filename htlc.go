@@ -0,0 +1,672 @@
+package main
+
+/*
+HTLC UPDATES (both sides):
+- update_add/fulfill/fail_htlc are collected in NextLocalUpdates/NextRemoteUpdates
+- whoever sends an update follows it with a state_update signing the next state
+- a state_update from the peer that signs our next state commits the pending updates;
+  we answer with our own state_update if we haven't signed that state yet
+- when both sides send updates at once each state_update misses the other side's;
+  whoever has unsigned updates signs the whole next state again
+
+HOST VIEW of forwarding (htlc_accepted):
+- [x] parse HTLC message
+- [x] return HTLC to lightningd if short channel ID (scid) not from hosted channels
+- [x] forward HTLC to hosted channel peer
+- [x] wait for htlc_fulfill from CLIENT
+- [x] resolve HTLC with non-hosted-channel peer with payment key/preimage from htlc_fufill
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/raphjaph/go-hosted-channels/hcwire"
+	"github.com/tidwall/gjson"
+)
+
+// how often to check whether htlcs we hold the hook for are about to expire
+const blockPollInterval = time.Minute
+
+// blocks before the incoming htlc expires at which we stop waiting for the client and fail it
+const forwardDeadlineBlocks = 6
+
+// identifies an htlc across both channel directions
+type htlcKey struct {
+	ChanID lnwire.ChannelID
+	ID     uint64
+}
+
+// how an htlc we forwarded into a hosted channel ended
+type htlcResult struct {
+	preimage  *[32]byte
+	fail      *hcwire.UpdateFailHTLC
+	malformed *hcwire.UpdateFailMalformedHTLC
+}
+
+// htlc_accepted hooks waiting for the client to resolve an htlc
+var htlcWaiters = newWaiters[htlcKey, htlcResult]()
+
+// nextState applies the pending updates to the last cross signed state
+func nextState(channel Channel, blockday uint32) (hcwire.LastCrossSignedState, error) {
+	state := channel.LastCrossSignedState
+	state.IncomingHTLCs = append([]lnwire.UpdateAddHTLC{}, state.IncomingHTLCs...)
+	state.OutgoingHTLCs = append([]lnwire.UpdateAddHTLC{}, state.OutgoingHTLCs...)
+	state.Blockday = blockday
+	state.LocalUpdates += uint32(len(channel.NextLocalUpdates))
+	state.RemoteUpdates += uint32(len(channel.NextRemoteUpdates))
+
+	for _, update := range channel.NextLocalUpdates {
+		if err := applyUpdate(&state, update, true); err != nil {
+			return state, err
+		}
+	}
+	for _, update := range channel.NextRemoteUpdates {
+		if err := applyUpdate(&state, update, false); err != nil {
+			return state, err
+		}
+	}
+
+	return state, nil
+}
+
+func applyUpdate(state *hcwire.LastCrossSignedState, update hcwire.Message, local bool) error {
+	// balance of whoever sent the update and of the other side
+	senderBalance, otherBalance := &state.LocalBalanceMSat, &state.RemoteBalanceMSat
+	// htlcs offered by the other side which the sender can resolve
+	offered, added := &state.IncomingHTLCs, &state.OutgoingHTLCs
+	if !local {
+		senderBalance, otherBalance = otherBalance, senderBalance
+		offered, added = added, offered
+	}
+
+	switch u := update.(type) {
+	case *hcwire.UpdateAddHTLC:
+		amount := uint64(u.Amount)
+		if amount > *senderBalance {
+			return fmt.Errorf("htlc of %v msat exceeds balance of %v msat", amount, *senderBalance)
+		}
+		*senderBalance -= amount
+		// extensions of the message aren't part of the state
+		htlc := u.UpdateAddHTLC
+		htlc.ExtraData = nil
+		*added = append(*added, htlc)
+
+	case *hcwire.UpdateFulfillHTLC:
+		htlc, err := removeHTLC(offered, u.ID)
+		if err != nil {
+			return err
+		}
+		*senderBalance += uint64(htlc.Amount)
+
+	case *hcwire.UpdateFailHTLC:
+		htlc, err := removeHTLC(offered, u.ID)
+		if err != nil {
+			return err
+		}
+		*otherBalance += uint64(htlc.Amount)
+
+	case *hcwire.UpdateFailMalformedHTLC:
+		htlc, err := removeHTLC(offered, u.ID)
+		if err != nil {
+			return err
+		}
+		*otherBalance += uint64(htlc.Amount)
+
+	case *hcwire.ResizeChannel:
+		// the client sends it; the extra capacity is the host's
+		capacity := state.InitHostedChannel.ChannelCapacityMSat
+		if u.NewCapacitySat > math.MaxUint64/1000 || u.NewCapacitySat*1000 <= capacity {
+			return fmt.Errorf("resize to %v sat doesn't grow capacity of %v msat", u.NewCapacitySat, capacity)
+		}
+		*otherBalance += u.NewCapacitySat*1000 - capacity
+		state.InitHostedChannel.ChannelCapacityMSat = u.NewCapacitySat * 1000
+
+	default:
+		return fmt.Errorf("%v is not an htlc update", update.MsgType())
+	}
+
+	return nil
+}
+
+func removeHTLC(htlcs *[]lnwire.UpdateAddHTLC, id uint64) (lnwire.UpdateAddHTLC, error) {
+	for i, htlc := range *htlcs {
+		if htlc.ID == id {
+			*htlcs = append((*htlcs)[:i], (*htlcs)[i+1:]...)
+			return htlc, nil
+		}
+	}
+
+	return lnwire.UpdateAddHTLC{}, fmt.Errorf("unknown htlc id %v", id)
+}
+
+// id for the next htlc we add; update counters only ever grow so it's unique
+func nextLocalHTLCID(channel Channel) uint64 {
+	return uint64(channel.LastCrossSignedState.LocalUpdates) + uint64(len(channel.NextLocalUpdates)) + 1
+}
+
+// checks an htlc against the limits of the channel, given the state including it
+func validateHTLCLimits(initHC hcwire.InitHostedChannel, htlc lnwire.UpdateAddHTLC, htlcs []lnwire.UpdateAddHTLC) error {
+	if uint64(htlc.Amount) < initHC.HTLCMinimumMSat {
+		return fmt.Errorf("htlc of %v msat below minimum of %v msat", htlc.Amount, initHC.HTLCMinimumMSat)
+	}
+
+	if len(htlcs) > int(initHC.MaxAcceptedHTLCs) {
+		return fmt.Errorf("too many htlcs in flight: %v", len(htlcs))
+	}
+
+	var inFlight uint64
+	for _, h := range htlcs {
+		inFlight += uint64(h.Amount)
+	}
+	if inFlight > initHC.MaxHTLCValueInFlightMSat {
+		return fmt.Errorf("%v msat in flight exceeds maximum of %v msat", inFlight, initHC.MaxHTLCValueInFlightMSat)
+	}
+
+	return nil
+}
+
+// adds one of our updates, sends it and signs the resulting state; the caller saves the channel
+func sendLocalUpdate(p *plugin.Plugin, channel *Channel, update hcwire.Message) error {
+	blockday, err := getBlockday(p)
+	if err != nil {
+		return err
+	}
+
+	if len(channel.NextLocalUpdates) >= hcwire.MaxPendingUpdates {
+		return fmt.Errorf("already %v updates waiting for a signature", len(channel.NextLocalUpdates))
+	}
+
+	updated := *channel
+	updated.NextLocalUpdates = append(append([]hcwire.Message{}, channel.NextLocalUpdates...), update)
+	state, err := nextState(updated, blockday)
+	if err != nil {
+		return err
+	}
+
+	if add, ok := update.(*hcwire.UpdateAddHTLC); ok {
+		if err := validateHTLCLimits(channel.InitHostedChannel, add.UpdateAddHTLC, state.OutgoingHTLCs); err != nil {
+			return err
+		}
+	}
+
+	*channel = updated
+	if err := sendMessage(p, channel.PeerID, update); err != nil {
+		return err
+	}
+
+	return signNextState(p, channel, state)
+}
+
+func signNextState(p *plugin.Plugin, channel *Channel, state hcwire.LastCrossSignedState) error {
+	nodeKey, err := getNodeKey(p)
+	if err != nil {
+		return err
+	}
+	if err := state.SignRemote(nodeKey); err != nil {
+		return err
+	}
+
+	channel.SentStateUpdate = true
+
+	return sendMessage(p, channel.PeerID, state.StateUpdate())
+}
+
+// an htlc update from the peer of an open channel
+func handleRemoteUpdate(p *plugin.Plugin, channel Channel, update hcwire.Message) error {
+	if channel.Status != StatusOpen {
+		return fmt.Errorf("unexpected %v in channel status %v", update.MsgType(), channel.Status)
+	}
+
+	// invalid updates are protocol violations
+	if len(channel.NextRemoteUpdates) >= hcwire.MaxPendingUpdates {
+		return errorChannel(p, channel, fmt.Errorf("more than %v updates without a signature", hcwire.MaxPendingUpdates))
+	}
+	state := channel.LastCrossSignedState
+	switch u := update.(type) {
+	case *hcwire.UpdateAddHTLC:
+		if u.ChanID != channel.ChannelID {
+			return errorChannel(p, channel, fmt.Errorf("update_add_htlc for wrong channel %v", u.ChanID))
+		}
+
+	case *hcwire.UpdateFulfillHTLC:
+		// only htlcs that are cross signed can be resolved
+		htlc, ok := findHTLC(state.OutgoingHTLCs, u.ID)
+		if !ok {
+			return errorChannel(p, channel, fmt.Errorf("update_fulfill_htlc for unknown htlc %v", u.ID))
+		}
+		if sha256.Sum256(u.PaymentPreimage[:]) != htlc.PaymentHash {
+			return errorChannel(p, channel, fmt.Errorf("update_fulfill_htlc with wrong preimage for htlc %v", u.ID))
+		}
+		if err := store.savePreimage(u.PaymentPreimage); err != nil {
+			return err
+		}
+
+	case *hcwire.UpdateFailHTLC:
+		if _, ok := findHTLC(state.OutgoingHTLCs, u.ID); !ok {
+			return errorChannel(p, channel, fmt.Errorf("update_fail_htlc for unknown htlc %v", u.ID))
+		}
+
+	case *hcwire.UpdateFailMalformedHTLC:
+		if _, ok := findHTLC(state.OutgoingHTLCs, u.ID); !ok {
+			return errorChannel(p, channel, fmt.Errorf("update_fail_malformed_htlc for unknown htlc %v", u.ID))
+		}
+
+	case *hcwire.ResizeChannel:
+		if err := hostValidateResize(p, channel, u); err != nil {
+			return errorChannel(p, channel, newChannelError(hcwire.ErrInvalidResize, "%v", err))
+		}
+	}
+
+	blockday, err := getBlockday(p)
+	if err != nil {
+		return err
+	}
+
+	updated := channel
+	updated.NextRemoteUpdates = append(append([]hcwire.Message{}, channel.NextRemoteUpdates...), update)
+	next, err := nextState(updated, blockday)
+	if err != nil {
+		// a resize that passed validation holds its payment
+		releaseResizePayments(p, channel, []hcwire.Message{update})
+		return errorChannel(p, channel, err)
+	}
+	if add, ok := update.(*hcwire.UpdateAddHTLC); ok {
+		if err := validateHTLCLimits(channel.InitHostedChannel, add.UpdateAddHTLC, next.IncomingHTLCs); err != nil {
+			return errorChannel(p, channel, err)
+		}
+	}
+	channel = updated
+
+	// our signature (if any) doesn't cover this update; if we have updates of our
+	// own the peer's state_update won't cover them either so sign the whole state
+	channel.SentStateUpdate = false
+	if len(channel.NextLocalUpdates) > 0 {
+		if err := signNextState(p, &channel, next); err != nil {
+			return err
+		}
+	}
+	if err := store.saveChannel(channel); err != nil {
+		return err
+	}
+
+	// the preimage is all we need to settle upstream; don't wait for the signatures
+	switch u := update.(type) {
+	case *hcwire.UpdateFulfillHTLC:
+		preimage := [32]byte(u.PaymentPreimage)
+		htlcWaiters.notify(htlcKey{u.ChanID, u.ID}, htlcResult{preimage: &preimage})
+	}
+
+	return nil
+}
+
+func findHTLC(htlcs []lnwire.UpdateAddHTLC, id uint64) (lnwire.UpdateAddHTLC, bool) {
+	for _, htlc := range htlcs {
+		if htlc.ID == id {
+			return htlc, true
+		}
+	}
+
+	return lnwire.UpdateAddHTLC{}, false
+}
+
+// state_update on an open channel: the peer signed the state including all pending updates
+func handleOpenStateUpdate(p *plugin.Plugin, channel Channel, stateUpdate *hcwire.StateUpdate, resolveHTLCs bool) error {
+	blockday, err := getBlockday(p)
+	if err != nil {
+		return err
+	}
+	if !isBlockdayAcceptable(blockday, stateUpdate.Blockday) {
+		return errorChannel(p, channel, newChannelError(hcwire.ErrWrongBlockday, "state_update with blockday %v, ours is %v", stateUpdate.Blockday, blockday))
+	}
+
+	next, err := nextState(channel, stateUpdate.Blockday)
+	if err != nil {
+		return err
+	}
+
+	if stateUpdate.LocalUpdates > next.RemoteUpdates || stateUpdate.RemoteUpdates > next.LocalUpdates {
+		return errorChannel(p, channel, newChannelError(hcwire.ErrTooManyStateUpdates, "state_update for %v/%v updates, we have %v/%v", stateUpdate.RemoteUpdates, stateUpdate.LocalUpdates, next.LocalUpdates, next.RemoteUpdates))
+	}
+	if stateUpdate.LocalUpdates != next.RemoteUpdates || stateUpdate.RemoteUpdates != next.LocalUpdates {
+		// signature of an older state; the peer signs again once it has all
+		// updates, and so do we if we haven't yet
+		p.Logf("ignoring state_update for %v/%v updates, expected %v/%v", stateUpdate.RemoteUpdates, stateUpdate.LocalUpdates, next.LocalUpdates, next.RemoteUpdates)
+		if channel.SentStateUpdate {
+			return nil
+		}
+		ours, err := nextState(channel, blockday)
+		if err != nil {
+			return err
+		}
+		if err := signNextState(p, &channel, ours); err != nil {
+			return err
+		}
+		return store.saveChannel(channel)
+	}
+
+	next.RemoteSigOfLocal = stateUpdate.LocalSigOfRemote
+	if err := verifyAndSign(p, channel.PeerID, &next); err != nil {
+		return errorChannel(p, channel, err)
+	}
+
+	alreadySigned := channel.SentStateUpdate
+	resolved := append(append([]hcwire.Message{}, channel.NextLocalUpdates...), channel.NextRemoteUpdates...)
+	remoteUpdates := channel.NextRemoteUpdates
+
+	channel.LastCrossSignedState = next
+	channel.InitHostedChannel = next.InitHostedChannel
+	channel.NextLocalUpdates = nil
+	channel.NextRemoteUpdates = nil
+	channel.SentStateUpdate = false
+	if err := store.saveChannel(channel); err != nil {
+		return err
+	}
+
+	for _, update := range remoteUpdates {
+		if resize, ok := update.(*hcwire.ResizeChannel); ok && channel.IsHost {
+			if err := hostSpendResizePayment(resize); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !alreadySigned {
+		if err := sendMessage(p, channel.PeerID, next.StateUpdate()); err != nil {
+			return err
+		}
+	}
+
+	// failures and resizes are final once they are cross signed
+	for _, update := range resolved {
+		switch u := update.(type) {
+		case *hcwire.ResizeChannel:
+			resizeWaiters.notify(channel.PeerID, nil)
+		case *hcwire.UpdateFailHTLC:
+			htlcWaiters.notify(htlcKey{u.ChanID, u.ID}, htlcResult{fail: u})
+		case *hcwire.UpdateFailMalformedHTLC:
+			htlcWaiters.notify(htlcKey{u.ChanID, u.ID}, htlcResult{malformed: u})
+		}
+	}
+
+	// htlcs the peer added are ours to resolve now
+	for _, update := range remoteUpdates {
+		if add, ok := update.(*hcwire.UpdateAddHTLC); ok && resolveHTLCs {
+			go processIncomingHTLC(p, channel.PeerID, channel.IsHost, add.UpdateAddHTLC)
+		}
+	}
+
+	return nil
+}
+
+// lightningd gives amounts as "1000msat" strings or as plain numbers
+func parseMSat(r gjson.Result) (uint64, error) {
+	if r.Type == gjson.Number {
+		return r.Uint(), nil
+	}
+
+	return strconv.ParseUint(strings.TrimSuffix(r.String(), "msat"), 10, 64)
+}
+
+func parseShortChannelID(s string) (lnwire.ShortChannelID, error) {
+	parts := strings.Split(s, "x")
+	if len(parts) != 3 {
+		return lnwire.ShortChannelID{}, fmt.Errorf("invalid short channel id: %v", s)
+	}
+
+	var values [3]uint64
+	for i, part := range parts {
+		v, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return lnwire.ShortChannelID{}, fmt.Errorf("invalid short channel id: %v", s)
+		}
+		values[i] = v
+	}
+
+	return lnwire.ShortChannelID{
+		BlockHeight: uint32(values[0]),
+		TxIndex:     uint32(values[1]),
+		TxPosition:  uint16(values[2]),
+	}, nil
+}
+
+// lightningd's notation; lnwire's String() separates with colons
+func formatShortChannelID(scid lnwire.ShortChannelID) string {
+	return fmt.Sprintf("%dx%dx%d", scid.BlockHeight, scid.TxIndex, scid.TxPosition)
+}
+
+func handleHTLCAccepted(p *plugin.Plugin, params plugin.Params) (resp interface{}) {
+	scid := params.Get("onion.short_channel_id").String()
+	if scid == "" {
+		// we are the final hop
+		return continueHTLC
+	}
+
+	shortChannelID, err := parseShortChannelID(scid)
+	if err != nil {
+		return continueHTLC
+	}
+
+	channel, err := store.getChannelByShortChannelID(shortChannelID)
+	if err == errChannelNotFound || (err == nil && !channel.IsHost) {
+		// not one of our hosted channels; lightningd forwards it
+		return continueHTLC
+	}
+	if err != nil {
+		p.Log("error looking up hosted channel: ", err)
+		return failHTLC(&lnwire.FailTemporaryNodeFailure{})
+	}
+
+	paymentHash, err := decodeHash(params.Get("htlc.payment_hash").String())
+	if err != nil {
+		p.Log("invalid payment hash: ", err)
+		return failHTLC(&lnwire.FailTemporaryNodeFailure{})
+	}
+
+	// we may already know how it ended (e.g. the hook is replayed after a restart)
+	if preimage, err := store.getPreimage(paymentHash); err == nil {
+		return resolveWithPreimage(preimage)
+	}
+
+	amount, err := parseMSat(params.Get("onion.forward_amount"))
+	if err != nil {
+		amount, err = parseMSat(params.Get("onion.forward_msat"))
+	}
+	if err != nil {
+		p.Log("invalid forward amount: ", err)
+		return failHTLC(&lnwire.FailTemporaryNodeFailure{})
+	}
+
+	// the same checks lightningd does before forwarding: the incoming htlc has to
+	// pay our fee and leave us our cltv delta
+	incomingAmount, err := parseMSat(params.Get("htlc.amount_msat"))
+	if err != nil {
+		incomingAmount, err = parseMSat(params.Get("htlc.amount"))
+	}
+	if err != nil {
+		p.Log("invalid htlc amount: ", err)
+		return failHTLC(&lnwire.FailTemporaryNodeFailure{})
+	}
+	incomingExpiry := uint32(params.Get("htlc.cltv_expiry").Uint())
+	outgoingExpiry := uint32(params.Get("onion.outgoing_cltv_value").Uint())
+
+	baseFee, feePPM, cltvDelta, err := getForwardPolicy(p)
+	if err != nil {
+		p.Log("couldn't get forwarding policy: ", err)
+		return failHTLC(&lnwire.FailTemporaryNodeFailure{})
+	}
+	// lightningd doesn't hand out channel_updates and hosted channels have none; the failures carry an empty one
+	fee := baseFee + amount*feePPM/1000000
+	if incomingAmount < amount+fee {
+		p.Logf("htlc pays %v to forward %v to %v, fee is %v msat", incomingAmount, amount, channel.PeerID, fee)
+		return failHTLC(lnwire.NewFeeInsufficient(lnwire.MilliSatoshi(incomingAmount), lnwire.ChannelUpdate{}))
+	}
+	if uint64(incomingExpiry) < uint64(outgoingExpiry)+uint64(cltvDelta) {
+		p.Logf("htlc expires at %v but asks to forward to %v with expiry %v", incomingExpiry, channel.PeerID, outgoingExpiry)
+		return failHTLC(lnwire.NewIncorrectCltvExpiry(incomingExpiry, lnwire.ChannelUpdate{}))
+	}
+
+	nextOnion, err := hex.DecodeString(params.Get("onion.next_onion").String())
+	if err != nil || len(nextOnion) != lnwire.OnionPacketSize {
+		p.Log("invalid next onion")
+		return failHTLC(&lnwire.FailTemporaryNodeFailure{})
+	}
+
+	addHTLC := &hcwire.UpdateAddHTLC{
+		UpdateAddHTLC: lnwire.UpdateAddHTLC{
+			ChanID:      channel.ChannelID,
+			Amount:      lnwire.MilliSatoshi(amount),
+			PaymentHash: paymentHash,
+			Expiry:      outgoingExpiry,
+		},
+	}
+	copy(addHTLC.OnionBlob[:], nextOnion)
+
+	incoming := IncomingHTLC{
+		ShortChannelID: params.Get("htlc.short_channel_id").String(),
+		ID:             params.Get("htlc.id").Uint(),
+	}
+	key, waiter, err := forwardToHostedChannel(p, channel.PeerID, incoming, addHTLC)
+	if err != nil {
+		p.Logf("couldn't forward htlc to %v: %v", channel.PeerID, err)
+		return failHTLC(channelFailure(err))
+	}
+	defer htlcWaiters.remove(key, waiter)
+
+	// hold the hook until the client settles or the incoming htlc is about to expire
+	ticker := time.NewTicker(blockPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case result := <-waiter:
+			return htlcResultResponse(result)
+		case <-ticker.C:
+			info, err := p.Client.Call("getinfo")
+			if err != nil || uint32(info.Get("blockheight").Uint())+forwardDeadlineBlocks < incomingExpiry {
+				continue
+			}
+
+			// the client may still fulfill it; that's up to the state override now
+			p.Logf("htlc %v to %v not resolved %v blocks before the incoming one expires", key.ID, channel.PeerID, forwardDeadlineBlocks)
+			errorTimedOutChannel(p, channel.PeerID, key.ID)
+			return failHTLC(&lnwire.FailPermanentChannelFailure{})
+		}
+	}
+}
+
+// what we charge to forward into a hosted channel: lightningd's fee-base,
+// fee-per-satoshi and cltv-delta, which it uses for all its channels
+func getForwardPolicy(p *plugin.Plugin) (baseFee uint64, feePPM uint64, cltvDelta uint32, err error) {
+	configs, err := p.Client.Call("listconfigs")
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	// newer versions nest each option under configs with its value by type
+	get := func(name string) gjson.Result {
+		if value := configs.Get("configs." + name + ".value_int"); value.Exists() {
+			return value
+		}
+		return configs.Get(name)
+	}
+
+	return get("fee-base").Uint(), get("fee-per-satoshi").Uint(), uint32(get("cltv-delta").Uint()), nil
+}
+
+func htlcResultResponse(result htlcResult) map[string]interface{} {
+	switch {
+	case result.preimage != nil:
+		return resolveWithPreimage(*result.preimage)
+	case result.fail != nil:
+		return map[string]interface{}{"result": "fail", "failure_onion": hex.EncodeToString(result.fail.Reason)}
+	case result.malformed != nil:
+		// invalid_onion_* failures: [u16:failure_code][sha256:sha256_of_onion]
+		failure := new(bytes.Buffer)
+		lnwire.WriteUint16(failure, uint16(result.malformed.FailureCode))
+		failure.Write(result.malformed.ShaOnionBlob[:])
+		return map[string]interface{}{"result": "fail", "failure_message": hex.EncodeToString(failure.Bytes())}
+	default:
+		return failHTLC(&lnwire.FailTemporaryNodeFailure{})
+	}
+}
+
+// adds the htlc to the hosted channel unless incoming was already forwarded (replayed hook)
+func forwardToHostedChannel(p *plugin.Plugin, peer string, incoming IncomingHTLC, addHTLC *hcwire.UpdateAddHTLC) (htlcKey, chan htlcResult, error) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	channel, err := store.getChannel(peer)
+	if err != nil {
+		return htlcKey{}, nil, err
+	}
+
+	// forget htlcs that were resolved since; unsigned ones of an errored channel were failed
+	pending := channel.LastCrossSignedState.OutgoingHTLCs
+	if channel.Status == StatusOpen {
+		pending = pendingOutgoingHTLCs(channel)
+	}
+	forwarded := make(map[uint64]IncomingHTLC)
+	for _, htlc := range pending {
+		if from, ok := channel.ForwardedHTLCs[htlc.ID]; ok {
+			if from == incoming {
+				key := htlcKey{htlc.ChanID, htlc.ID}
+				return key, htlcWaiters.add(key), nil
+			}
+			forwarded[htlc.ID] = from
+		}
+	}
+
+	if channel.Status == StatusErrored && channel.ErrorReason != nil {
+		return htlcKey{}, nil, channel.ErrorReason
+	}
+	if channel.Status != StatusOpen {
+		return htlcKey{}, nil, fmt.Errorf("channel is %v", channel.Status)
+	}
+
+	// the id addLocalHTLC gives it
+	forwarded[nextLocalHTLCID(channel)] = incoming
+	channel.ForwardedHTLCs = forwarded
+
+	waiter, err := addLocalHTLC(p, channel, addHTLC)
+	return htlcKey{addHTLC.ChanID, addHTLC.ID}, waiter, err
+}
+
+// sends our htlc and returns where its result will arrive; caller holds stateMu
+func addLocalHTLC(p *plugin.Plugin, channel Channel, addHTLC *hcwire.UpdateAddHTLC) (chan htlcResult, error) {
+	addHTLC.ID = nextLocalHTLCID(channel)
+	key := htlcKey{addHTLC.ChanID, addHTLC.ID}
+	waiter := htlcWaiters.add(key)
+	if err := sendLocalUpdate(p, &channel, addHTLC); err != nil {
+		htlcWaiters.remove(key, waiter)
+		return nil, err
+	}
+
+	return waiter, store.saveChannel(channel)
+}
+
+func resolveWithPreimage(preimage [32]byte) map[string]interface{} {
+	return map[string]interface{}{"result": "resolve", "payment_key": hex.EncodeToString(preimage[:])}
+}
+
+func decodeHash(s string) ([32]byte, error) {
+	var hash [32]byte
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return hash, err
+	}
+	if len(b) != 32 {
+		return hash, fmt.Errorf("hash must be 32 bytes, got %v", len(b))
+	}
+	copy(hash[:], b)
+
+	return hash, nil
+}
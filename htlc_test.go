@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/raphjaph/go-hosted-channels/hcwire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// what htlc_accepted gives the host for an htlc to forward into the client's channel;
+// the fake lightningd charges 1000 msat plus 10 ppm and a cltv delta of 34
+func getTestHTLCAccepted(client Channel, preimage [32]byte, incomingAmount uint64, incomingExpiry uint32) plugin.Params {
+	paymentHash := sha256.Sum256(preimage[:])
+
+	return plugin.Params{
+		"onion": map[string]interface{}{
+			"short_channel_id":    formatShortChannelID(client.ShortChannelID()),
+			"forward_msat":        "100000msat",
+			"outgoing_cltv_value": testBlockheight + 144,
+			"next_onion":          hex.EncodeToString(make([]byte, lnwire.OnionPacketSize)),
+		},
+		"htlc": map[string]interface{}{
+			"short_channel_id": "800000x1x0",
+			"id":               9,
+			"amount_msat":      incomingAmount,
+			"cltv_expiry":      incomingExpiry,
+			"payment_hash":     hex.EncodeToString(paymentHash[:]),
+		},
+	}
+}
+
+func TestForwardToHostedChannel(t *testing.T) {
+	client := newTestNode(t, optionFlags{})
+	host := newTestNode(t, optionFlags{})
+	openTestChannel(t, client, host)
+
+	preimage := [32]byte{9}
+	params := getTestHTLCAccepted(host.channel(t, client), preimage, 101001, testBlockheight+144+34)
+	host.use()
+	resp := make(chan interface{})
+	go func() { resp <- handleHTLCAccepted(host.p, params) }()
+
+	// the hook holds on until the client settles
+	// reads the node's db directly; use() would race with the goroutine
+	require.Eventually(t, func() bool {
+		channel, err := host.db.getChannel(client.id)
+		return err == nil && len(channel.NextLocalUpdates) == 1
+	}, time.Second, 10*time.Millisecond)
+	exchange(t, host, client)
+
+	channel := client.channel(t, host)
+	require.Len(t, channel.LastCrossSignedState.IncomingHTLCs, 1)
+	htlc := channel.LastCrossSignedState.IncomingHTLCs[0]
+	assert.Equal(t, lnwire.MilliSatoshi(100000), htlc.Amount)
+	assert.Equal(t, uint32(testBlockheight+144), htlc.Expiry)
+	assert.Equal(t, IncomingHTLC{ShortChannelID: "800000x1x0", ID: 9}, host.channel(t, client).ForwardedHTLCs[htlc.ID])
+
+	sendTestUpdate(t, client, host, &hcwire.UpdateFulfillHTLC{
+		UpdateFulfillHTLC: lnwire.UpdateFulfillHTLC{ChanID: htlc.ChanID, ID: htlc.ID, PaymentPreimage: preimage},
+	})
+	exchange(t, client, host)
+
+	select {
+	case r := <-resp:
+		assert.Equal(t, resolveWithPreimage(preimage), r)
+	case <-time.After(time.Second):
+		t.Fatal("htlc_accepted wasn't resolved")
+	}
+	assertSameState(t, client, host)
+}
+
+func TestForwardPolicy(t *testing.T) {
+	tests := []struct {
+		name           string
+		incomingAmount uint64
+		incomingExpiry uint32
+		failure        lnwire.FailureMessage
+	}{
+		{"fee too low", 101000, testBlockheight + 144 + 34, lnwire.NewFeeInsufficient(101000, lnwire.ChannelUpdate{})},
+		{"cltv delta too small", 101001, testBlockheight + 144 + 33, lnwire.NewIncorrectCltvExpiry(testBlockheight+144+33, lnwire.ChannelUpdate{})},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newTestNode(t, optionFlags{})
+			host := newTestNode(t, optionFlags{})
+			openTestChannel(t, client, host)
+
+			params := getTestHTLCAccepted(host.channel(t, client), [32]byte{9}, test.incomingAmount, test.incomingExpiry)
+			host.use()
+			assert.Equal(t, failHTLC(test.failure), handleHTLCAccepted(host.p, params))
+
+			// the client never hears of it
+			assert.Empty(t, host.ln.takeSent())
+			assert.Empty(t, host.channel(t, client).NextLocalUpdates)
+		})
+	}
+}
+
+func TestUpdates(t *testing.T) {
+	client := newTestNode(t, optionFlags{})
+	host := newTestNode(t, optionFlags{})
+	openTestChannel(t, client, host)
+
+	payTestHTLC(t, client, host)
+	assertSameState(t, client, host)
+
+	for _, channel := range []Channel{host.channel(t, client), client.channel(t, host)} {
+		assert.Empty(t, channel.NextLocalUpdates)
+		assert.Empty(t, channel.NextRemoteUpdates)
+		assert.Empty(t, channel.LastCrossSignedState.IncomingHTLCs)
+		assert.Empty(t, channel.LastCrossSignedState.OutgoingHTLCs)
+	}
+
+	// the host's add and the client's fulfill
+	state := host.channel(t, client).LastCrossSignedState
+	assert.Equal(t, uint64(1000000000-100000), state.LocalBalanceMSat)
+	assert.Equal(t, uint64(100000), state.RemoteBalanceMSat)
+	assert.Equal(t, uint32(1), state.LocalUpdates)
+	assert.Equal(t, uint32(1), state.RemoteUpdates)
+}
+
+func TestSimultaneousUpdates(t *testing.T) {
+	client := newTestNode(t, optionFlags{})
+	host := newTestNode(t, optionFlags{})
+	openTestChannel(t, client, host)
+	payTestHTLC(t, client, host)
+
+	// both add before either sees the other's add; each state_update signs a state
+	// the other side doesn't have
+	sendTestUpdate(t, host, client, getTestHTLC(host.channel(t, client), [32]byte{8}))
+	sendTestUpdate(t, client, host, getTestHTLC(client.channel(t, host), [32]byte{9}))
+	exchange(t, host, client)
+
+	assertSameState(t, client, host)
+	for _, channel := range []Channel{host.channel(t, client), client.channel(t, host)} {
+		assert.Empty(t, channel.NextLocalUpdates)
+		assert.Empty(t, channel.NextRemoteUpdates)
+		assert.Len(t, channel.LastCrossSignedState.IncomingHTLCs, 1)
+		assert.Len(t, channel.LastCrossSignedState.OutgoingHTLCs, 1)
+	}
+}
+
+func TestStaleStateUpdate(t *testing.T) {
+	client := newTestNode(t, optionFlags{})
+	host := newTestNode(t, optionFlags{})
+	openTestChannel(t, client, host)
+	state := host.channel(t, client).LastCrossSignedState
+	stale := state.StateUpdate()
+
+	sendTestUpdate(t, host, client, getTestHTLC(host.channel(t, client), [32]byte{8}))
+	sent := host.ln.takeSent()
+	require.Len(t, sent, 2)
+
+	// the add alone doesn't make the client sign
+	client.use()
+	handlePeerMessage(client.p, host.id, sent[0].payload, false)
+	assert.Empty(t, client.ln.takeSent())
+
+	// but a state_update that doesn't cover it does
+	buf := new(bytes.Buffer)
+	_, err := hcwire.WriteMessage(buf, stale, getProtocolVersion(host.id))
+	require.NoError(t, err)
+	handlePeerMessage(client.p, host.id, hex.EncodeToString(buf.Bytes()), false)
+	assert.True(t, client.channel(t, host).SentStateUpdate)
+
+	client.use()
+	handlePeerMessage(client.p, host.id, sent[1].payload, false)
+	exchange(t, client, host)
+	assertSameState(t, client, host)
+	assert.Len(t, client.channel(t, host).LastCrossSignedState.IncomingHTLCs, 1)
+}
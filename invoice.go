@@ -0,0 +1,131 @@
+package main
+
+/*
+INVOICE FORWARDING:
+- CLIENT: hc-forward-invoice hands a bolt11 invoice to the host of the channel and keeps its
+  preimage if given, so payments arriving through the host can be settled
+- HOST: keeps forwarded invoices by payment hash and presents them with hc-invoices;
+  payments reach the client through the short channel id of the hosted channel
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+	"github.com/lightningnetwork/lnd/zpay32"
+	"github.com/raphjaph/go-hosted-channels/hcwire"
+)
+
+type ForwardedInvoice struct {
+	PeerID         string `json:"peer_id"`
+	PaymentHash    string `json:"payment_hash"`
+	Bolt11         string `json:"bolt11"`
+	ShortChannelID string `json:"short_channel_id"`
+	ReceivedAt     int64  `json:"received_at"`
+}
+
+func decodeInvoiceFrom(bolt11 string, network string, nodeID string) (*zpay32.Invoice, error) {
+	invoice, err := zpay32.Decode(bolt11, getChainParams(network))
+	if err != nil {
+		return nil, err
+	}
+
+	if hex.EncodeToString(invoice.Destination.SerializeCompressed()) != nodeID {
+		return nil, fmt.Errorf("invoice is not payable to %v", nodeID)
+	}
+
+	if time.Now().After(invoice.Timestamp.Add(invoice.Expiry())) {
+		return nil, fmt.Errorf("invoice is expired")
+	}
+
+	return invoice, nil
+}
+
+func clientForwardInvoice(p *plugin.Plugin, peer string, bolt11 string, preimage *[32]byte) error {
+	channel, err := store.getChannel(peer)
+	if err != nil {
+		return err
+	}
+	if channel.IsHost || channel.Status != StatusOpen {
+		return fmt.Errorf("no open hosted channel with host %v", peer)
+	}
+
+	info, err := p.Client.Call("getinfo")
+	if err != nil {
+		return err
+	}
+	invoice, err := decodeInvoiceFrom(bolt11, p.Network, info.Get("id").String())
+	if err != nil {
+		return err
+	}
+
+	// lightningd keeps the preimage of unpaid invoices to itself; we need it to settle htlcs from the host
+	if preimage != nil {
+		if sha256.Sum256(preimage[:]) != *invoice.PaymentHash {
+			return fmt.Errorf("preimage doesn't match the payment hash of the invoice")
+		}
+		if err := store.savePreimage(*preimage); err != nil {
+			return err
+		}
+	}
+
+	return sendMessage(p, peer, &hcwire.InvoiceForward{
+		ChainHash: getGenesisHash(p.Network),
+		Invoice:   []byte(bolt11),
+	})
+}
+
+func hostHandleInvoiceForward(p *plugin.Plugin, channel Channel, invoiceForward *hcwire.InvoiceForward) error {
+	if !channel.IsHost || channel.Status != StatusOpen {
+		return fmt.Errorf("unexpected invoice_forward in channel status %v", channel.Status)
+	}
+
+	if invoiceForward.ChainHash != getGenesisHash(p.Network) {
+		return fmt.Errorf("invoice_forward for wrong chain: %x", invoiceForward.ChainHash)
+	}
+
+	invoice, err := decodeInvoiceFrom(string(invoiceForward.Invoice), p.Network, channel.PeerID)
+	if err != nil {
+		return err
+	}
+
+	return store.saveForwardedInvoice(ForwardedInvoice{
+		PeerID:         channel.PeerID,
+		PaymentHash:    hex.EncodeToString(invoice.PaymentHash[:]),
+		Bolt11:         string(invoiceForward.Invoice),
+		ShortChannelID: channel.ShortChannelID().String(),
+		ReceivedAt:     time.Now().Unix(),
+	})
+}
+
+func hcForwardInvoice(p *plugin.Plugin, params plugin.Params) (interface{}, int, error) {
+	peer := params.Get("node_id").String()
+	bolt11 := params.Get("bolt11").String()
+
+	var preimage *[32]byte
+	if params.Get("preimage").Exists() {
+		decoded, err := decodeHash(params.Get("preimage").String())
+		if err != nil {
+			return nil, 1, fmt.Errorf("invalid preimage: %v", err)
+		}
+		preimage = &decoded
+	}
+
+	if err := clientForwardInvoice(p, peer, bolt11, preimage); err != nil {
+		return nil, 1, err
+	}
+
+	return map[string]interface{}{"forwarded": bolt11}, 0, nil
+}
+
+func hcInvoices(p *plugin.Plugin, params plugin.Params) (interface{}, int, error) {
+	invoices, err := store.listForwardedInvoices()
+	if err != nil {
+		return nil, 1, err
+	}
+
+	return invoices, 0, nil
+}
@@ -14,40 +14,112 @@ lightning-createonion – Low-level command to create a custom onion
 import (
 	"bytes"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
 	"github.com/raphjaph/go-hosted-channels/hcwire"
-
-	"github.com/lightningnetwork/lnd/lnwire"
-	"github.com/syndtr/goleveldb/leveldb"
 )
 
 var continueHTLC = map[string]interface{}{"result": "continue"}
-var failHTLC = map[string]interface{}{"result": "fail", "failure_message": "2002"} // TODO: hosted channel specific error codes
-var resolveHTLC = map[string]interface{}{"result": "resolve", "payment_key": "0000000000000000000000000000000000000000000000000000000000000000"}
 
-var db *leveldb.DB
+var store *DB
+
+// guards the channel state machine
+var stateMu sync.Mutex
+
+var pluginOptions = []plugin.Option{
+	{
+		Name:        "hosted-channel-size",
+		Type:        "int",
+		Default:     1000000,
+		Description: "The default size in sats of a hosted channel.",
+	},
+	{
+		Name:        "hosted-channel-secret",
+		Type:        "string",
+		Default:     "",
+		Description: "If set, clients have to provide this secret to invoke a hosted channel.",
+	},
+	{
+		Name:        "hosted-channel-max-size",
+		Type:        "int",
+		Default:     10000000,
+		Description: "The largest size in sats clients can resize their hosted channel to.",
+	},
+	{
+		Name:        "hosted-channel-resize-fee-ppm",
+		Type:        "int",
+		Default:     0,
+		Description: "What clients pay for every million msat of extra capacity when resizing; they have to give the payment hash of a paid invoice.",
+	},
+	{
+		Name:        "hosted-channel-branding-color",
+		Type:        "string",
+		Default:     "",
+		Description: "Color (#rrggbb) wallets of our clients show for our hosted channels.",
+	},
+	{
+		Name:        "hosted-channel-branding-icon",
+		Type:        "string",
+		Default:     "",
+		Description: "Path of a PNG icon wallets of our clients show for our hosted channels.",
+	},
+	{
+		Name:        "hosted-channel-branding-contact",
+		Type:        "string",
+		Default:     "",
+		Description: "Contact info (url, email) wallets of our clients show for our hosted channels.",
+	},
+	{
+		Name:        "hosted-channel-min-capacity",
+		Type:        "int",
+		Default:     100000,
+		Description: "As a client, the minimum size in sats of a hosted channel we accept.",
+	},
+	{
+		Name:        "hosted-channel-min-liability-deadline",
+		Type:        "int",
+		Default:     90,
+		Description: "As a client, the minimum liability deadline in blockdays we accept from a host.",
+	},
+	{
+		Name:        "hosted-channel-max-htlc-minimum",
+		Type:        "int",
+		Default:     10000,
+		Description: "As a client, the largest htlc_minimum_msat we accept from a host.",
+	},
+	{
+		Name:        "hosted-channel-record-dir",
+		Type:        "string",
+		Default:     "",
+		Description: "If set, custom messages exchanged with each peer are appended to <peer_id>.jsonl in this directory so they can be replayed.",
+	},
+}
 
 func main() {
+	// offline tool; doesn't touch the database of a running plugin
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(replay(os.Args[2:]))
+	}
 
-	db, err := leveldb.OpenFile("hc-database", nil)
+	var err error
+	store, err = openDB("hc-database", func(format string, args ...interface{}) {
+		fmt.Fprintf(os.Stderr, "hc-database: "+format+"\n", args...)
+	})
 	if err != nil {
-		fmt.Println("couldn't open database: ", err)
+		fmt.Fprintln(os.Stderr, "couldn't open database: ", err)
+		os.Exit(1)
 	}
-	defer db.Close()
+	defer store.Close()
 
 	p := plugin.Plugin{
 		Name:    "hosted-channels",
 		Version: "v0.0.1",
-		Options: []plugin.Option{
-			{
-				Name:        "hosted-channel-size",
-				Type:        "int",
-				Default:     1000000,
-				Description: "The default size in sats of a hosted channel.",
-			},
-		},
+		Options: pluginOptions,
 
 		// do something asynchronously; lightnind doesn't wait for response
 		Subscriptions: []plugin.Subscription{
@@ -84,15 +156,108 @@ func main() {
 
 			{
 				Name:            "hc-pay",
-				Usage:           "node_id bolt11",
-				Description:     "pay an invoice through a hosted channel",
+				Usage:           "node_id bolt11 [timeout]",
+				Description:     "pay an invoice through the hosted channel with host node_id; waits up to timeout seconds for the preimage",
 				LongDescription: "",
 				Handler:         hcPay,
 			},
+
+			{
+				Name:            "hc-forward-invoice",
+				Usage:           "node_id bolt11 [preimage]",
+				Description:     "hand an invoice of ours to the host of our hosted channel with node_id so it can present it to payers; payments through the host can only be settled with the preimage the invoice was created with",
+				LongDescription: "",
+				Handler:         hcForwardInvoice,
+			},
+
+			{
+				Name:            "hc-invoices",
+				Usage:           "",
+				Description:     "list invoices our hosted channel clients forwarded to us",
+				LongDescription: "",
+				Handler:         hcInvoices,
+			},
+
+			{
+				Name:            "hc-resize",
+				Usage:           "node_id capacity [payment_hash]",
+				Description:     "grow our hosted channel with host node_id to capacity sats; payment_hash is that of the invoice the host made with hc-resize-invoice if it charges for resizing",
+				LongDescription: "",
+				Handler:         hcResize,
+			},
+
+			{
+				Name:            "hc-resize-invoice",
+				Usage:           "node_id capacity",
+				Description:     "make the invoice our client node_id pays to grow its hosted channel to capacity sats; give its payment_hash to hc-resize",
+				LongDescription: "",
+				Handler:         hcResizeInvoice,
+			},
+
+			{
+				Name:            "hc-branding",
+				Usage:           "node_id [refresh]",
+				Description:     "show the branding of host node_id; asks the host unless it's cached or refresh is true",
+				LongDescription: "",
+				Handler:         hcBranding,
+			},
+
+			{
+				Name:            "hc-query-preimages",
+				Usage:           "",
+				Description:     "ask our other hosts for the preimages of htlcs our hosts didn't settle in time (done every 10 minutes anyway)",
+				LongDescription: "",
+				Handler:         hcQueryPreimages,
+			},
+
+			{
+				Name:            "hc-override",
+				Usage:           "node_id balance_msat",
+				Description:     "as host of an errored channel with client node_id, propose a new state without htlcs where our balance is balance_msat",
+				LongDescription: "",
+				Handler:         hcOverride,
+			},
+
+			{
+				Name:            "hc-accept-override",
+				Usage:           "node_id",
+				Description:     "accept the state the host node_id proposed for our errored channel and reopen it",
+				LongDescription: "",
+				Handler:         hcAcceptOverride,
+			},
+
+			{
+				Name:            "hc-decode",
+				Usage:           "payload [protocol_version] [node_id]",
+				Description:     "decode a hosted channel message given as hex like the custommsg hook has it (message type included)",
+				LongDescription: "protocol_version defaults to the one negotiated with node_id, or 1; only error is encoded differently in version 2",
+				Handler:         hcDecode,
+			},
+
+			{
+				Name:            "hc-encode",
+				Usage:           "message [protocol_version] [node_id]",
+				Description:     "encode a hosted channel message given as json like hc-decode returns it; the payload can be sent with sendcustommsg",
+				LongDescription: "protocol_version defaults to the one negotiated with node_id, or 1; only error is encoded differently in version 2",
+				Handler:         hcEncode,
+			},
+
+			{
+				Name:            "hc-list",
+				Usage:           "",
+				Description:     "list all hosted channels (as host and as client)",
+				LongDescription: "",
+				Handler:         hcList,
+			},
 		},
 
 		OnInit: func(p *plugin.Plugin) {
 			p.Log("hosted-channel plugin loaded")
+			if _, err := getHostBranding(p); err != nil {
+				p.Logf("not sending any branding to clients: %v", err)
+			}
+			resumeIncomingHTLCs(p)
+			go queryStuckPreimagesPeriodically(p)
 		},
 	}
 
@@ -100,10 +265,19 @@ func main() {
 }
 
 func handleCustomMsg(p *plugin.Plugin, params plugin.Params) (resp interface{}) {
+	return handlePeerMessage(p, params.Get("peer_id").String(), params.Get("payload").String(), true)
+}
+
+// resolveHTLCs starts resolving the htlcs the message cross signs; replays leave that to the recording
+func handlePeerMessage(p *plugin.Plugin, peer string, payload string, resolveHTLCs bool) interface{} {
+	// messages change channel state so handle them one at a time; that includes
+	// decoding since the message before may have changed the protocol version
+	stateMu.Lock()
+	defer stateMu.Unlock()
 
-	peer := params.Get("peer_id").String()
+	// recorded in the order the state machine sees them
+	recordMessage(p, peer, directionIn, payload)
 
-	payload := params.Get("payload").String()
 	b, err := hex.DecodeString(payload)
 	if err != nil {
 		p.Log("error decoding []byte from hex string: ", err)
@@ -111,7 +285,7 @@ func handleCustomMsg(p *plugin.Plugin, params plugin.Params) (resp interface{})
 	}
 
 	r := bytes.NewReader(b)
-	msg, err := hcwire.ReadMessage(r, 1)
+	msg, err := hcwire.ReadMessage(r, getProtocolVersion(peer))
 	if err != nil {
 		p.Log("error reading custom message: ", err)
 		return continueHTLC
@@ -127,231 +301,288 @@ func handleCustomMsg(p *plugin.Plugin, params plugin.Params) (resp interface{})
 			p.Log("unable to assert InvokeHostedChannel type")
 			return continueHTLC
 		}
-		p.Logf("got %v from %v", invokeHC.MsgType(), peer)
-
-		// check if secret correct
 
-		// create a channel in database wit initial parameters
-
-		// reply with init message
-		p.Log("sending init_hosted_channel message")
-		initHC := &hcwire.InitHostedChannel{
-			MaxHTLCValueInFlightMSat:           100000000,
-			HTLCMinimumMSat:                    1000,
-			MaxAcceptedHTLCs:                   30,
-			ChannelCapacityMSat:                1000000000,
-			LiabilityDeadlineBlockdays:         360,
-			MinimalOnChainRefundAmountSatoshis: 100000,
-			InitialClientBalanceMSat:           0,
-			Features:                           []byte{},
+		if err := hostHandleInvokeHostedChannel(p, peer, invokeHC); err != nil {
+			p.Logf("error handling %v from %v: %v", msg.MsgType(), peer, err)
 		}
 
-		buf := new(bytes.Buffer)
-		if _, err := hcwire.WriteMessage(buf, initHC, 1); err != nil {
-			return continueHTLC
-		}
-		payload := hex.EncodeToString(buf.Bytes())
-
-		p.Client.Call("sendcustommsg", peer, payload)
-
 	case hcwire.MsgInitHostedChannel:
-		_, ok := msg.(*hcwire.InitHostedChannel)
+		initHC, ok := msg.(*hcwire.InitHostedChannel)
 		if !ok {
 			p.Log("unable to assert InitHostedChannel type")
 			return continueHTLC
 		}
 
+		if err := clientHandleInitHostedChannel(p, peer, initHC); err != nil {
+			p.Logf("error handling %v from %v: %v", msg.MsgType(), peer, err)
+		}
+
 	case hcwire.MsgLastCrossedSignedState:
-		_, ok := msg.(*hcwire.LastCrossSignedState)
-		if !ok {
-			p.Log("unable to assert LastCrossSignedState type")
+		// signatures are over exactly the fields so read it again without leeway:
+		// no extension, nothing after it and a state that makes sense
+		lastCSS := hcwire.NewLastCrossedSignedState()
+		if err := lastCSS.DecodeStrict(bytes.NewReader(b[2:]), getProtocolVersion(peer)); err != nil {
+			p.Logf("rejecting %v from %v: %v", msg.MsgType(), peer, err)
+			return continueHTLC
+		}
+
+		channel, err := store.getChannel(peer)
+		if err != nil {
+			p.Logf("error handling %v from %v: %v", msg.MsgType(), peer, err)
 			return continueHTLC
 		}
 
+		if channel.IsHost {
+			err = hostHandleLastCrossSignedState(p, channel, lastCSS)
+		} else {
+			err = clientHandleLastCrossSignedState(p, channel, lastCSS)
+		}
+		if err != nil {
+			p.Logf("error handling %v from %v: %v", msg.MsgType(), peer, err)
+		}
+
 	case hcwire.MsgStateUpdate:
-		_, ok := msg.(*hcwire.StateUpdate)
+		stateUpdate, ok := msg.(*hcwire.StateUpdate)
 		if !ok {
 			p.Log("unable to assert StateUpdate type")
 			return continueHTLC
 		}
 
+		channel, err := store.getChannel(peer)
+		if err != nil {
+			p.Logf("error handling %v from %v: %v", msg.MsgType(), peer, err)
+			return continueHTLC
+		}
+
+		if channel.Status == StatusOpen {
+			err = handleOpenStateUpdate(p, channel, stateUpdate, resolveHTLCs)
+		} else if channel.IsHost && channel.Status == StatusErrored && channel.StateOverride != nil {
+			err = hostHandleOverrideStateUpdate(p, channel, stateUpdate)
+		} else if channel.IsHost {
+			err = hostHandleStateUpdate(p, channel, stateUpdate)
+		} else {
+			err = clientHandleStateUpdate(p, channel, stateUpdate)
+		}
+		if err != nil {
+			p.Logf("error handling %v from %v: %v", msg.MsgType(), peer, err)
+		}
+
 	case hcwire.MsgStateOverride:
-		_, ok := msg.(*hcwire.StateOverride)
+		stateOverride, ok := msg.(*hcwire.StateOverride)
 		if !ok {
 			p.Log("unable to assert StateOverrid type")
 			return continueHTLC
 		}
 
-	case hcwire.MsgUpdateAddHTLC:
-		addHTLC, ok := msg.(*hcwire.UpdateAddHTLC)
+		channel, err := store.getChannel(peer)
+		if err == nil {
+			err = clientHandleStateOverride(p, channel, stateOverride)
+		}
+		if err != nil {
+			p.Logf("error handling %v from %v: %v", msg.MsgType(), peer, err)
+		}
+
+	case hcwire.MsgInvoiceForward:
+		invoiceForward, ok := msg.(*hcwire.InvoiceForward)
 		if !ok {
-			p.Log("unable to assert UpdateAddHTLC type")
+			p.Log("unable to assert InvoiceForward type")
 			return continueHTLC
 		}
 
-		// TEST: create own onion blob
-		// hardcoded hop l2 -> l1 (pubkey)
-		//hop := map[string]interface{}{"pubkey": "039c49ccbf7341e1829152d0067b1b47b06d596a21d9a7d640616ee2f990dc8f82", "payload": "00000067000003000100000000000003e800000075000000000000000000000000000000000000000000000000"}
-		// HARD CODED: id from l1
-		firstHop := map[string]interface{}{"id": "039c49ccbf7341e1829152d0067b1b47b06d596a21d9a7d640616ee2f990dc8f82", "amount_msat": "1000000", "delay": "21"}
-		hops := []map[string]interface{}{{"pubkey": "039c49ccbf7341e1829152d0067b1b47b06d596a21d9a7d640616ee2f990dc8f82", "payload": "00000067000003000100000000000003e800000075000000000000000000000000000000000000000000000000"}}
+		channel, err := store.getChannel(peer)
+		if err == nil {
+			err = hostHandleInvoiceForward(p, channel, invoiceForward)
+		}
+		if err != nil {
+			p.Logf("error handling %v from %v: %v", msg.MsgType(), peer, err)
+		}
+
+	case hcwire.MsgAskBrandingInfo:
+		ask, ok := msg.(*hcwire.AskBrandingInfo)
+		if !ok {
+			p.Log("unable to assert AskBrandingInfo type")
+			return continueHTLC
+		}
 
-		hexPaymentHash := hex.EncodeToString(addHTLC.PaymentHash[:])
-		//hexOnionBlob := hex.EncodeToString(addHTLC.OnionBlob[:])
+		if err := hostHandleAskBrandingInfo(p, peer, ask); err != nil {
+			p.Logf("error handling %v from %v: %v", msg.MsgType(), peer, err)
+		}
+
+	case hcwire.MsgHostedChannelBranding:
+		branding, ok := msg.(*hcwire.HostedChannelBranding)
+		if !ok {
+			p.Log("unable to assert HostedChannelBranding type")
+			return continueHTLC
+		}
+
+		if err := clientHandleBranding(p, peer, branding); err != nil {
+			p.Logf("error handling %v from %v: %v", msg.MsgType(), peer, err)
+		}
+
+	case hcwire.MsgQueryPreimages:
+		query, ok := msg.(*hcwire.QueryPreimages)
+		if !ok {
+			p.Log("unable to assert QueryPreimages type")
+			return continueHTLC
+		}
 
-		onionBlob, err := p.Client.Call("createonion", hops, hexPaymentHash)
+		channel, err := store.getChannel(peer)
+		if err == nil {
+			err = hostHandleQueryPreimages(p, channel, query)
+		}
 		if err != nil {
-			p.Log("couldn't create onion: ", err)
+			p.Logf("error handling %v from %v: %v", msg.MsgType(), peer, err)
 		}
 
-		p.Log("OnionBlob: \n", onionBlob.Get("onion").String(), "\n")
-		p.Log("ChanID: \n", addHTLC.ChanID, "\n")
-		p.Log("PaymentHash: \n", hexPaymentHash, "\n")
+	case hcwire.MsgReplyPreimages:
+		reply, ok := msg.(*hcwire.ReplyPreimages)
+		if !ok {
+			p.Log("unable to assert ReplyPreimages type")
+			return continueHTLC
+		}
 
-		// forward the onion to the next hop
-		// NOTE: sendonion adds htlc to lightningd database so it can be retrieved with listsendpays
-		result, err := p.Client.Call("sendonion", addHTLC.OnionBlob, firstHop, hexPaymentHash)
+		channel, err := store.getChannel(peer)
+		if err == nil {
+			err = clientHandleReplyPreimages(p, channel, reply)
+		}
 		if err != nil {
-			p.Log("error sending onion: ", err)
+			p.Logf("error handling %v from %v: %v", msg.MsgType(), peer, err)
 		}
-		p.Log("htlc status: ", result.Get("status").Str)
 
-	case hcwire.MsgUpdateFulfillHTLC:
-		//fulfillHTLC, ok := msg.(*hcwire.UpdateFulfillHTLC)
-		_, ok := msg.(*hcwire.UpdateFulfillHTLC)
+	case hcwire.MsgError:
+		remoteErr, ok := msg.(*hcwire.Error)
 		if !ok {
-			p.Log("unable to assert UpdateFulfillHTLC type")
+			p.Log("unable to assert Error type")
 			return continueHTLC
 		}
 
+		if err := handleRemoteError(p, peer, remoteErr); err != nil {
+			p.Logf("error handling %v from %v: %v", msg.MsgType(), peer, err)
+		}
+
+	case hcwire.MsgUpdateAddHTLC, hcwire.MsgUpdateFulfillHTLC, hcwire.MsgUpdateFailHTLC, hcwire.MsgUpdateFailMalformedHTLC, hcwire.MsgResizeChannel:
+		channel, err := store.getChannel(peer)
+		if err == nil {
+			err = handleRemoteUpdate(p, channel, msg)
+		}
+		if err != nil {
+			p.Logf("error handling %v from %v: %v", msg.MsgType(), peer, err)
+		}
+
 	default:
-		p.Log("handeling msg type: ", msg.MsgType(), " from peer: ", peer, " with content: ", payload[:])
+		content, _ := json.Marshal(msg)
+		p.Logf("unhandled %v from %v: %s", msg.MsgType(), peer, content)
 	}
 	return continueHTLC
 }
 
 func hcPay(p *plugin.Plugin, params plugin.Params) (interface{}, int, error) {
-	/*
-		- [] decode invoice
-		- [] create route with getroute -> hard code for now: l1 --invoice--> l3 --hcpay--> l2 --sendonion--> l3
-			- l1 id: 039c49ccbf7341e1829152d0067b1b47b06d596a21d9a7d640616ee2f990dc8f82
-			- l2 id: 02ba62ac6b9819d140695c4676eaac7330574af9f08abbe3928d765a396ed915a9
-			- l3 id: 03361b104205147575ccaf4c7f111dfd533b8db7cd590c1087051edbc450248467
-		- [] createonion hops payment_hash(assoc_data)
-		- [] create update_add_htlc for hc peer (with onion blob for next hop)
-		- [] send to hc peer with sendcustommsg
-		- [] wait for htlc_fulfill
-
-		PEER VIEW:
-		- [] receive htlc
-		- [] make htlc with next hop
-		- [] wait for htlc_fulfill
-		- []
-	*/
-
-	invoice, err := p.Client.Call("decode", params.Get("bolt11").String())
+	timeout := defaultPayTimeout
+	if t := params.Get("timeout").Int(); t > 0 {
+		timeout = time.Duration(t) * time.Second
+	}
+
+	result, err := clientPay(p, params.Get("node_id").String(), params.Get("bolt11").String(), timeout)
+	if payErr, ok := err.(*payError); ok {
+		return nil, payErr.code, payErr
+	}
 	if err != nil {
 		return nil, 1, err
 	}
-	//payee := invoice.Get("payee").String()
-	paymentHash := invoice.Get("payment_hash").String()
-	//amount := invoice.Get("amount_msat")
-	//result, err := p.Client.Call("getroute", payee, amount, 10)
-	//route := result.Get("route")
-	// parse route so that payload of n is parameters of n+1
 
-	// create (last) onion payload for l2 -> l1; see here
-	//paymentSecret := invoice.Get("payment_secret").String()
+	return result, 0, nil
+}
 
-	// hardcoded hop l2 -> l1 (pubkey)
-	firstHop := map[string]interface{}{"pubkey": "039c49ccbf7341e1829152d0067b1b47b06d596a21d9a7d640616ee2f990dc8f82", "payload": "00000067000003000100000000000003e800000075000000000000000000000000000000000000000000000000"}
-	hops := []map[string]interface{}{firstHop}
+func hcInvoke(p *plugin.Plugin, params plugin.Params) (interface{}, int, error) {
+	nodeId := params.Get("node_id").String()
 
-	onionBlob, err := p.Client.Call("createonion", hops, paymentHash)
+	refundScriptPubKey, err := addressToScriptPubKey(params.Get("refund_address").String(), p.Network)
+	if err != nil {
+		return nil, 1, fmt.Errorf("invalid refund_address: %v", err)
+	}
+
+	secret := []byte(params.Get("secret").String())
+
+	channel, err := clientInvokeHostedChannel(p, nodeId, refundScriptPubKey, secret)
 	if err != nil {
 		return nil, 1, err
 	}
-	tmp, _ := hex.DecodeString(onionBlob.Get("onion").String())
-	var onionBlobBytes [1366]byte
-	copy(onionBlobBytes[:], tmp)
-
-	// channel id between l1-----l2
-	//channelid, _ := hex.DecodeString("4f642a22b2205f87c6e4a939b73c7c45368c944979365b89ccc8a4470a6b6fc0")
-	// l1----l3
-	//channelid, _ := hex.DecodeString("f76489c99659f713890649f721dde11f569ea1ffeff80febe53656e54c67ea80"
-	channelid, _ := hex.DecodeString("6e0000010001")
-
-	var cid [32]byte
-	copy(cid[:], channelid)
-
-	tmp, _ = hex.DecodeString(paymentHash)
-	var paymentHashBytes [32]byte
-	copy(paymentHashBytes[:], tmp)
-
-	addHTLC := hcwire.UpdateAddHTLC{
-		lnwire.UpdateAddHTLC{
-			ChanID:      cid,
-			ID:          1,
-			Amount:      lnwire.MilliSatoshi(1000011),
-			PaymentHash: paymentHashBytes,
-			Expiry:      144,
-			OnionBlob:   onionBlobBytes,
-		},
+
+	return channel, 0, nil
+}
+
+func hcResize(p *plugin.Plugin, params plugin.Params) (interface{}, int, error) {
+	var paymentHash *[32]byte
+	if s := params.Get("payment_hash").String(); s != "" {
+		hash, err := decodeHash(s)
+		if err != nil {
+			return nil, 1, fmt.Errorf("invalid payment_hash: %v", err)
+		}
+		paymentHash = &hash
 	}
 
-	buf := new(bytes.Buffer)
-	if _, err := hcwire.WriteMessage(buf, &addHTLC, 1); err != nil {
+	channel, err := clientResizeChannel(p, params.Get("node_id").String(), params.Get("capacity").Uint(), paymentHash)
+	if err != nil {
 		return nil, 1, err
 	}
-	payload := hex.EncodeToString(buf.Bytes())
-
-	p.Log("hc-pay sending message: \n", addHTLC)
 
-	p.Client.Call("sendcustommsg", params.Get("node_id").String(), payload)
+	return channel, 0, nil
+}
 
-	// wait for payment preimage from hc peer
+func hcResizeInvoice(p *plugin.Plugin, params plugin.Params) (interface{}, int, error) {
+	bolt11, err := hostResizeInvoice(p, params.Get("node_id").String(), params.Get("capacity").Uint())
+	if err != nil {
+		return nil, 1, err
+	}
 
-	return nil, 0, nil
+	return map[string]interface{}{"bolt11": bolt11}, 0, nil
 }
 
-func hcInvoke(p *plugin.Plugin, params plugin.Params) (interface{}, int, error) {
+func hcBranding(p *plugin.Plugin, params plugin.Params) (interface{}, int, error) {
+	branding, err := clientGetBranding(p, params.Get("node_id").String(), params.Get("refresh").Bool())
+	if err != nil {
+		return nil, 1, err
+	}
 
-	nodeId := params.Get("node_id").String()
-	//refundAddr := params.Get("refund_address").String()
-	//secret := params.Get("secret").String()
+	return branding, 0, nil
+}
 
-	var genesisHash [32]byte
-	hash, _ := hex.DecodeString("000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f")
-	copy(genesisHash[:], hash)
+func hcQueryPreimages(p *plugin.Plugin, params plugin.Params) (interface{}, int, error) {
+	if err := clientQueryStuckPreimages(p); err != nil {
+		return nil, 1, err
+	}
 
-	invokeHC := &hcwire.InvokeHostedChannel{
-		ChainHash:          genesisHash,
-		RefundScriptPubKey: []byte{8},
-		Secret:             []byte{10},
+	return map[string]interface{}{"status": "queried"}, 0, nil
+}
+
+func hcOverride(p *plugin.Plugin, params plugin.Params) (interface{}, int, error) {
+	balance := params.Get("balance_msat")
+	if !balance.Exists() {
+		return nil, 1, fmt.Errorf("missing balance_msat")
 	}
 
-	buf := new(bytes.Buffer)
-	if _, err := hcwire.WriteMessage(buf, invokeHC, 1); err != nil {
+	override, err := hostOverrideState(p, params.Get("node_id").String(), balance.Uint())
+	if err != nil {
 		return nil, 1, err
 	}
-	payload := hex.EncodeToString(buf.Bytes())
-
-	p.Client.Call("sendcustommsg", nodeId, payload)
 
-	return nil, 0, nil
+	return override, 0, nil
 }
 
-func handleHTLCAccepted(p *plugin.Plugin, params plugin.Params) (resp interface{}) {
-	/*
-		HOST VIEW:
-		- [] parse HTLC message
-		- [] return return HTLC to lightningd if short channel ID (scid) not hosted from hosted channels
-		- [] forward HTLC to hosted channel peer
-		- [] wait for htlc_fulfill from CLIENT
-		- [] resolve HTLC with non-hosted-channel peer with payment key/preimage from htlc_fufill
-	*/
+func hcAcceptOverride(p *plugin.Plugin, params plugin.Params) (interface{}, int, error) {
+	channel, err := clientAcceptOverride(p, params.Get("node_id").String())
+	if err != nil {
+		return nil, 1, err
+	}
 
-	p.Log("HTLC:\n", params.Get("@pretty").String())
+	return channel, 0, nil
+}
 
-	return continueHTLC
+func hcList(p *plugin.Plugin, params plugin.Params) (interface{}, int, error) {
+	channels, err := store.listChannels()
+	if err != nil {
+		return nil, 1, err
+	}
+
+	return channels, 0, nil
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/raphjaph/go-hosted-channels/hcwire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLastCrossSignedStateFromPeerIsStrict(t *testing.T) {
+	client := newTestNode(t, optionFlags{})
+	host := newTestNode(t, optionFlags{})
+	openTestChannel(t, client, host)
+	payTestHTLC(t, client, host)
+
+	encode := func(state hcwire.LastCrossSignedState) string {
+		buf := new(bytes.Buffer)
+		_, err := hcwire.WriteMessage(buf, &state, hcwire.ProtocolVersion1)
+		require.NoError(t, err)
+		return hex.EncodeToString(buf.Bytes())
+	}
+
+	// an odd extension is fine for other messages but not for what gets signed
+	withExtension := host.channel(t, client).LastCrossSignedState
+	withExtension.ExtraData = []byte{0x01, 0x00}
+	client.use()
+	handlePeerMessage(client.p, host.id, encode(withExtension), false)
+	assert.Empty(t, client.ln.takeSent())
+	assert.Equal(t, StatusOpen, client.channel(t, host).Status)
+
+	// the state as the host sends it, with its version, is answered with ours
+	hostState := host.channel(t, client).LastCrossSignedState
+	require.NoError(t, hostState.SetProtocolVersion(hcwire.LatestProtocolVersion))
+	client.use()
+	handlePeerMessage(client.p, host.id, encode(hostState), false)
+	sent := client.ln.takeSent()
+	require.Len(t, sent, 1)
+	msg, err := decodeMessage(sent[0].payload, hcwire.ProtocolVersion1)
+	require.NoError(t, err)
+	assert.Equal(t, hcwire.MessageType(hcwire.MsgLastCrossedSignedState), msg.MsgType())
+}
@@ -0,0 +1,234 @@
+package main
+
+/*
+STATE OVERRIDE: the way out of an errored channel
+- HOST VIEW: hc-override proposes a new balance; the state has no htlcs and
+  both update counters one above the last cross signed state. we sign it and send
+  state_override
+- CLIENT VIEW: a valid state_override is kept on the channel until the user
+  accepts it with hc-accept-override; then we sign it and send state_update
+- host gets the state_update: both signatures exist and the channel is open again
+*/
+
+import (
+	"fmt"
+
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+	"github.com/raphjaph/go-hosted-channels/hcwire"
+)
+
+// the state the override proposes from our point of view; only the host signed it
+func overriddenState(channel Channel, override *hcwire.StateOverride) hcwire.LastCrossSignedState {
+	capacity := channel.LastCrossSignedState.InitHostedChannel.ChannelCapacityMSat
+
+	// the override is the host's view
+	state := channel.LastCrossSignedState
+	state.IsHost = true
+	state.Blockday = override.Blockday
+	state.LocalBalanceMSat = override.LocalBalanceMSat
+	state.RemoteBalanceMSat = capacity - override.LocalBalanceMSat
+	state.LocalUpdates = override.LocalUpdates
+	state.RemoteUpdates = override.RemoteUpdates
+	state.IncomingHTLCs = nil
+	state.OutgoingHTLCs = nil
+	state.LocalSigOfRemote = override.LocalSigOfRemote
+	state.RemoteSigOfLocal = [64]byte{}
+
+	if channel.IsHost {
+		return state
+	}
+
+	return *state.Reverse()
+}
+
+func hostOverrideState(p *plugin.Plugin, client string, balanceMSat uint64) (*hcwire.StateOverride, error) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	channel, err := store.getChannel(client)
+	if err != nil {
+		return nil, err
+	}
+	if !channel.IsHost {
+		return nil, fmt.Errorf("only the host can override the state")
+	}
+	if channel.Status != StatusErrored {
+		return nil, fmt.Errorf("channel is %v; only errored channels can be overridden", channel.Status)
+	}
+
+	last := channel.LastCrossSignedState
+	if capacity := last.InitHostedChannel.ChannelCapacityMSat; balanceMSat > capacity {
+		return nil, fmt.Errorf("balance of %v msat exceeds capacity of %v msat", balanceMSat, capacity)
+	}
+
+	blockday, err := getBlockday(p)
+	if err != nil {
+		return nil, err
+	}
+
+	override := &hcwire.StateOverride{
+		Blockday:         blockday,
+		LocalBalanceMSat: balanceMSat,
+		LocalUpdates:     last.LocalUpdates + 1,
+		RemoteUpdates:    last.RemoteUpdates + 1,
+	}
+	state := overriddenState(channel, override)
+
+	nodeKey, err := getNodeKey(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := state.SignRemote(nodeKey); err != nil {
+		return nil, err
+	}
+	override.LocalSigOfRemote = state.LocalSigOfRemote
+
+	channel.StateOverride = override
+	if err := store.saveChannel(channel); err != nil {
+		return nil, err
+	}
+
+	return override, sendMessage(p, client, override)
+}
+
+// the client signed the state we proposed
+func hostHandleOverrideStateUpdate(p *plugin.Plugin, channel Channel, stateUpdate *hcwire.StateUpdate) error {
+	override := channel.StateOverride
+	if stateUpdate.Blockday != override.Blockday ||
+		stateUpdate.LocalUpdates != override.RemoteUpdates ||
+		stateUpdate.RemoteUpdates != override.LocalUpdates {
+		return fmt.Errorf("state_update doesn't match our state_override")
+	}
+
+	state := overriddenState(channel, override)
+	state.RemoteSigOfLocal = stateUpdate.LocalSigOfRemote
+
+	clientKey, err := parseNodeID(channel.PeerID)
+	if err != nil {
+		return err
+	}
+	ok, err := state.VerifyRemoteSig(clientKey)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("wrong signature of the overridden state")
+	}
+
+	return applyOverride(channel, state)
+}
+
+// a state_override from our host; it waits for hc-accept-override
+func clientHandleStateOverride(p *plugin.Plugin, channel Channel, override *hcwire.StateOverride) error {
+	if channel.IsHost {
+		return fmt.Errorf("state_override from a client")
+	}
+
+	if err := validateStateOverride(p, channel, override); err != nil {
+		return err
+	}
+
+	channel.StateOverride = override
+
+	return store.saveChannel(channel)
+}
+
+func validateStateOverride(p *plugin.Plugin, channel Channel, override *hcwire.StateOverride) error {
+	if channel.Status != StatusErrored {
+		return fmt.Errorf("state_override for a channel that is %v", channel.Status)
+	}
+
+	blockday, err := getBlockday(p)
+	if err != nil {
+		return err
+	}
+	if !isBlockdayAcceptable(blockday, override.Blockday) {
+		return fmt.Errorf("state_override with wrong blockday %v, ours is %v", override.Blockday, blockday)
+	}
+
+	// the overridden state has to supersede every state signed before
+	last := channel.LastCrossSignedState
+	if override.LocalUpdates <= last.RemoteUpdates || override.RemoteUpdates <= last.LocalUpdates {
+		return fmt.Errorf("state_override with %v/%v updates doesn't supersede ours with %v/%v",
+			override.RemoteUpdates, override.LocalUpdates, last.LocalUpdates, last.RemoteUpdates)
+	}
+
+	if capacity := last.InitHostedChannel.ChannelCapacityMSat; override.LocalBalanceMSat > capacity {
+		return fmt.Errorf("state_override balance of %v msat exceeds capacity of %v msat", override.LocalBalanceMSat, capacity)
+	}
+
+	hostKey, err := parseNodeID(channel.PeerID)
+	if err != nil {
+		return err
+	}
+	state := overriddenState(channel, override)
+	ok, err := state.VerifyRemoteSig(hostKey)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("state_override with wrong signature")
+	}
+
+	return nil
+}
+
+// signs the state the host proposed and reopens the channel
+func clientAcceptOverride(p *plugin.Plugin, host string) (Channel, error) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	channel, err := store.getChannel(host)
+	if err != nil {
+		return Channel{}, err
+	}
+	if channel.IsHost || channel.StateOverride == nil {
+		return Channel{}, fmt.Errorf("no state_override from host %v", host)
+	}
+
+	// the blockday may be too old by now; the host has to send a new one then
+	if err := validateStateOverride(p, channel, channel.StateOverride); err != nil {
+		return Channel{}, err
+	}
+
+	state := overriddenState(channel, channel.StateOverride)
+	nodeKey, err := getNodeKey(p)
+	if err != nil {
+		return Channel{}, err
+	}
+	if err := state.SignRemote(nodeKey); err != nil {
+		return Channel{}, err
+	}
+
+	if err := applyOverride(channel, state); err != nil {
+		return Channel{}, err
+	}
+	if err := sendMessage(p, host, state.StateUpdate()); err != nil {
+		return Channel{}, err
+	}
+
+	return store.getChannel(host)
+}
+
+// replaces the state with the fully signed override; htlcs that were in flight are gone
+func applyOverride(channel Channel, state hcwire.LastCrossSignedState) error {
+	dropped := pendingOutgoingHTLCs(channel)
+
+	channel.LastCrossSignedState = state
+	channel.Status = StatusOpen
+	channel.ErrorReason = nil
+	channel.StateOverride = nil
+	channel.NextLocalUpdates = nil
+	channel.NextRemoteUpdates = nil
+	channel.SentStateUpdate = false
+	if err := store.saveChannel(channel); err != nil {
+		return err
+	}
+
+	// whoever waits for those htlcs gets a failure; settled ones were notified already
+	for _, htlc := range dropped {
+		htlcWaiters.notify(htlcKey{htlc.ChanID, htlc.ID}, htlcResult{})
+	}
+
+	return nil
+}
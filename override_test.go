@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/raphjaph/go-hosted-channels/hcwire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// host errors the channel and the client learns about it
+func errorTestChannel(t *testing.T, client, host *testNode) {
+	host.use()
+	stateMu.Lock()
+	channel, err := store.getChannel(client.id)
+	require.NoError(t, err)
+	errorChannel(host.p, channel, fmt.Errorf("something went wrong"))
+	stateMu.Unlock()
+
+	exchange(t, host, client)
+	require.Equal(t, StatusErrored, host.channel(t, client).Status)
+	require.Equal(t, StatusErrored, client.channel(t, host).Status)
+}
+
+// a state_override for host's channel with client signed by key
+func getTestOverride(t *testing.T, client, host *testNode, key *btcec.PrivateKey, override hcwire.StateOverride) *hcwire.StateOverride {
+	state := overriddenState(host.channel(t, client), &override)
+	require.NoError(t, state.SignRemote(key))
+	override.LocalSigOfRemote = state.LocalSigOfRemote
+	return &override
+}
+
+// delivers a state_override to the client as if the host sent it
+func sendTestOverride(t *testing.T, client, host *testNode, override *hcwire.StateOverride) {
+	client.use()
+	buf := new(bytes.Buffer)
+	_, err := hcwire.WriteMessage(buf, override, getProtocolVersion(host.id))
+	require.NoError(t, err)
+	handlePeerMessage(client.p, host.id, hex.EncodeToString(buf.Bytes()), false)
+}
+
+func TestStateOverride(t *testing.T) {
+	client := newTestNode(t, optionFlags{})
+	host := newTestNode(t, optionFlags{})
+	openTestChannel(t, client, host)
+	payTestHTLC(t, client, host)
+	errorTestChannel(t, client, host)
+
+	hostKey, err := getNodeKey(host.p)
+	require.NoError(t, err)
+	otherKey, err := btcec.NewPrivateKey(btcec.S256())
+	require.NoError(t, err)
+
+	last := host.channel(t, client).LastCrossSignedState
+	blockday := uint32(testBlockheight / 144)
+	balance := last.LocalBalanceMSat - 50000
+	superseding := hcwire.StateOverride{
+		Blockday:         blockday,
+		LocalBalanceMSat: balance,
+		LocalUpdates:     last.LocalUpdates + 1,
+		RemoteUpdates:    last.RemoteUpdates + 1,
+	}
+
+	// the client keeps none of these
+	stale := superseding
+	stale.Blockday = blockday - 2
+	sameLocalUpdates := superseding
+	sameLocalUpdates.LocalUpdates = last.LocalUpdates
+	sameRemoteUpdates := superseding
+	sameRemoteUpdates.RemoteUpdates = last.RemoteUpdates
+
+	for name, override := range map[string]*hcwire.StateOverride{
+		"stale blockday":           getTestOverride(t, client, host, hostKey, stale),
+		"same host updates":        getTestOverride(t, client, host, hostKey, sameLocalUpdates),
+		"same client updates":      getTestOverride(t, client, host, hostKey, sameRemoteUpdates),
+		"not signed by the host":   getTestOverride(t, client, host, otherKey, superseding),
+		"signature of another one": {Blockday: blockday, LocalBalanceMSat: balance + 1, LocalUpdates: superseding.LocalUpdates, RemoteUpdates: superseding.RemoteUpdates, LocalSigOfRemote: getTestOverride(t, client, host, hostKey, superseding).LocalSigOfRemote},
+	} {
+		sendTestOverride(t, client, host, override)
+		assert.Nil(t, client.channel(t, host).StateOverride, name)
+	}
+
+	// the host proposes it the way hc-override does
+	host.use()
+	proposed, err := hostOverrideState(host.p, client.id, balance)
+	require.NoError(t, err)
+	assert.Equal(t, getTestOverride(t, client, host, hostKey, superseding), proposed)
+	exchange(t, host, client)
+	assert.Equal(t, proposed, client.channel(t, host).StateOverride)
+
+	// too late to accept it: the blockday is stale by now
+	client.ln.setBlockheight(testBlockheight + 3*144)
+	client.use()
+	_, err = clientAcceptOverride(client.p, host.id)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "blockday")
+	assert.Equal(t, StatusErrored, client.channel(t, host).Status)
+
+	client.ln.setBlockheight(testBlockheight)
+	client.use()
+	_, err = clientAcceptOverride(client.p, host.id)
+	require.NoError(t, err)
+	exchange(t, client, host)
+
+	// both reopened the same state
+	hostChannel := host.channel(t, client)
+	clientChannel := client.channel(t, host)
+	for _, channel := range []Channel{hostChannel, clientChannel} {
+		assert.Equal(t, StatusOpen, channel.Status)
+		assert.Nil(t, channel.ErrorReason)
+		assert.Nil(t, channel.StateOverride)
+	}
+	assertSameState(t, client, host)
+	assert.Equal(t, balance, hostChannel.LastCrossSignedState.LocalBalanceMSat)
+	assert.Equal(t, superseding.LocalUpdates, hostChannel.LastCrossSignedState.LocalUpdates)
+	assert.Equal(t, superseding.RemoteUpdates, hostChannel.LastCrossSignedState.RemoteUpdates)
+
+	// and it's usable again
+	payTestHTLC(t, client, host)
+	assertSameState(t, client, host)
+}
+
+// the host takes the client's signature only for the state it proposed
+func TestStateOverrideWrongClientSignature(t *testing.T) {
+	client := newTestNode(t, optionFlags{})
+	host := newTestNode(t, optionFlags{})
+	openTestChannel(t, client, host)
+	errorTestChannel(t, client, host)
+
+	host.use()
+	override, err := hostOverrideState(host.p, client.id, 1000000000)
+	require.NoError(t, err)
+	host.ln.takeSent()
+
+	otherKey, err := btcec.NewPrivateKey(btcec.S256())
+	require.NoError(t, err)
+	state := overriddenState(client.channel(t, host), override)
+	require.NoError(t, state.SignRemote(otherKey))
+
+	host.use()
+	buf := new(bytes.Buffer)
+	_, err = hcwire.WriteMessage(buf, state.StateUpdate(), getProtocolVersion(client.id))
+	require.NoError(t, err)
+	handlePeerMessage(host.p, client.id, hex.EncodeToString(buf.Bytes()), false)
+
+	channel := host.channel(t, client)
+	assert.Equal(t, StatusErrored, channel.Status)
+	assert.Equal(t, override, channel.StateOverride)
+}
@@ -0,0 +1,329 @@
+package main
+
+/*
+CLIENT VIEW of paying through a hosted channel (hc-pay):
+- decode invoice
+- getroute from the host to the payee
+- createonion with the host as first hop and a session key of ours
+- add the htlc to the hosted channel and sign the new state
+- wait for update_fulfill_htlc/update_fail_htlc from the host; failures are
+  decrypted with the session key to tell which hop failed and why
+*/
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+	sphinx "github.com/lightningnetwork/lightning-onion"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/record"
+	"github.com/lightningnetwork/lnd/tlv"
+	"github.com/raphjaph/go-hosted-channels/hcwire"
+)
+
+const defaultPayTimeout = 60 * time.Second
+
+// error codes of hc-pay; same meaning as the ones of lightningd's pay
+const (
+	payErrTryOtherRoute  = 204
+	payErrRouteNotFound  = 205
+	payErrInvoiceInvalid = 206
+	payErrTimeout        = 210
+)
+
+type routeHop struct {
+	NodeID         string
+	ShortChannelID lnwire.ShortChannelID
+	AmountMSat     uint64
+	Delay          uint32 // absolute cltv expiry of the htlc reaching this hop
+}
+
+type PaymentResult struct {
+	PaymentHash     string `json:"payment_hash"`
+	PaymentPreimage string `json:"payment_preimage"`
+	AmountMSat      uint64 `json:"amount_msat"`
+	AmountSentMSat  uint64 `json:"amount_sent_msat"`
+	Status          string `json:"status"`
+}
+
+// tlv hop payload including its bigsize length prefix, as createonion wants it
+func encodeHopPayload(amount uint64, cltv uint32, nextChannel *lnwire.ShortChannelID, mpp *record.MPP) ([]byte, error) {
+	records := []tlv.Record{
+		record.NewAmtToFwdRecord(&amount),
+		record.NewLockTimeRecord(&cltv),
+	}
+	if nextChannel != nil {
+		scid := nextChannel.ToUint64()
+		records = append(records, record.NewNextHopIDRecord(&scid))
+	}
+	if mpp != nil {
+		records = append(records, mpp.Record())
+	}
+
+	stream, err := tlv.NewStream(records...)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := new(bytes.Buffer)
+	if err := stream.Encode(payload); err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	var scratch [8]byte
+	if err := tlv.WriteVarInt(buf, uint64(payload.Len()), &scratch); err != nil {
+		return nil, err
+	}
+	buf.Write(payload.Bytes())
+
+	return buf.Bytes(), nil
+}
+
+// route from the host to the payee; the host itself is not part of it
+func getRouteFromHost(p *plugin.Plugin, host string, payee string, amount uint64, finalCLTV int64, blockheight uint32) ([]routeHop, error) {
+	result, err := p.Client.CallNamed("getroute",
+		"id", payee,
+		"msatoshi", amount,
+		"riskfactor", 10,
+		"cltv", finalCLTV,
+		"fromid", host,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var route []routeHop
+	for _, hop := range result.Get("route").Array() {
+		scid, err := parseShortChannelID(hop.Get("channel").String())
+		if err != nil {
+			return nil, err
+		}
+
+		route = append(route, routeHop{
+			NodeID:         hop.Get("id").String(),
+			ShortChannelID: scid,
+			AmountMSat:     hop.Get("msatoshi").Uint(),
+			Delay:          blockheight + uint32(hop.Get("delay").Uint()),
+		})
+	}
+	if len(route) == 0 {
+		return nil, fmt.Errorf("no route from %v to %v", host, payee)
+	}
+
+	return route, nil
+}
+
+// what the host charges for forwarding over its channel to the first hop
+func getHostFee(p *plugin.Plugin, host string, firstHop routeHop) (uint64, uint32, error) {
+	result, err := p.Client.Call("listchannels", formatShortChannelID(firstHop.ShortChannelID), host)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	channels := result.Get("channels").Array()
+	if len(channels) == 0 {
+		return 0, 0, fmt.Errorf("host has no channel %v", firstHop.ShortChannelID)
+	}
+
+	baseFee := channels[0].Get("base_fee_millisatoshi").Uint()
+	feeRate := channels[0].Get("fee_per_millionth").Uint()
+	delay := uint32(channels[0].Get("delay").Uint())
+
+	return baseFee + firstHop.AmountMSat*feeRate/1000000, delay, nil
+}
+
+type payError struct {
+	code int
+	err  error
+}
+
+func (e *payError) Error() string {
+	return e.err.Error()
+}
+
+func clientPay(p *plugin.Plugin, host string, bolt11 string, timeout time.Duration) (*PaymentResult, error) {
+	invoice, err := p.Client.Call("decodepay", bolt11)
+	if err != nil {
+		return nil, &payError{payErrInvoiceInvalid, err}
+	}
+
+	payee := invoice.Get("payee").String()
+	amount := invoice.Get("msatoshi").Uint()
+	if amount == 0 {
+		return nil, &payError{payErrInvoiceInvalid, fmt.Errorf("invoices without amount are not supported")}
+	}
+	paymentHash, err := decodeHash(invoice.Get("payment_hash").String())
+	if err != nil {
+		return nil, &payError{payErrInvoiceInvalid, err}
+	}
+	paymentSecret, err := decodeHash(invoice.Get("payment_secret").String())
+	if err != nil {
+		return nil, &payError{payErrInvoiceInvalid, fmt.Errorf("invoice has no payment secret: %v", err)}
+	}
+
+	info, err := p.Client.Call("getinfo")
+	if err != nil {
+		return nil, err
+	}
+	blockheight := uint32(info.Get("blockheight").Uint())
+
+	route, err := getRouteFromHost(p, host, payee, amount, invoice.Get("min_final_cltv_expiry").Int(), blockheight)
+	if err != nil {
+		return nil, &payError{payErrRouteNotFound, err}
+	}
+
+	hostFee, hostDelay, err := getHostFee(p, host, route[0])
+	if err != nil {
+		return nil, &payError{payErrRouteNotFound, err}
+	}
+
+	// the host is the first hop of the onion; each hop's payload describes the next channel
+	var hops []map[string]interface{}
+	hopIDs := []string{host}
+	for _, hop := range route {
+		hopIDs = append(hopIDs, hop.NodeID)
+	}
+	for i, hop := range route {
+		payload, err := encodeHopPayload(hop.AmountMSat, hop.Delay, &route[i].ShortChannelID, nil)
+		if err != nil {
+			return nil, err
+		}
+		hops = append(hops, map[string]interface{}{"pubkey": hopIDs[i], "payload": hex.EncodeToString(payload)})
+	}
+	last := route[len(route)-1]
+	payload, err := encodeHopPayload(last.AmountMSat, last.Delay, nil, record.NewMPP(lnwire.MilliSatoshi(amount), paymentSecret))
+	if err != nil {
+		return nil, err
+	}
+	hops = append(hops, map[string]interface{}{"pubkey": last.NodeID, "payload": hex.EncodeToString(payload)})
+
+	// our own session key so we can decrypt the failure the route sends back
+	sessionKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		return nil, err
+	}
+	circuit := &sphinx.Circuit{SessionKey: sessionKey}
+	for _, id := range hopIDs {
+		key, err := parseNodeID(id)
+		if err != nil {
+			return nil, &payError{payErrRouteNotFound, err}
+		}
+		circuit.PaymentPath = append(circuit.PaymentPath, key)
+	}
+
+	onion, err := p.Client.CallNamed("createonion",
+		"hops", hops,
+		"assocdata", hex.EncodeToString(paymentHash[:]),
+		"session_key", hex.EncodeToString(sessionKey.Serialize()),
+	)
+	if err != nil {
+		return nil, err
+	}
+	onionBlob, err := hex.DecodeString(onion.Get("onion").String())
+	if err != nil || len(onionBlob) != lnwire.OnionPacketSize {
+		return nil, fmt.Errorf("createonion returned an invalid onion")
+	}
+
+	addHTLC := &hcwire.UpdateAddHTLC{
+		UpdateAddHTLC: lnwire.UpdateAddHTLC{
+			Amount:      lnwire.MilliSatoshi(route[0].AmountMSat + hostFee),
+			PaymentHash: paymentHash,
+			Expiry:      route[0].Delay + hostDelay,
+		},
+	}
+	copy(addHTLC.OnionBlob[:], onionBlob)
+
+	waiter, err := addOutgoingHTLC(p, host, addHTLC)
+	if err != nil {
+		return nil, err
+	}
+	defer htlcWaiters.remove(htlcKey{addHTLC.ChanID, addHTLC.ID}, waiter)
+
+	select {
+	case result := <-waiter:
+		if result.preimage == nil {
+			return nil, &payError{payErrTryOtherRoute, describeHTLCFailure(result, circuit)}
+		}
+
+		return &PaymentResult{
+			PaymentHash:     hex.EncodeToString(paymentHash[:]),
+			PaymentPreimage: hex.EncodeToString(result.preimage[:]),
+			AmountMSat:      amount,
+			AmountSentMSat:  uint64(addHTLC.Amount),
+			Status:          "complete",
+		}, nil
+
+	case <-time.After(timeout):
+		return nil, &payError{payErrTimeout, fmt.Errorf("htlc %v still pending after %v", addHTLC.ID, timeout)}
+	}
+}
+
+// why an htlc we sent was failed and by whom; hop 1 is the host
+type htlcFailure struct {
+	ID      uint64
+	Hop     int
+	NodeID  string
+	Code    lnwire.FailCode
+	Failure lnwire.FailureMessage // nil when the host couldn't parse the onion
+}
+
+func (f *htlcFailure) Error() string {
+	if f.Failure == nil {
+		return fmt.Sprintf("htlc %v failed at hop %v (%v): %v", f.ID, f.Hop, f.NodeID, f.Code)
+	}
+	return fmt.Sprintf("htlc %v failed at hop %v (%v): %v", f.ID, f.Hop, f.NodeID, f.Failure)
+}
+
+func describeHTLCFailure(result htlcResult, circuit *sphinx.Circuit) error {
+	switch {
+	case result.fail != nil:
+		decrypted, err := sphinx.NewOnionErrorDecrypter(circuit).DecryptError(result.fail.Reason)
+		if err != nil {
+			return fmt.Errorf("htlc %v failed with a reason we can't decrypt: %v", result.fail.ID, err)
+		}
+		failure, err := lnwire.DecodeFailure(bytes.NewReader(decrypted.Message), 0)
+		if err != nil {
+			return fmt.Errorf("htlc %v failed at hop %v with a reason we can't decode: %v", result.fail.ID, decrypted.SenderIdx, err)
+		}
+		return &htlcFailure{
+			ID:      result.fail.ID,
+			Hop:     decrypted.SenderIdx,
+			NodeID:  hex.EncodeToString(decrypted.Sender.SerializeCompressed()),
+			Code:    failure.Code(),
+			Failure: failure,
+		}
+	case result.malformed != nil:
+		// only the host sees our onion as it is
+		return &htlcFailure{
+			ID:     result.malformed.ID,
+			Hop:    1,
+			NodeID: hex.EncodeToString(circuit.PaymentPath[0].SerializeCompressed()),
+			Code:   result.malformed.FailureCode,
+		}
+	default:
+		return fmt.Errorf("htlc failed")
+	}
+}
+
+// adds our htlc to the open channel with host and signs the new state
+func addOutgoingHTLC(p *plugin.Plugin, host string, addHTLC *hcwire.UpdateAddHTLC) (chan htlcResult, error) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	channel, err := store.getChannel(host)
+	if err != nil {
+		return nil, err
+	}
+	if channel.IsHost || channel.Status != StatusOpen {
+		return nil, fmt.Errorf("no open hosted channel with host %v", host)
+	}
+
+	addHTLC.ChanID = channel.ChannelID
+
+	return addLocalHTLC(p, channel, addHTLC)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	sphinx "github.com/lightningnetwork/lightning-onion"
+	"github.com/lightningnetwork/lnd/keychain"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/tlv"
+	"github.com/raphjaph/go-hosted-channels/hcwire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+)
+
+// createonion the way lightningd does it, with the session key it's given
+func testCreateOnion(params gjson.Result) (interface{}, error) {
+	sessionKeyBytes, err := hex.DecodeString(params.Get("session_key").String())
+	if err != nil {
+		return nil, err
+	}
+	sessionKey, _ := btcec.PrivKeyFromBytes(btcec.S256(), sessionKeyBytes)
+
+	var path sphinx.PaymentPath
+	for i, hop := range params.Get("hops").Array() {
+		key, err := parseNodeID(hop.Get("pubkey").String())
+		if err != nil {
+			return nil, err
+		}
+		payload, err := hex.DecodeString(hop.Get("payload").String())
+		if err != nil {
+			return nil, err
+		}
+
+		// createonion gets the length prefix too; sphinx adds its own
+		r := bytes.NewReader(payload)
+		var scratch [8]byte
+		if _, err := tlv.ReadVarInt(r, &scratch); err != nil {
+			return nil, err
+		}
+		hopPayload, err := sphinx.NewHopPayload(nil, payload[len(payload)-r.Len():])
+		if err != nil {
+			return nil, err
+		}
+		path[i] = sphinx.OnionHop{NodePub: *key, HopPayload: hopPayload}
+	}
+
+	assocData, err := hex.DecodeString(params.Get("assocdata").String())
+	if err != nil {
+		return nil, err
+	}
+	onion, err := sphinx.NewOnionPacket(&path, sessionKey, assocData, sphinx.DeterministicPacketFiller)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if err := onion.Encode(buf); err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{"onion": hex.EncodeToString(buf.Bytes())}, nil
+}
+
+type testPayee struct {
+	key         *btcec.PrivateKey
+	id          string
+	preimage    [32]byte
+	paymentHash [32]byte
+}
+
+func newTestPayee(t *testing.T) testPayee {
+	key, err := btcec.NewPrivateKey(btcec.S256())
+	require.NoError(t, err)
+	payee := testPayee{key: key, id: hex.EncodeToString(key.PubKey().SerializeCompressed()), preimage: [32]byte{5}}
+	payee.paymentHash = sha256.Sum256(payee.preimage[:])
+
+	return payee
+}
+
+// gives client an invoice of 50000 msat to payee, one channel away from the host
+func setupTestPay(t *testing.T, client, host *testNode, payee testPayee) {
+	client.ln.handle("decodepay", func(params gjson.Result) (interface{}, error) {
+		return map[string]interface{}{
+			"payee":                 payee.id,
+			"msatoshi":              50000,
+			"payment_hash":          hex.EncodeToString(payee.paymentHash[:]),
+			"payment_secret":        hex.EncodeToString(make([]byte, 32)),
+			"min_final_cltv_expiry": 18,
+		}, nil
+	})
+	client.ln.handle("getroute", func(params gjson.Result) (interface{}, error) {
+		assert.Equal(t, host.id, params.Get("fromid").String())
+		return map[string]interface{}{"route": []map[string]interface{}{
+			{"id": payee.id, "channel": "700000x1x0", "msatoshi": 50000, "delay": 18},
+		}}, nil
+	})
+	client.ln.handle("listchannels", func(params gjson.Result) (interface{}, error) {
+		if params.Get("0").String() != "700000x1x0" {
+			return map[string]interface{}{"channels": []interface{}{}}, nil
+		}
+		return map[string]interface{}{"channels": []map[string]interface{}{
+			{"base_fee_millisatoshi": 1000, "fee_per_millionth": 10, "delay": 34},
+		}}, nil
+	})
+	client.ln.handle("createonion", testCreateOnion)
+}
+
+// runs hc-pay until the client's htlc is cross signed with the host; returns the htlc
+// as the host has it and where the result of hc-pay will arrive
+func startTestPay(t *testing.T, client, host *testNode, timeout time.Duration) (lnwire.UpdateAddHTLC, chan error, chan *PaymentResult) {
+	errs := make(chan error, 1)
+	results := make(chan *PaymentResult, 1)
+	client.use()
+	go func() {
+		result, err := clientPay(client.p, host.id, "lnbcrt500n1", timeout)
+		errs <- err
+		results <- result
+	}()
+
+	// reads the node's db directly; use() would race with the goroutine
+	require.Eventually(t, func() bool {
+		channel, err := client.db.getChannel(host.id)
+		return err == nil && len(channel.NextLocalUpdates) == 1
+	}, time.Second, 10*time.Millisecond)
+	exchange(t, client, host)
+
+	htlcs := host.channel(t, client).LastCrossSignedState.IncomingHTLCs
+	require.Len(t, htlcs, 1)
+	return htlcs[0], errs, results
+}
+
+func TestPay(t *testing.T) {
+	client := newTestNode(t, optionFlags{})
+	host := newTestNode(t, optionFlags{})
+	openTestChannel(t, client, host)
+	payTestHTLC(t, client, host)
+	payee := newTestPayee(t)
+	setupTestPay(t, client, host, payee)
+
+	htlc, errs, results := startTestPay(t, client, host, time.Second)
+	// the amount of the route plus what the host charges for its channel
+	assert.Equal(t, lnwire.MilliSatoshi(50000+1000), htlc.Amount)
+	assert.Equal(t, uint32(testBlockheight+18+34), htlc.Expiry)
+
+	// the host can read its hop: forward 50000 msat to the payee's channel
+	host.use()
+	onion, err := peelOnion(host.p, htlc)
+	require.NoError(t, err)
+	fwd := onion.payload.ForwardingInfo()
+	assert.Equal(t, lnwire.MilliSatoshi(50000), fwd.AmountToForward)
+	assert.Equal(t, "700000x1x0", formatShortChannelID(fwd.NextHop))
+
+	sendTestUpdate(t, host, client, &hcwire.UpdateFulfillHTLC{
+		UpdateFulfillHTLC: lnwire.UpdateFulfillHTLC{ChanID: htlc.ChanID, ID: htlc.ID, PaymentPreimage: payee.preimage},
+	})
+	exchange(t, host, client)
+
+	require.NoError(t, <-errs)
+	result := <-results
+	assert.Equal(t, hex.EncodeToString(payee.preimage[:]), result.PaymentPreimage)
+	assert.Equal(t, uint64(50000), result.AmountMSat)
+	assert.Equal(t, uint64(51000), result.AmountSentMSat)
+}
+
+func TestPayFailures(t *testing.T) {
+	tests := []struct {
+		name string
+		hop  int
+		fail func(t *testing.T, host *testNode, payee testPayee, onion *peeledOnion, htlc lnwire.UpdateAddHTLC) hcwire.Message
+		code lnwire.FailCode
+	}{
+		{"by the host", 1, func(t *testing.T, host *testNode, payee testPayee, onion *peeledOnion, htlc lnwire.UpdateAddHTLC) hcwire.Message {
+			fail, err := failHTLCWith(onion, htlc, &lnwire.FailUnknownNextPeer{})
+			require.NoError(t, err)
+			return fail
+		}, lnwire.CodeUnknownNextPeer},
+		{"by the payee", 2, func(t *testing.T, host *testNode, payee testPayee, onion *peeledOnion, htlc lnwire.UpdateAddHTLC) hcwire.Message {
+			// the payee encrypts it and the host wraps it on the way back
+			router := sphinx.NewRouter(&keychain.PrivKeyECDH{PrivKey: payee.key}, getChainParams(host.p.Network), sphinx.NewMemoryReplayLog())
+			encrypter, err := sphinx.NewOnionErrorEncrypter(router, onion.packet.NextPacket.EphemeralKey)
+			require.NoError(t, err)
+			failure := new(bytes.Buffer)
+			require.NoError(t, lnwire.EncodeFailure(failure, lnwire.NewFailIncorrectDetails(50000, testBlockheight), 0))
+			reason := onion.encrypter.EncryptError(false, encrypter.EncryptError(true, failure.Bytes()))
+
+			return &hcwire.UpdateFailHTLC{
+				UpdateFailHTLC: lnwire.UpdateFailHTLC{ChanID: htlc.ChanID, ID: htlc.ID, Reason: reason},
+			}
+		}, lnwire.CodeIncorrectOrUnknownPaymentDetails},
+		{"malformed", 1, func(t *testing.T, host *testNode, payee testPayee, onion *peeledOnion, htlc lnwire.UpdateAddHTLC) hcwire.Message {
+			return &hcwire.UpdateFailMalformedHTLC{
+				UpdateFailMalformedHTLC: lnwire.UpdateFailMalformedHTLC{
+					ChanID:       htlc.ChanID,
+					ID:           htlc.ID,
+					ShaOnionBlob: sha256.Sum256(htlc.OnionBlob[:]),
+					FailureCode:  lnwire.CodeInvalidOnionHmac,
+				},
+			}
+		}, lnwire.CodeInvalidOnionHmac},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newTestNode(t, optionFlags{})
+			host := newTestNode(t, optionFlags{})
+			openTestChannel(t, client, host)
+			payTestHTLC(t, client, host)
+			payee := newTestPayee(t)
+			setupTestPay(t, client, host, payee)
+
+			htlc, errs, _ := startTestPay(t, client, host, time.Second)
+			host.use()
+			onion, err := peelOnion(host.p, htlc)
+			require.NoError(t, err)
+			sendTestUpdate(t, host, client, test.fail(t, host, payee, onion, htlc))
+			exchange(t, host, client)
+
+			err = <-errs
+			payErr, ok := err.(*payError)
+			require.True(t, ok, "%v", err)
+			assert.Equal(t, payErrTryOtherRoute, payErr.code)
+			failure, ok := payErr.err.(*htlcFailure)
+			require.True(t, ok, "%v", payErr.err)
+			assert.Equal(t, test.hop, failure.Hop)
+			assert.Equal(t, []string{host.id, payee.id}[test.hop-1], failure.NodeID)
+			assert.Equal(t, test.code, failure.Code)
+		})
+	}
+}
+
+func TestPayTimeout(t *testing.T) {
+	client := newTestNode(t, optionFlags{})
+	host := newTestNode(t, optionFlags{})
+	openTestChannel(t, client, host)
+	payTestHTLC(t, client, host)
+	setupTestPay(t, client, host, newTestPayee(t))
+
+	htlc, errs, _ := startTestPay(t, client, host, 100*time.Millisecond)
+	err := <-errs
+	payErr, ok := err.(*payError)
+	require.True(t, ok, "%v", err)
+	assert.Equal(t, payErrTimeout, payErr.code)
+
+	// nobody is left waiting for the htlc
+	htlcWaiters.mu.Lock()
+	defer htlcWaiters.mu.Unlock()
+	assert.NotContains(t, htlcWaiters.waiting, htlcKey{htlc.ChanID, htlc.ID})
+}
@@ -0,0 +1,209 @@
+package main
+
+/*
+PREIMAGE QUERIES: when our host doesn't settle an htlc we sent, the payment may
+still have succeeded further down the route. other hosts we have channels with
+might know the preimage, so we ask them:
+- HOST VIEW: answer query_preimages from clients with the preimages in our store or in listsendpays
+- CLIENT VIEW: periodically query our other hosts for the hashes of stuck outgoing htlcs
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/raphjaph/go-hosted-channels/hcwire"
+)
+
+const preimageQueryInterval = 10 * time.Minute
+
+// outgoing htlcs this close to their expiry are stuck if the host didn't settle them yet
+const stuckHTLCBlocks = 18
+
+// preimage from our store; falls back to our payments in lightningd and stores what it finds there
+func lookupPreimage(p *plugin.Plugin, paymentHash [32]byte) ([32]byte, bool) {
+	if preimage, err := store.getPreimage(paymentHash); err == nil {
+		return preimage, true
+	}
+
+	sendpays, err := p.Client.CallNamed("listsendpays", "payment_hash", hex.EncodeToString(paymentHash[:]))
+	if err != nil {
+		return [32]byte{}, false
+	}
+	for _, sendpay := range sendpays.Get("payments").Array() {
+		if sendpay.Get("status").String() != "complete" {
+			continue
+		}
+
+		preimage, err := decodeHash(sendpay.Get("payment_preimage").String())
+		if err != nil || sha256.Sum256(preimage[:]) != paymentHash {
+			continue
+		}
+		if err := store.savePreimage(preimage); err != nil {
+			p.Log("error saving preimage: ", err)
+		}
+
+		return preimage, true
+	}
+
+	return [32]byte{}, false
+}
+
+func hostHandleQueryPreimages(p *plugin.Plugin, channel Channel, query *hcwire.QueryPreimages) error {
+	if !channel.IsHost || !channel.HasFeature(hcwire.PreimageQueriesOptional) {
+		return nil
+	}
+
+	reply := &hcwire.ReplyPreimages{}
+	for _, paymentHash := range query.PaymentHashes {
+		if preimage, ok := lookupPreimage(p, paymentHash); ok {
+			reply.Preimages = append(reply.Preimages, preimage)
+		}
+	}
+
+	return sendMessage(p, channel.PeerID, reply)
+}
+
+// preimages are their own proof; whoever sends them, we settle upstream with them
+func clientHandleReplyPreimages(p *plugin.Plugin, channel Channel, reply *hcwire.ReplyPreimages) error {
+	if channel.IsHost {
+		return nil
+	}
+
+	info, err := p.Client.Call("getinfo")
+	if err != nil {
+		return err
+	}
+	blockheight := uint32(info.Get("blockheight").Uint())
+
+	channels, err := store.listChannels()
+	if err != nil {
+		return err
+	}
+
+	for _, preimage := range reply.Preimages {
+		paymentHash := sha256.Sum256(preimage[:])
+
+		for i, ch := range channels {
+			if ch.IsHost {
+				continue
+			}
+			for _, htlc := range pendingOutgoingHTLCs(ch) {
+				if htlc.PaymentHash != paymentHash {
+					continue
+				}
+
+				p.Logf("got preimage of htlc %v with %v from %v", htlc.ID, ch.PeerID, channel.PeerID)
+				if err := store.savePreimage(preimage); err != nil {
+					return err
+				}
+				htlcWaiters.notify(htlcKey{htlc.ChanID, htlc.ID}, htlcResult{preimage: &preimage})
+
+				// the host kept a stuck htlc that was paid; it has to settle it with a state override
+				if ch.Status == StatusOpen && htlc.Expiry <= blockheight+stuckHTLCBlocks {
+					p.Log("errored channel: ", errorChannel(p, ch, newChannelError(hcwire.ErrHTLCExternalFulfill, "htlc %v", htlc.ID)))
+					channels[i].Status = StatusErrored
+					ch.Status = StatusErrored
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// htlcs we sent that the host hasn't resolved, signed or not
+func pendingOutgoingHTLCs(channel Channel) []lnwire.UpdateAddHTLC {
+	htlcs := append([]lnwire.UpdateAddHTLC{}, channel.LastCrossSignedState.OutgoingHTLCs...)
+	return append(htlcs, unsignedOutgoingHTLCs(channel)...)
+}
+
+// htlcs we sent that aren't part of the last cross signed state yet
+func unsignedOutgoingHTLCs(channel Channel) []lnwire.UpdateAddHTLC {
+	var htlcs []lnwire.UpdateAddHTLC
+	for _, update := range channel.NextLocalUpdates {
+		if add, ok := update.(*hcwire.UpdateAddHTLC); ok {
+			htlcs = append(htlcs, add.UpdateAddHTLC)
+		}
+	}
+
+	return htlcs
+}
+
+// asks all our hosts except the one of the htlc for the preimages of stuck htlcs
+func clientQueryStuckPreimages(p *plugin.Plugin) error {
+	info, err := p.Client.Call("getinfo")
+	if err != nil {
+		return err
+	}
+	blockheight := uint32(info.Get("blockheight").Uint())
+
+	stateMu.Lock()
+	channels, err := store.listChannels()
+	stateMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// payment hashes to ask each host for
+	queries := make(map[string][][32]byte)
+	for _, channel := range channels {
+		if channel.IsHost {
+			continue
+		}
+
+		for _, htlc := range pendingOutgoingHTLCs(channel) {
+			if channel.Status == StatusOpen && htlc.Expiry <= blockheight {
+				errorTimedOutChannel(p, channel.PeerID, htlc.ID)
+			}
+			if channel.Status == StatusOpen && htlc.Expiry > blockheight+stuckHTLCBlocks {
+				continue
+			}
+			if _, err := store.getPreimage(htlc.PaymentHash); err == nil {
+				continue
+			}
+
+			for _, other := range channels {
+				if other.IsHost || other.PeerID == channel.PeerID || other.Status != StatusOpen ||
+					!other.HasFeature(hcwire.PreimageQueriesOptional) {
+					continue
+				}
+				if len(queries[other.PeerID]) < hcwire.MaxPreimagesPerMessage {
+					queries[other.PeerID] = append(queries[other.PeerID], htlc.PaymentHash)
+				}
+			}
+		}
+	}
+
+	for host, paymentHashes := range queries {
+		if err := sendMessage(p, host, &hcwire.QueryPreimages{PaymentHashes: paymentHashes}); err != nil {
+			p.Logf("couldn't query %v for preimages: %v", host, err)
+		}
+	}
+
+	return nil
+}
+
+// the peer let one of our htlcs get too close to expiry without resolving it
+func errorTimedOutChannel(p *plugin.Plugin, peer string, htlcID uint64) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	channel, err := store.getChannel(peer)
+	if err != nil || channel.Status != StatusOpen {
+		return
+	}
+
+	p.Log("errored channel: ", errorChannel(p, channel, newChannelError(hcwire.ErrTimedOutOutgoingHTLC, "htlc %v", htlcID)))
+}
+
+func queryStuckPreimagesPeriodically(p *plugin.Plugin) {
+	for range time.Tick(preimageQueryInterval) {
+		if err := clientQueryStuckPreimages(p); err != nil {
+			p.Log("couldn't query preimages: ", err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+/*
+RECORDING custom messages (hosted-channel-record-dir):
+- every message to or from a peer is appended to <dir>/<peer_id>.jsonl as it was on the wire
+- with the blockheight at the time since blockdays decide which states are accepted
+- `go-hosted-channels replay` runs a recording through the state machine again
+*/
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+	"github.com/lightningnetwork/lnd/lnwire"
+)
+
+const (
+	directionIn  = "in"
+	directionOut = "out"
+)
+
+type recordEntry struct {
+	Time        time.Time `json:"time"`
+	Peer        string    `json:"peer"`
+	Direction   string    `json:"direction"` // in: from the peer, out: sent by us
+	Blockheight uint32    `json:"blockheight"`
+	Payload     string    `json:"payload"` // hex like the custommsg hook has it
+}
+
+// recordings are appended to from the hook and from goroutines resolving htlcs
+var recordMu sync.Mutex
+
+func recordMessage(p *plugin.Plugin, peer string, direction string, payload string) {
+	dir := p.Args.Get("hosted-channel-record-dir").String()
+	if dir == "" {
+		return
+	}
+
+	entry := recordEntry{
+		Time:      time.Now().UTC(),
+		Peer:      peer,
+		Direction: direction,
+		Payload:   payload,
+	}
+	if info, err := p.Client.Call("getinfo"); err == nil {
+		entry.Blockheight = uint32(info.Get("blockheight").Uint())
+	}
+
+	if err := appendRecord(filepath.Join(dir, peer+".jsonl"), entry); err != nil {
+		p.Logf("couldn't record message %v %v: %v", direction, peer, err)
+	}
+}
+
+func appendRecord(path string, entry recordEntry) error {
+	recordMu.Lock()
+	defer recordMu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return json.NewEncoder(f).Encode(entry)
+}
+
+func readRecording(path string) ([]recordEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// type and payload in hex plus the other fields
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 4*lnwire.MaxSliceLength+1024)
+
+	var entries []recordEntry
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var entry recordEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
@@ -0,0 +1,438 @@
+package main
+
+/*
+HOST VIEW of htlcs from the client (once they are cross signed):
+- [x] peel our layer of the client's onion with the node key
+- [x] read next hop, amount and cltv from the payload
+- [x] sendonion to the next hop
+- [x] waitsendpay and fulfill or fail back to the client
+
+CLIENT VIEW: htlcs from the host are payments to us; they have to pay an invoice
+from listinvoices and we have to know its preimage, otherwise they are failed back.
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+	sphinx "github.com/lightningnetwork/lightning-onion"
+	"github.com/lightningnetwork/lnd/htlcswitch/hop"
+	"github.com/lightningnetwork/lnd/keychain"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/zpay32"
+	"github.com/raphjaph/go-hosted-channels/hcwire"
+	"github.com/tidwall/gjson"
+)
+
+// how long waitsendpay waits per call; we keep calling until the payment is resolved
+const waitSendPayTimeout = 600
+
+// waitsendpay error code for a payment that's still in flight after the timeout
+const waitSendPayStillPending = 200
+
+// longest we wait between waitsendpay calls that failed for other reasons than the payment
+const maxWaitSendPayBackoff = time.Minute
+
+type peeledOnion struct {
+	packet    *sphinx.ProcessedPacket
+	payload   *hop.Payload
+	encrypter *sphinx.OnionErrorEncrypter // wraps failures we send back
+}
+
+func peelOnion(p *plugin.Plugin, htlc lnwire.UpdateAddHTLC) (*peeledOnion, error) {
+	nodeKey, err := getNodeKey(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var onion sphinx.OnionPacket
+	if err := onion.Decode(bytes.NewReader(htlc.OnionBlob[:])); err != nil {
+		return nil, err
+	}
+
+	// htlcs are only processed once they are cross signed so replays can't
+	// cost us anything; the replay log isn't needed
+	router := sphinx.NewRouter(&keychain.PrivKeyECDH{PrivKey: nodeKey}, getChainParams(p.Network), sphinx.NewMemoryReplayLog())
+	packet, err := router.ReconstructOnionPacket(&onion, htlc.PaymentHash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	encrypter, err := sphinx.NewOnionErrorEncrypter(router, onion.EphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var payload *hop.Payload
+	if packet.ForwardingInstructions != nil {
+		payload = hop.NewLegacyPayload(packet.ForwardingInstructions)
+	} else {
+		payload, err = hop.NewPayloadFromReader(bytes.NewReader(packet.Payload.Payload))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &peeledOnion{packet: packet, payload: payload, encrypter: encrypter}, nil
+}
+
+// called for every htlc the peer added once it is cross signed
+func processIncomingHTLC(p *plugin.Plugin, peer string, isHost bool, htlc lnwire.UpdateAddHTLC) {
+	update, err := resolveIncomingHTLC(p, isHost, htlc)
+	if err != nil {
+		p.Logf("couldn't resolve htlc %v from %v: %v", htlc.ID, peer, err)
+		return
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	channel, err := store.getChannel(peer)
+	if err != nil {
+		p.Logf("couldn't resolve htlc %v from %v: %v", htlc.ID, peer, err)
+		return
+	}
+	if channel.Status != StatusOpen {
+		p.Logf("couldn't resolve htlc %v from %v: channel is %v", htlc.ID, peer, channel.Status)
+		return
+	}
+	if !isUnresolved(channel, htlc.ID) {
+		return
+	}
+
+	if err := sendLocalUpdate(p, &channel, update); err != nil {
+		p.Logf("couldn't resolve htlc %v from %v: %v", htlc.ID, peer, err)
+		return
+	}
+	if err := store.saveChannel(channel); err != nil {
+		p.Log("error saving channel: ", err)
+	}
+}
+
+// the htlc is cross signed and we haven't sent anything resolving it yet
+func isUnresolved(channel Channel, id uint64) bool {
+	if _, ok := findHTLC(channel.LastCrossSignedState.IncomingHTLCs, id); !ok {
+		return false
+	}
+
+	for _, update := range channel.NextLocalUpdates {
+		switch u := update.(type) {
+		case *hcwire.UpdateFulfillHTLC:
+			if u.ID == id {
+				return false
+			}
+		case *hcwire.UpdateFailHTLC:
+			if u.ID == id {
+				return false
+			}
+		case *hcwire.UpdateFailMalformedHTLC:
+			if u.ID == id {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// picks up htlcs that were still pending when we were stopped
+func resumeIncomingHTLCs(p *plugin.Plugin) {
+	channels, err := store.listChannels()
+	if err != nil {
+		p.Log("couldn't list channels: ", err)
+		return
+	}
+
+	for _, channel := range channels {
+		if channel.Status != StatusOpen {
+			continue
+		}
+		for _, htlc := range channel.LastCrossSignedState.IncomingHTLCs {
+			if isUnresolved(channel, htlc.ID) {
+				go processIncomingHTLC(p, channel.PeerID, channel.IsHost, htlc)
+			}
+		}
+	}
+}
+
+// returns the update_fulfill/fail_htlc that resolves the htlc
+func resolveIncomingHTLC(p *plugin.Plugin, isHost bool, htlc lnwire.UpdateAddHTLC) (hcwire.Message, error) {
+	onion, err := peelOnion(p, htlc)
+	if err != nil {
+		return &hcwire.UpdateFailMalformedHTLC{
+			UpdateFailMalformedHTLC: lnwire.UpdateFailMalformedHTLC{
+				ChanID:       htlc.ChanID,
+				ID:           htlc.ID,
+				ShaOnionBlob: sha256.Sum256(htlc.OnionBlob[:]),
+				FailureCode:  lnwire.CodeInvalidOnionHmac,
+			},
+		}, nil
+	}
+
+	if onion.packet.Action == sphinx.ExitNode {
+		return resolvePaymentToUs(p, onion, htlc)
+	}
+
+	if !isHost {
+		// clients don't route
+		return failHTLCWith(onion, htlc, &lnwire.FailUnknownNextPeer{})
+	}
+
+	return relayHTLC(p, onion, htlc)
+}
+
+// settles the htlc with the preimage of the invoice it pays; BOLT 4 failures otherwise
+func resolvePaymentToUs(p *plugin.Plugin, onion *peeledOnion, htlc lnwire.UpdateAddHTLC) (hcwire.Message, error) {
+	fwd := onion.payload.ForwardingInfo()
+	if fwd.AmountToForward > htlc.Amount {
+		return failHTLCWith(onion, htlc, lnwire.NewFinalIncorrectHtlcAmount(htlc.Amount))
+	}
+	if fwd.OutgoingCTLV > htlc.Expiry {
+		return failHTLCWith(onion, htlc, lnwire.NewFinalIncorrectCltvExpiry(htlc.Expiry))
+	}
+
+	info, err := p.Client.Call("getinfo")
+	if err != nil {
+		return nil, err
+	}
+	blockheight := uint32(info.Get("blockheight").Uint())
+	incorrectDetails := lnwire.NewFailIncorrectDetails(htlc.Amount, blockheight)
+
+	invoices, err := p.Client.CallNamed("listinvoices", "payment_hash", hex.EncodeToString(htlc.PaymentHash[:]))
+	if err != nil {
+		return nil, err
+	}
+	invoice := invoices.Get("invoices.0")
+	if !invoice.Exists() {
+		p.Logf("htlc %v pays no invoice of ours", htlc.ID)
+		return failHTLCWith(onion, htlc, incorrectDetails)
+	}
+
+	status := invoice.Get("status").String()
+	if status == "expired" || (status == "unpaid" && time.Now().Unix() > invoice.Get("expires_at").Int()) {
+		p.Logf("htlc %v pays an expired invoice", htlc.ID)
+		return failHTLCWith(onion, htlc, incorrectDetails)
+	}
+
+	// invoices without amount take anything; otherwise at most twice the amount like lightningd
+	if invoice.Get("amount_msat").Exists() {
+		amount, err := parseMSat(invoice.Get("amount_msat"))
+		if err != nil {
+			return nil, err
+		}
+		if uint64(htlc.Amount) < amount || uint64(htlc.Amount) > 2*amount {
+			p.Logf("htlc %v pays %v for an invoice of %v msat", htlc.ID, htlc.Amount, amount)
+			return failHTLCWith(onion, htlc, incorrectDetails)
+		}
+	}
+
+	decoded, err := zpay32.Decode(invoice.Get("bolt11").String(), getChainParams(p.Network))
+	if err != nil {
+		return nil, err
+	}
+	if htlc.Expiry < blockheight+uint32(decoded.MinFinalCLTVExpiry()) {
+		p.Logf("htlc %v expires at %v, too soon for the invoice", htlc.ID, htlc.Expiry)
+		return failHTLCWith(onion, htlc, incorrectDetails)
+	}
+
+	// we don't wait for other parts; the htlc has to pay everything
+	mpp := onion.payload.MultiPath()
+	if decoded.PaymentAddr != nil && (mpp == nil || mpp.PaymentAddr() != *decoded.PaymentAddr) {
+		p.Logf("htlc %v has the wrong payment secret", htlc.ID)
+		return failHTLCWith(onion, htlc, incorrectDetails)
+	}
+	if mpp != nil && mpp.TotalMsat() > htlc.Amount {
+		p.Logf("htlc %v is one part of %v", htlc.ID, mpp.TotalMsat())
+		return failHTLCWith(onion, htlc, incorrectDetails)
+	}
+
+	// lightningd only shows the preimage of paid invoices; others have to be forwarded with theirs
+	preimage, err := decodeHash(invoice.Get("payment_preimage").String())
+	if err != nil {
+		preimage, err = store.getPreimage(htlc.PaymentHash)
+	}
+	if err != nil {
+		p.Logf("don't know the preimage of htlc %v", htlc.ID)
+		return failHTLCWith(onion, htlc, incorrectDetails)
+	}
+
+	return &hcwire.UpdateFulfillHTLC{
+		UpdateFulfillHTLC: lnwire.UpdateFulfillHTLC{
+			ChanID:          htlc.ChanID,
+			ID:              htlc.ID,
+			PaymentPreimage: preimage,
+		},
+	}, nil
+}
+
+func failHTLCWith(onion *peeledOnion, htlc lnwire.UpdateAddHTLC, failure lnwire.FailureMessage) (hcwire.Message, error) {
+	// padded to the fixed size BOLT 4 wants so the payer can decrypt it
+	buf := new(bytes.Buffer)
+	if err := lnwire.EncodeFailure(buf, failure, 0); err != nil {
+		return nil, err
+	}
+
+	return &hcwire.UpdateFailHTLC{
+		UpdateFailHTLC: lnwire.UpdateFailHTLC{
+			ChanID: htlc.ChanID,
+			ID:     htlc.ID,
+			Reason: onion.encrypter.EncryptError(true, buf.Bytes()),
+		},
+	}, nil
+}
+
+// lightningd tells the parts of a payment apart by partid; clients of different
+// channels can relay the same payment hash with the same htlc id so the channel
+// is part of it too. Cut to 53 bits so it's a json number without rounding.
+func relayPartID(htlc lnwire.UpdateAddHTLC) uint64 {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], deriveShortChannelID(htlc.ChanID).ToUint64())
+	binary.BigEndian.PutUint64(b[8:], htlc.ID)
+	hash := sha256.Sum256(b[:])
+
+	return binary.BigEndian.Uint64(hash[:8]) & (1<<53 - 1)
+}
+
+// forwards the client's htlc with sendonion and waits until it's resolved
+func relayHTLC(p *plugin.Plugin, onion *peeledOnion, htlc lnwire.UpdateAddHTLC) (hcwire.Message, error) {
+	fwd := onion.payload.ForwardingInfo()
+
+	info, err := p.Client.Call("getinfo")
+	if err != nil {
+		return nil, err
+	}
+	blockheight := uint32(info.Get("blockheight").Uint())
+
+	channels, err := p.Client.Call("listchannels", formatShortChannelID(fwd.NextHop), info.Get("id").String())
+	if err != nil {
+		return nil, err
+	}
+	next := channels.Get("channels.0")
+	nextPeer := next.Get("destination").String()
+	if nextPeer == "" {
+		return failHTLCWith(onion, htlc, &lnwire.FailUnknownNextPeer{})
+	}
+
+	// the client pays what we charge on the outgoing channel (see getHostFee);
+	// lightningd doesn't hand out the signed channel_update so the failures carry an empty one
+	fee := next.Get("base_fee_millisatoshi").Uint() + uint64(fwd.AmountToForward)*next.Get("fee_per_millionth").Uint()/1000000
+	if uint64(htlc.Amount) < uint64(fwd.AmountToForward)+fee {
+		p.Logf("htlc %v pays %v to forward %v, fee is %v msat", htlc.ID, htlc.Amount, fwd.AmountToForward, fee)
+		return failHTLCWith(onion, htlc, lnwire.NewFeeInsufficient(htlc.Amount, lnwire.ChannelUpdate{}))
+	}
+	if uint64(htlc.Expiry) < uint64(fwd.OutgoingCTLV)+next.Get("delay").Uint() {
+		p.Logf("htlc %v expires at %v but asks to forward with expiry %v", htlc.ID, htlc.Expiry, fwd.OutgoingCTLV)
+		return failHTLCWith(onion, htlc, lnwire.NewIncorrectCltvExpiry(htlc.Expiry, lnwire.ChannelUpdate{}))
+	}
+	if fwd.OutgoingCTLV <= blockheight+1 {
+		return failHTLCWith(onion, htlc, lnwire.NewExpiryTooSoon(lnwire.ChannelUpdate{}))
+	}
+
+	paymentHash := hex.EncodeToString(htlc.PaymentHash[:])
+	partID := relayPartID(htlc)
+
+	// the hook may have been replayed after a restart; don't send twice
+	sendpays, err := p.Client.CallNamed("listsendpays", "payment_hash", paymentHash)
+	if err != nil {
+		return nil, err
+	}
+	alreadySent := false
+	for _, sendpay := range sendpays.Get("payments").Array() {
+		if sendpay.Get("partid").Uint() == partID {
+			alreadySent = true
+		}
+	}
+
+	if !alreadySent {
+		nextOnion := new(bytes.Buffer)
+		if err := onion.packet.NextPacket.Encode(nextOnion); err != nil {
+			return nil, err
+		}
+
+		firstHop := map[string]interface{}{
+			"id":          nextPeer,
+			"amount_msat": fmt.Sprintf("%dmsat", fwd.AmountToForward),
+			"delay":       fwd.OutgoingCTLV - (blockheight + 1),
+		}
+
+		// NOTE: sendonion adds htlc to lightningd database so it can be retrieved with listsendpays
+		_, err = p.Client.CallNamed("sendonion",
+			"onion", hex.EncodeToString(nextOnion.Bytes()),
+			"first_hop", firstHop,
+			"payment_hash", paymentHash,
+			"partid", partID,
+		)
+		if err != nil {
+			p.Logf("sendonion for htlc %v failed: %v", htlc.ID, err)
+			return failHTLCWith(onion, htlc, &lnwire.FailTemporaryNodeFailure{})
+		}
+	}
+
+	backoff := time.Second
+	for {
+		result, err := p.Client.CallNamedWithCustomTimeout(time.Duration(waitSendPayTimeout+10)*time.Second, "waitsendpay",
+			"payment_hash", paymentHash,
+			"timeout", waitSendPayTimeout,
+			"partid", partID,
+		)
+		if err == nil {
+			preimage, err := decodeHash(result.Get("payment_preimage").String())
+			if err != nil {
+				return nil, err
+			}
+			if err := store.savePreimage(preimage); err != nil {
+				p.Log("error saving preimage: ", err)
+			}
+
+			return &hcwire.UpdateFulfillHTLC{
+				UpdateFulfillHTLC: lnwire.UpdateFulfillHTLC{
+					ChanID:          htlc.ChanID,
+					ID:              htlc.ID,
+					PaymentPreimage: preimage,
+				},
+			}, nil
+		}
+
+		cmdErr, ok := err.(lightning.ErrorCommand)
+		if ok && cmdErr.Code == waitSendPayStillPending {
+			backoff = time.Second
+			continue
+		}
+		if !ok {
+			// lightningd is busy or restarting; the client errors the channel if we let the htlc expire
+			if info, err := p.Client.Call("getinfo"); err == nil && uint32(info.Get("blockheight").Uint())+forwardDeadlineBlocks >= htlc.Expiry {
+				p.Logf("giving up on htlc %v close to its expiry: %v", htlc.ID, err)
+				return failHTLCWith(onion, htlc, &lnwire.FailTemporaryNodeFailure{})
+			}
+
+			p.Logf("waitsendpay for htlc %v failed, retrying in %v: %v", htlc.ID, backoff, err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxWaitSendPayBackoff {
+				backoff = maxWaitSendPayBackoff
+			}
+			continue
+		}
+
+		// a downstream node failed it; add our layer to its error
+		data, _ := json.Marshal(cmdErr.Data)
+		if onionReply, err := hex.DecodeString(gjson.GetBytes(data, "onionreply").String()); err == nil && len(onionReply) > 0 {
+			return &hcwire.UpdateFailHTLC{
+				UpdateFailHTLC: lnwire.UpdateFailHTLC{
+					ChanID: htlc.ChanID,
+					ID:     htlc.ID,
+					Reason: onion.encrypter.EncryptError(false, onionReply),
+				},
+			}, nil
+		}
+
+		p.Logf("htlc %v failed: %v", htlc.ID, err)
+		return failHTLCWith(onion, htlc, &lnwire.FailTemporaryNodeFailure{})
+	}
+}
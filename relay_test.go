@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/raphjaph/go-hosted-channels/hcwire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+)
+
+// the host's lightningd: a channel to the payee and payments that settle right away
+type testSendpays struct {
+	mu       sync.Mutex
+	payments []map[string]interface{}
+}
+
+func setupTestRelay(t *testing.T, host *testNode, payee testPayee) *testSendpays {
+	sendpays := &testSendpays{}
+
+	host.ln.handle("listchannels", func(params gjson.Result) (interface{}, error) {
+		if params.Get("0").String() != "700000x1x0" {
+			return map[string]interface{}{"channels": []interface{}{}}, nil
+		}
+		return map[string]interface{}{"channels": []map[string]interface{}{
+			{"destination": payee.id, "base_fee_millisatoshi": 1000, "fee_per_millionth": 10, "delay": 34},
+		}}, nil
+	})
+	host.ln.handle("listsendpays", func(params gjson.Result) (interface{}, error) {
+		sendpays.mu.Lock()
+		defer sendpays.mu.Unlock()
+		var payments []map[string]interface{}
+		for _, payment := range sendpays.payments {
+			if payment["payment_hash"] == params.Get("payment_hash").String() {
+				payments = append(payments, payment)
+			}
+		}
+		return map[string]interface{}{"payments": payments}, nil
+	})
+	host.ln.handle("sendonion", func(params gjson.Result) (interface{}, error) {
+		sendpays.mu.Lock()
+		defer sendpays.mu.Unlock()
+		sendpays.payments = append(sendpays.payments, map[string]interface{}{
+			"payment_hash": params.Get("payment_hash").String(),
+			"partid":       params.Get("partid").Uint(),
+		})
+		return map[string]interface{}{"status": "pending"}, nil
+	})
+	host.ln.handle("waitsendpay", func(params gjson.Result) (interface{}, error) {
+		sendpays.mu.Lock()
+		defer sendpays.mu.Unlock()
+		for _, payment := range sendpays.payments {
+			if payment["payment_hash"] == params.Get("payment_hash").String() && payment["partid"] == params.Get("partid").Uint() {
+				return map[string]interface{}{"payment_preimage": hex.EncodeToString(payee.preimage[:])}, nil
+			}
+		}
+		return nil, fmt.Errorf("no such payment")
+	})
+
+	return sendpays
+}
+
+func TestRelaySameHashFromTwoChannels(t *testing.T) {
+	host := newTestNode(t, optionFlags{})
+	clients := []*testNode{newTestNode(t, optionFlags{}), newTestNode(t, optionFlags{})}
+
+	// both pay the same invoice
+	payee := newTestPayee(t)
+	for _, client := range clients {
+		openTestChannel(t, client, host)
+		payTestHTLC(t, client, host)
+		setupTestPay(t, client, host, payee)
+	}
+	sendpays := setupTestRelay(t, host, payee)
+
+	for _, client := range clients {
+		htlc, errs, results := startTestPay(t, client, host, time.Second)
+		// the same htlc id in both channels
+		assert.Equal(t, uint64(2), htlc.ID)
+
+		host.use()
+		update, err := resolveIncomingHTLC(host.p, true, htlc)
+		require.NoError(t, err)
+		fulfill, ok := update.(*hcwire.UpdateFulfillHTLC)
+		require.True(t, ok, "%v", update)
+		assert.Equal(t, payee.preimage, [32]byte(fulfill.PaymentPreimage))
+
+		sendTestUpdate(t, host, client, update)
+		exchange(t, host, client)
+		require.NoError(t, <-errs)
+		assert.Equal(t, hex.EncodeToString(payee.preimage[:]), (<-results).PaymentPreimage)
+	}
+
+	// each was sent on its own instead of the second waiting for the first
+	require.Len(t, sendpays.payments, 2)
+	assert.NotEqual(t, sendpays.payments[0]["partid"], sendpays.payments[1]["partid"])
+}
@@ -0,0 +1,435 @@
+package main
+
+/*
+REPLAY of a recording: go-hosted-channels replay -lightning-dir <dir> <peer_id>.jsonl
+- runs offline against a fake lightningd: getinfo answers with the recorded blockheight,
+  sendcustommsg collects what we send and everything else fails
+- starts from an empty database or a copy of the one given with -db
+- messages from the peer go through handleCustomMsg like they did live
+- messages we sent have to come out of the state machine in the same order; the ones
+  that didn't come from a custom message (hc-invoke, hc-pay, resolving htlcs, ...) are
+  put into the state machine the way they were recorded
+- stops at the first message that differs and exits with 1
+*/
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+	"github.com/raphjaph/go-hosted-channels/hcwire"
+	"github.com/tidwall/gjson"
+)
+
+type sentMessage struct {
+	peer    string
+	payload string
+}
+
+// the parts of lightningd the state machine needs
+type fakeLightningd struct {
+	listener net.Listener
+	nodeID   string
+
+	mu          sync.Mutex
+	blockheight uint32
+	sent        []sentMessage
+	methods     map[string]func(params gjson.Result) (interface{}, error)
+}
+
+func startFakeLightningd(path string, nodeID string) (*fakeLightningd, error) {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	ln := &fakeLightningd{listener: listener, nodeID: nodeID}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go ln.serve(conn)
+		}
+	}()
+
+	return ln, nil
+}
+
+func (ln *fakeLightningd) serve(conn net.Conn) {
+	defer conn.Close()
+
+	decoder := json.NewDecoder(conn)
+	for {
+		var request json.RawMessage
+		if err := decoder.Decode(&request); err != nil {
+			return
+		}
+
+		response := lightning.JSONRPCResponse{Version: "2.0", Id: gjson.GetBytes(request, "id").Value()}
+		result, err := ln.call(gjson.GetBytes(request, "method").String(), gjson.GetBytes(request, "params"))
+		if err != nil {
+			response.Error = &lightning.JSONRPCError{Code: -1, Message: err.Error()}
+		} else {
+			response.Result, _ = json.Marshal(result)
+		}
+
+		if err := json.NewEncoder(conn).Encode(response); err != nil {
+			return
+		}
+	}
+}
+
+func (ln *fakeLightningd) call(method string, params gjson.Result) (interface{}, error) {
+	ln.mu.Lock()
+	handler, ok := ln.methods[method]
+	ln.mu.Unlock()
+	if ok {
+		return handler(params)
+	}
+
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+
+	switch method {
+	case "getinfo":
+		return map[string]interface{}{"id": ln.nodeID, "blockheight": ln.blockheight}, nil
+	case "listconfigs":
+		// lightningd's defaults
+		return map[string]interface{}{"fee-base": 1000, "fee-per-satoshi": 10, "cltv-delta": 34}, nil
+	case "sendcustommsg":
+		peer, payload := params.Get("0"), params.Get("1")
+		if params.IsObject() {
+			peer, payload = params.Get("node_id"), params.Get("msg")
+		}
+		ln.sent = append(ln.sent, sentMessage{peer.String(), payload.String()})
+		return map[string]interface{}{"status": "replayed"}, nil
+	default:
+		return nil, fmt.Errorf("%v isn't available in a replay", method)
+	}
+}
+
+func (ln *fakeLightningd) setBlockheight(blockheight uint32) {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+
+	ln.blockheight = blockheight
+}
+
+// messages sent since the last call
+func (ln *fakeLightningd) takeSent() []sentMessage {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+
+	sent := ln.sent
+	ln.sent = nil
+	return sent
+}
+
+// flag for repeated -o name=value
+type optionFlags map[string]string
+
+func (o optionFlags) String() string {
+	return fmt.Sprint(map[string]string(o))
+}
+
+func (o optionFlags) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("options are name=value")
+	}
+	o[parts[0]] = parts[1]
+
+	return nil
+}
+
+// the plugin options as lightningd would pass them; overrides are parsed like the defaults
+func replayArgs(overrides optionFlags) (plugin.Params, error) {
+	args := plugin.Params{}
+	for _, option := range pluginOptions {
+		args[option.Name] = option.Default
+	}
+
+	for name, value := range overrides {
+		if _, ok := args[name]; !ok {
+			return nil, fmt.Errorf("unknown option %v", name)
+		}
+
+		var parsed interface{} = value
+		if _, isString := args[name].(string); !isString {
+			if err := json.Unmarshal([]byte(value), &parsed); err != nil {
+				return nil, fmt.Errorf("invalid value for %v: %v", name, err)
+			}
+		}
+		args[name] = parsed
+	}
+
+	return args, nil
+}
+
+func copyDir(src, dst string) error {
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst, 0700); err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		// a running plugin holds the lock; the copy doesn't need it
+		if file.IsDir() || file.Name() == "LOCK" {
+			continue
+		}
+		if err := copyFile(filepath.Join(src, file.Name()), filepath.Join(dst, file.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// the message as json for reports; hex if it can't be decoded
+func describePayload(peer string, payload string) string {
+	msg, err := decodeMessage(payload, getProtocolVersion(peer))
+	if err != nil {
+		return payload
+	}
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return payload
+	}
+
+	return string(b)
+}
+
+// puts a message we sent without a custom message causing it into the state machine
+func replayLocalMessage(p *plugin.Plugin, peer string, payload string) error {
+	msg, err := decodeMessage(payload, getProtocolVersion(peer))
+	if err != nil {
+		return err
+	}
+
+	switch m := msg.(type) {
+	case *hcwire.InvokeHostedChannel:
+		// hc-invoke
+		if err := clientStartInvoke(p, peer, m.RefundScriptPubKey); err != nil {
+			return err
+		}
+		return sendMessage(p, peer, m)
+
+	case *hcwire.StateUpdate:
+		// hc-accept-override; other state_updates only follow updates
+		if channel, err := store.getChannel(peer); err == nil && !channel.IsHost && channel.StateOverride != nil {
+			_, err := clientAcceptOverride(p, peer)
+			return err
+		}
+		return sendMessage(p, peer, m)
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	switch m := msg.(type) {
+	case *hcwire.UpdateAddHTLC, *hcwire.UpdateFulfillHTLC, *hcwire.UpdateFailHTLC, *hcwire.UpdateFailMalformedHTLC, *hcwire.ResizeChannel:
+		// hc-pay, htlc_accepted, resolved htlcs and hc-resize
+		channel, err := store.getChannel(peer)
+		if err != nil {
+			return err
+		}
+		if err := sendLocalUpdate(p, &channel, m); err != nil {
+			return err
+		}
+		return store.saveChannel(channel)
+
+	case *hcwire.StateOverride:
+		// hc-override
+		channel, err := store.getChannel(peer)
+		if err != nil {
+			return err
+		}
+		channel.StateOverride = m
+		if err := store.saveChannel(channel); err != nil {
+			return err
+		}
+		return sendMessage(p, peer, m)
+
+	case *hcwire.Error:
+		// channels we errored on our own, like for timed out htlcs
+		channel, err := store.getChannel(peer)
+		if err != nil {
+			return sendMessage(p, peer, m)
+		}
+		chanErr := &ChannelError{Code: m.Code(), Details: m.Details()}
+		if err := errorChannel(p, channel, chanErr); err != chanErr {
+			return err
+		}
+		return nil
+
+	default:
+		// asking for branding or preimages and forwarding invoices don't change the channel
+		return sendMessage(p, peer, m)
+	}
+}
+
+func replay(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	lightningDir := flags.String("lightning-dir", "", "lightningd directory with the hsm_secret of the node that made the recording")
+	network := flags.String("network", "bitcoin", "bitcoin, testnet, signet or regtest")
+	dbPath := flags.String("db", "", "database to start from (it is copied); empty to start without channels")
+	options := optionFlags{}
+	flags.Var(options, "o", "plugin option as name=value, can be repeated")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: go-hosted-channels replay -lightning-dir <dir> [-db <dir>] [-o name=value] <recording>")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 || *lightningDir == "" {
+		flags.Usage()
+		return 2
+	}
+
+	if err := runReplay(flags.Arg(0), *lightningDir, *network, *dbPath, options); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
+func runReplay(recordingPath, lightningDir, network, dbPath string, options optionFlags) error {
+	entries, err := readRecording(recordingPath)
+	if err != nil {
+		return fmt.Errorf("couldn't read recording: %v", err)
+	}
+
+	tmp, err := ioutil.TempDir("", "hc-replay")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	if dbPath != "" {
+		if err := copyDir(dbPath, filepath.Join(tmp, "hc-database")); err != nil {
+			return fmt.Errorf("couldn't copy database: %v", err)
+		}
+	}
+	logger := log.New(os.Stderr, "", 0)
+	store, err = openDB(filepath.Join(tmp, "hc-database"), logger.Printf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	pluginArgs, err := replayArgs(options)
+	if err != nil {
+		return err
+	}
+
+	p := &plugin.Plugin{
+		Client: &lightning.Client{
+			Path:         filepath.Join(tmp, "lightning-rpc"),
+			LightningDir: lightningDir,
+			CallTimeout:  10 * time.Second,
+		},
+		Network: network,
+		Args:    pluginArgs,
+		Log:     logger.Println,
+		Logf:    logger.Printf,
+	}
+
+	nodeKey, err := getNodeKey(p)
+	if err != nil {
+		return fmt.Errorf("couldn't read node key: %v", err)
+	}
+	ln, err := startFakeLightningd(p.Client.Path, fmt.Sprintf("%x", nodeKey.PubKey().SerializeCompressed()))
+	if err != nil {
+		return err
+	}
+	defer ln.listener.Close()
+
+	var pending []sentMessage
+	for i, entry := range entries {
+		if entry.Blockheight != 0 {
+			ln.setBlockheight(entry.Blockheight)
+		}
+		fmt.Printf("#%d %v %v %v\n", i, entry.Time.Format(time.RFC3339), entry.Direction, describePayload(entry.Peer, entry.Payload))
+
+		switch entry.Direction {
+		case directionIn:
+			// the recording decides how htlcs were resolved
+			handlePeerMessage(p, entry.Peer, entry.Payload, false)
+			pending = append(pending, ln.takeSent()...)
+
+		case directionOut:
+			if len(pending) == 0 {
+				if err := replayLocalMessage(p, entry.Peer, entry.Payload); err != nil {
+					return fmt.Errorf("diverged at #%d: couldn't send recorded message again: %v", i, err)
+				}
+				pending = append(pending, ln.takeSent()...)
+			}
+			if len(pending) == 0 {
+				return fmt.Errorf("diverged at #%d: recorded message wasn't sent in the replay", i)
+			}
+
+			sent := pending[0]
+			pending = pending[1:]
+			if sent.peer != entry.Peer || sent.payload != entry.Payload {
+				return fmt.Errorf("diverged at #%d:\nrecorded to %v: %v\nreplayed to %v: %v", i,
+					entry.Peer, describePayload(entry.Peer, entry.Payload), sent.peer, describePayload(sent.peer, sent.payload))
+			}
+
+		default:
+			return fmt.Errorf("#%d has unknown direction %q", i, entry.Direction)
+		}
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("diverged at the end: %v sent in the replay wasn't recorded", describePayload(pending[0].peer, pending[0].payload))
+	}
+
+	channels, err := store.listChannels()
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(channels, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("replayed %d messages without divergence; channels:\n%s\n", len(entries), b)
+
+	return nil
+}
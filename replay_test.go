@@ -0,0 +1,44 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// records the host side of an establishment and a paid htlc
+func getTestRecording(t *testing.T) (*testNode, string) {
+	recordDir := t.TempDir()
+	client := newTestNode(t, optionFlags{})
+	host := newTestNode(t, optionFlags{"hosted-channel-record-dir": recordDir})
+
+	openTestChannel(t, client, host)
+	payTestHTLC(t, client, host)
+	assertSameState(t, client, host)
+
+	return host, filepath.Join(recordDir, client.id+".jsonl")
+}
+
+func TestReplay(t *testing.T) {
+	host, recording := getTestRecording(t)
+
+	entries, err := readRecording(recording)
+	require.NoError(t, err)
+	// invoke, init, 2 state_updates, ask_branding_info, add + state_update, state_update,
+	// fulfill + state_update, state_update
+	assert.Len(t, entries, 11)
+	assert.Equal(t, directionIn, entries[0].Direction)
+
+	assert.NoError(t, runReplay(recording, host.lightningDir, "regtest", "", optionFlags{}))
+}
+
+func TestReplayDiverges(t *testing.T) {
+	host, recording := getTestRecording(t)
+
+	// a host with a different channel size answers the invoke differently
+	err := runReplay(recording, host.lightningDir, "regtest", "", optionFlags{"hosted-channel-size": "2000000"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "diverged at #1")
+}
@@ -0,0 +1,254 @@
+package main
+
+/*
+RESIZING a hosted channel (hc-resize):
+- client signs the new capacity and sends resize_channel, then signs the next state
+- host checks its policy (max size, payment for the extra capacity) and queues it like an htlc update
+- once both signed the next state the capacity is larger and the host's balance grew by the difference
+
+PAYING for a resize: the host makes an invoice for the fee with hc-resize-invoice;
+its label names the channel and the new capacity so it pays for that resize only.
+The payment is reserved while the resize is pending and used up once it's signed;
+if the channel errors before that it's released.
+*/
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/raphjaph/go-hosted-channels/hcwire"
+)
+
+const resizeTimeout = 60 * time.Second
+
+// hc-resize calls waiting for the resized state to be signed
+var resizeWaiters = newWaiters[string, error]()
+
+// what the host charges for growing a channel to newCapacitySat
+func getResizeFee(p *plugin.Plugin, currentCapacityMSat uint64, newCapacitySat uint64) uint64 {
+	feePPM := p.Args.Get("hosted-channel-resize-fee-ppm").Uint()
+	extraMSat := newCapacitySat*1000 - currentCapacityMSat
+
+	// split up so it doesn't overflow for large channels
+	return extraMSat/1000000*feePPM + extraMSat%1000000*feePPM/1000000
+}
+
+func clientResizeChannel(p *plugin.Plugin, host string, newCapacitySat uint64, paymentHash *[32]byte) (Channel, error) {
+	if newCapacitySat > math.MaxUint64/1000 {
+		return Channel{}, fmt.Errorf("capacity of %v sat is too large", newCapacitySat)
+	}
+
+	resize := &hcwire.ResizeChannel{NewCapacitySat: newCapacitySat}
+	if paymentHash != nil {
+		if err := resize.SetPaymentHash(*paymentHash); err != nil {
+			return Channel{}, err
+		}
+	}
+	nodeKey, err := getNodeKey(p)
+	if err != nil {
+		return Channel{}, err
+	}
+	if err := resize.Sign(nodeKey); err != nil {
+		return Channel{}, err
+	}
+
+	waiter := resizeWaiters.add(host)
+	defer resizeWaiters.remove(host, waiter)
+
+	if err := sendResize(p, host, resize); err != nil {
+		return Channel{}, err
+	}
+
+	select {
+	case err := <-waiter:
+		if err != nil {
+			return Channel{}, err
+		}
+	case <-time.After(resizeTimeout):
+		return Channel{}, fmt.Errorf("host %v didn't sign the resized state", host)
+	}
+
+	return store.getChannel(host)
+}
+
+func sendResize(p *plugin.Plugin, host string, resize *hcwire.ResizeChannel) error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	channel, err := store.getChannel(host)
+	if err != nil {
+		return err
+	}
+	if channel.IsHost || channel.Status != StatusOpen {
+		return fmt.Errorf("no open hosted channel with host %v", host)
+	}
+	if !channel.HasFeature(hcwire.ResizableChannelsOptional) {
+		return fmt.Errorf("host %v doesn't support resizing channels", host)
+	}
+
+	if err := sendLocalUpdate(p, &channel, resize); err != nil {
+		return err
+	}
+
+	return store.saveChannel(channel)
+}
+
+// resize_channel from a client; the caller queues it if it's acceptable
+func hostValidateResize(p *plugin.Plugin, channel Channel, resize *hcwire.ResizeChannel) error {
+	if !channel.IsHost {
+		return fmt.Errorf("only clients can resize a channel")
+	}
+	if !channel.HasFeature(hcwire.ResizableChannelsOptional) {
+		return fmt.Errorf("resizing wasn't negotiated for this channel")
+	}
+	for _, update := range channel.NextRemoteUpdates {
+		if _, ok := update.(*hcwire.ResizeChannel); ok {
+			return fmt.Errorf("there is a resize pending already")
+		}
+	}
+
+	clientKey, err := parseNodeID(channel.PeerID)
+	if err != nil {
+		return err
+	}
+	if ok, err := resize.VerifyClientSig(clientKey); err != nil || !ok {
+		return fmt.Errorf("resize_channel has an invalid signature")
+	}
+
+	capacity := channel.LastCrossSignedState.InitHostedChannel.ChannelCapacityMSat
+	if resize.NewCapacitySat > math.MaxUint64/1000 || resize.NewCapacitySat*1000 <= capacity {
+		return fmt.Errorf("new capacity of %v sat isn't larger than %v msat", resize.NewCapacitySat, capacity)
+	}
+	if maxSize := p.Args.Get("hosted-channel-max-size").Uint(); resize.NewCapacitySat > maxSize {
+		return fmt.Errorf("new capacity of %v sat is above our maximum of %v sat", resize.NewCapacitySat, maxSize)
+	}
+
+	fee := getResizeFee(p, capacity, resize.NewCapacitySat)
+	if fee == 0 {
+		return nil
+	}
+
+	paymentHash, err := resize.PaymentHash()
+	if err != nil {
+		return err
+	}
+	if paymentHash == nil {
+		return fmt.Errorf("resizing to %v sat costs %v msat but no payment was given", resize.NewCapacitySat, fee)
+	}
+
+	return checkResizePayment(p, channel, resize.NewCapacitySat, *paymentHash, fee)
+}
+
+// label of the invoice that pays for growing channelID to newCapacitySat
+func resizeInvoiceLabel(channelID lnwire.ChannelID, newCapacitySat uint64) string {
+	return fmt.Sprintf("hc-resize/%x/%d", channelID[:], newCapacitySat)
+}
+
+// the invoice has to be ours, made for this resize and paid with at least fee; the
+// payment is reserved for the resize until hostSpendResizePayment uses it up once
+// it's cross signed, or releaseResizePayments if it fails
+func checkResizePayment(p *plugin.Plugin, channel Channel, newCapacitySat uint64, paymentHash [32]byte, fee uint64) error {
+	invoices, err := p.Client.CallNamed("listinvoices", "payment_hash", hex.EncodeToString(paymentHash[:]))
+	if err != nil {
+		return err
+	}
+	invoice := invoices.Get("invoices.0")
+	if invoice.Get("status").String() != "paid" {
+		return fmt.Errorf("no paid invoice with payment hash %x", paymentHash)
+	}
+	if label := resizeInvoiceLabel(channel.ChannelID, newCapacitySat); invoice.Get("label").String() != label {
+		return fmt.Errorf("invoice with payment hash %x isn't for this resize, its label should be %v", paymentHash, label)
+	}
+
+	received, err := parseMSat(invoice.Get("amount_received_msat"))
+	if err != nil {
+		return err
+	}
+	if received < fee {
+		return fmt.Errorf("invoice paid %v msat but resizing costs %v msat", received, fee)
+	}
+
+	return store.reserveResizePayment(paymentHash, channel.PeerID)
+}
+
+// the resizes among a client's pending updates won't be signed; their payments can pay for others
+func releaseResizePayments(p *plugin.Plugin, channel Channel, updates []hcwire.Message) {
+	if !channel.IsHost {
+		return
+	}
+
+	for _, update := range updates {
+		resize, ok := update.(*hcwire.ResizeChannel)
+		if !ok {
+			continue
+		}
+		paymentHash, err := resize.PaymentHash()
+		if err != nil || paymentHash == nil {
+			continue
+		}
+		if err := store.releaseResizePayment(*paymentHash, channel.PeerID); err != nil {
+			p.Logf("couldn't release resize payment %x: %v", *paymentHash, err)
+		}
+	}
+}
+
+// the invoice a client of ours pays to grow its channel to newCapacitySat; the
+// same one again if it was made before
+func hostResizeInvoice(p *plugin.Plugin, client string, newCapacitySat uint64) (string, error) {
+	channel, err := store.getChannel(client)
+	if err != nil {
+		return "", err
+	}
+	if !channel.IsHost {
+		return "", fmt.Errorf("we don't host a channel for %v", client)
+	}
+
+	capacity := channel.LastCrossSignedState.InitHostedChannel.ChannelCapacityMSat
+	if newCapacitySat > math.MaxUint64/1000 || newCapacitySat*1000 <= capacity {
+		return "", fmt.Errorf("new capacity of %v sat isn't larger than %v msat", newCapacitySat, capacity)
+	}
+	fee := getResizeFee(p, capacity, newCapacitySat)
+	if fee == 0 {
+		return "", fmt.Errorf("resizing to %v sat is free", newCapacitySat)
+	}
+
+	label := resizeInvoiceLabel(channel.ChannelID, newCapacitySat)
+	invoices, err := p.Client.CallNamed("listinvoices", "label", label)
+	if err != nil {
+		return "", err
+	}
+	switch existing := invoices.Get("invoices.0"); existing.Get("status").String() {
+	case "":
+	case "expired":
+		if _, err := p.Client.CallNamed("delinvoice", "label", label, "status", "expired"); err != nil {
+			return "", err
+		}
+	default:
+		return existing.Get("bolt11").String(), nil
+	}
+
+	invoice, err := p.Client.CallNamed("invoice",
+		"msatoshi", fee,
+		"label", label,
+		"description", fmt.Sprintf("resize hosted channel %x to %d sat", channel.ChannelID[:], newCapacitySat),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return invoice.Get("bolt11").String(), nil
+}
+
+// the resize is part of the signed state now; its payment can't pay for another one
+func hostSpendResizePayment(resize *hcwire.ResizeChannel) error {
+	paymentHash, err := resize.PaymentHash()
+	if err != nil || paymentHash == nil {
+		return err
+	}
+
+	return store.markResizePaymentUsed(*paymentHash)
+}
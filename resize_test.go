@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/raphjaph/go-hosted-channels/hcwire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+)
+
+// the host's invoices; they are paid as soon as they are made
+type testInvoices struct {
+	mu       sync.Mutex
+	invoices []map[string]interface{}
+}
+
+func setupTestInvoices(host *testNode) *testInvoices {
+	invoices := &testInvoices{}
+
+	host.ln.handle("invoice", func(params gjson.Result) (interface{}, error) {
+		invoices.mu.Lock()
+		defer invoices.mu.Unlock()
+		preimage := [32]byte{byte(len(invoices.invoices) + 1)}
+		paymentHash := sha256.Sum256(preimage[:])
+		invoice := map[string]interface{}{
+			"label":                params.Get("label").String(),
+			"bolt11":               fmt.Sprintf("lnbcrt%dn1", len(invoices.invoices)),
+			"payment_hash":         hex.EncodeToString(paymentHash[:]),
+			"status":               "paid",
+			"amount_received_msat": params.Get("msatoshi").Uint(),
+		}
+		invoices.invoices = append(invoices.invoices, invoice)
+		return invoice, nil
+	})
+	host.ln.handle("listinvoices", func(params gjson.Result) (interface{}, error) {
+		invoices.mu.Lock()
+		defer invoices.mu.Unlock()
+		found := []map[string]interface{}{}
+		for _, invoice := range invoices.invoices {
+			if invoice["label"] == params.Get("label").String() || invoice["payment_hash"] == params.Get("payment_hash").String() {
+				found = append(found, invoice)
+			}
+		}
+		return map[string]interface{}{"invoices": found}, nil
+	})
+
+	return invoices
+}
+
+// payment hash of the invoice the host made for growing the client's channel to capacity
+func getTestResizePayment(t *testing.T, client, host *testNode, invoices *testInvoices, capacity uint64) [32]byte {
+	host.use()
+	bolt11, err := hostResizeInvoice(host.p, client.id, capacity)
+	require.NoError(t, err)
+
+	invoices.mu.Lock()
+	defer invoices.mu.Unlock()
+	for _, invoice := range invoices.invoices {
+		if invoice["bolt11"] == bolt11 {
+			paymentHash, err := decodeHash(invoice["payment_hash"].(string))
+			require.NoError(t, err)
+			return paymentHash
+		}
+	}
+	t.Fatalf("no invoice %v", bolt11)
+	return [32]byte{}
+}
+
+// runs hc-resize until the client sent resize_channel and its state_update
+func startTestResize(t *testing.T, client, host *testNode, capacity uint64, paymentHash [32]byte) chan error {
+	errs := make(chan error, 1)
+	client.use()
+	go func() {
+		_, err := clientResizeChannel(client.p, host.id, capacity, &paymentHash)
+		errs <- err
+	}()
+
+	// reads the node's db directly; use() would race with the goroutine
+	require.Eventually(t, func() bool {
+		channel, err := client.db.getChannel(host.id)
+		return err == nil && len(channel.NextLocalUpdates) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	return errs
+}
+
+func TestResize(t *testing.T) {
+	client := newTestNode(t, optionFlags{})
+	host := newTestNode(t, optionFlags{"hosted-channel-resize-fee-ppm": "1000"})
+	openTestChannel(t, client, host)
+	invoices := setupTestInvoices(host)
+
+	paymentHash := getTestResizePayment(t, client, host, invoices, 2000000)
+	// asking again gives the same invoice
+	assert.Equal(t, paymentHash, getTestResizePayment(t, client, host, invoices, 2000000))
+	assert.Equal(t, uint64(1000000), invoices.invoices[0]["amount_received_msat"])
+
+	errs := startTestResize(t, client, host, 2000000, paymentHash)
+	exchange(t, client, host)
+	require.NoError(t, <-errs)
+
+	assertSameState(t, client, host)
+	assert.Equal(t, uint64(2000000000), client.channel(t, host).LastCrossSignedState.InitHostedChannel.ChannelCapacityMSat)
+	host.use()
+	used, err := store.isResizePaymentUsed(paymentHash)
+	require.NoError(t, err)
+	assert.True(t, used)
+}
+
+func TestResizePaymentIsForOneResize(t *testing.T) {
+	client := newTestNode(t, optionFlags{})
+	host := newTestNode(t, optionFlags{"hosted-channel-resize-fee-ppm": "1000"})
+	openTestChannel(t, client, host)
+	invoices := setupTestInvoices(host)
+
+	// paid for 2000000 sat, asks for 3000000
+	paymentHash := getTestResizePayment(t, client, host, invoices, 2000000)
+	errs := startTestResize(t, client, host, 3000000, paymentHash)
+	exchange(t, client, host)
+
+	err := <-errs
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "isn't for this resize")
+	assert.Equal(t, hcwire.ErrInvalidResize, host.channel(t, client).ErrorReason.Code)
+
+	// the payment wasn't reserved so it's still good for the resize it was made for
+	host.use()
+	assert.NoError(t, store.reserveResizePayment(paymentHash, client.id))
+}
+
+func TestResizePaymentReleasedWhenChannelErrors(t *testing.T) {
+	client := newTestNode(t, optionFlags{})
+	host := newTestNode(t, optionFlags{"hosted-channel-resize-fee-ppm": "1000"})
+	openTestChannel(t, client, host)
+	invoices := setupTestInvoices(host)
+
+	paymentHash := getTestResizePayment(t, client, host, invoices, 2000000)
+	errs := startTestResize(t, client, host, 2000000, paymentHash)
+
+	// the host gets the resize but not the state_update
+	sent := client.ln.takeSent()
+	require.Len(t, sent, 2)
+	host.use()
+	handlePeerMessage(host.p, client.id, sent[0].payload, false)
+	assert.Error(t, store.reserveResizePayment(paymentHash, "other"))
+
+	host.use()
+	channel := host.channel(t, client)
+	assert.Error(t, errorChannel(host.p, channel, fmt.Errorf("gone")))
+	exchange(t, host, client)
+	assert.Error(t, <-errs)
+
+	// another resize can use it now
+	host.use()
+	assert.NoError(t, store.reserveResizePayment(paymentHash, "other"))
+}
@@ -0,0 +1,190 @@
+#!/usr/bin/env python3
+"""
+Builds test-data/hcwire-rfc-vectors.json without going through hcwire:
+- every message is put together field by field following the layouts in the
+  hosted channels RFC (https://github.com/btcontract/hosted-channels-rfc)
+- the sig hash follows the RFC's definition and the signatures are secp256k1
+  ECDSA with RFC 6979 nonces, implemented below with nothing but the stdlib
+
+usage: python3 test-data/rfc-vectors.py > test-data/hcwire-rfc-vectors.json
+"""
+
+import hashlib
+import hmac
+import json
+
+# secp256k1
+P = 2**256 - 2**32 - 977
+N = 0xFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEBAAEDCE6AF48A03BBFD25E8CD0364141
+G = (0x79BE667EF9DCBBAC55A06295CE870B07029BFCDB2DCE28D959F2815B16F81798,
+     0x483ADA7726A3C4655DA4FBFC0E1108A8FD17B448A68554199C47D08FFB10D4B8)
+
+
+def point_add(a, b):
+    if a is None:
+        return b
+    if b is None:
+        return a
+    if a[0] == b[0] and (a[1] + b[1]) % P == 0:
+        return None
+    if a == b:
+        slope = 3 * a[0] * a[0] * pow(2 * a[1], -1, P)
+    else:
+        slope = (b[1] - a[1]) * pow(b[0] - a[0], -1, P)
+    x = (slope * slope - a[0] - b[0]) % P
+    return (x, (slope * (a[0] - x) - a[1]) % P)
+
+
+def point_mul(k, point=G):
+    result = None
+    while k:
+        if k & 1:
+            result = point_add(result, point)
+        point = point_add(point, point)
+        k >>= 1
+    return result
+
+
+def pubkey(priv):
+    x, y = point_mul(priv)
+    return bytes([2 + (y & 1)]) + x.to_bytes(32, "big")
+
+
+def rfc6979_nonce(priv, digest):
+    x = priv.to_bytes(32, "big")
+    h = (int.from_bytes(digest, "big") % N).to_bytes(32, "big")
+    v, k = b"\x01" * 32, b"\x00" * 32
+    k = hmac.new(k, v + b"\x00" + x + h, hashlib.sha256).digest()
+    v = hmac.new(k, v, hashlib.sha256).digest()
+    k = hmac.new(k, v + b"\x01" + x + h, hashlib.sha256).digest()
+    v = hmac.new(k, v, hashlib.sha256).digest()
+    while True:
+        v = hmac.new(k, v, hashlib.sha256).digest()
+        nonce = int.from_bytes(v, "big")
+        if 1 <= nonce < N:
+            return nonce
+        k = hmac.new(k, v + b"\x00", hashlib.sha256).digest()
+        v = hmac.new(k, v, hashlib.sha256).digest()
+
+
+# 64 bytes r || s with low s like lightning signatures
+def sign(priv, digest):
+    nonce = rfc6979_nonce(priv, digest)
+    r = point_mul(nonce)[0] % N
+    s = pow(nonce, -1, N) * (int.from_bytes(digest, "big") + r * priv) % N
+    if s > N // 2:
+        s = N - s
+    return r.to_bytes(32, "big") + s.to_bytes(32, "big")
+
+
+def u16(v): return v.to_bytes(2, "big")
+def u32(v): return v.to_bytes(4, "big")
+def u64(v): return v.to_bytes(8, "big")
+def varbytes(b): return u16(len(b)) + b
+def sha256(b): return hashlib.sha256(b).digest()
+
+
+HOST_KEY = int.from_bytes(sha256(b"hcwire rfc vectors host"), "big")
+CLIENT_KEY = int.from_bytes(sha256(b"hcwire rfc vectors client"), "big")
+
+# p2wpkh
+REFUND_SCRIPT = bytes.fromhex("0014751e76e8199196d454941c45d1b3a323f1433bd6")
+CHANNEL_ID = sha256(b"hcwire rfc vectors channel")
+
+INIT_FIELDS = [
+    ("max_htlc_value_in_flight_msat", u64(100000000)),
+    ("htlc_minimum_msat", u64(1000)),
+    ("max_accepted_htlcs", u16(30)),
+    ("channel_capacity_msat", u64(1000000000)),
+    ("liability_deadline_blockdays", u16(360)),
+    ("minimal_onchain_refund_amount_satoshis", u64(100000)),
+    ("initial_client_balance_msat", u64(0)),
+    ("features", varbytes(b"")),
+]
+
+HTLC_AMOUNT = 100000
+HTLC_FIELDS = [
+    ("channel_id", CHANNEL_ID),
+    ("id", u64(2)),
+    ("amount_msat", u64(HTLC_AMOUNT)),
+    ("payment_hash", sha256(b"\x01" * 32)),
+    ("cltv_expiry", u32(800144)),
+    # version, ephemeral key, payload and hmac; nobody peels it here
+    ("onion_routing_packet", b"\x00" + pubkey(CLIENT_KEY) + bytes(i % 251 for i in range(1300)) + sha256(b"hmac")),
+]
+HTLC = b"".join(v for _, v in HTLC_FIELDS)
+
+BLOCKDAY = 5555
+HOST_BALANCE = 1000000000 - 2 * HTLC_AMOUNT
+CLIENT_BALANCE = HTLC_AMOUNT
+HOST_UPDATES, CLIENT_UPDATES = 2, 1
+
+
+# the RFC's sig hash of a state as seen by one side
+def sig_hash(is_host, local_balance, remote_balance, local_updates, remote_updates, incoming, outgoing):
+    return sha256(
+        REFUND_SCRIPT
+        + (1000000000).to_bytes(8, "little")  # channel_capacity_msat
+        + (0).to_bytes(8, "little")  # initial_client_balance_msat
+        + BLOCKDAY.to_bytes(4, "little")
+        + local_balance.to_bytes(8, "little")
+        + remote_balance.to_bytes(8, "little")
+        + local_updates.to_bytes(4, "little")
+        + remote_updates.to_bytes(4, "little")
+        + b"".join(sorted(incoming))
+        + b"".join(sorted(outgoing))
+        + bytes([1 if is_host else 0])
+    )
+
+
+# the host offered HTLC to the client
+host_sig_hash = sig_hash(True, HOST_BALANCE, CLIENT_BALANCE, HOST_UPDATES, CLIENT_UPDATES, [], [HTLC])
+client_sig_hash = sig_hash(False, CLIENT_BALANCE, HOST_BALANCE, CLIENT_UPDATES, HOST_UPDATES, [HTLC], [])
+host_sig = sign(HOST_KEY, client_sig_hash)
+client_sig = sign(CLIENT_KEY, host_sig_hash)
+
+
+def vector(name, msg_type, type_name, fields, **extra):
+    v = {
+        "name": name,
+        "type": type_name,
+        "protocol_version": 1,
+        "fields": [{"name": "type", "hex": u16(msg_type).hex()}] + [{"name": n, "hex": b.hex()} for n, b in fields],
+    }
+    v["hex"] = "".join(f["hex"] for f in v["fields"])
+    v.update(extra)
+    return v
+
+
+vectors = [
+    vector("update_add_htlc", 63505, "update_add_htlc", HTLC_FIELDS),
+    vector("last_cross_signed_state", 65531, "last_crossed_signed_state", [
+        ("is_host", b"\x01"),
+        ("last_refund_scriptpubkey", varbytes(REFUND_SCRIPT)),
+    ] + [("init_hosted_channel." + n, b) for n, b in INIT_FIELDS] + [
+        ("blockday", u32(BLOCKDAY)),
+        ("local_balance_msat", u64(HOST_BALANCE)),
+        ("remote_balance_msat", u64(CLIENT_BALANCE)),
+        ("local_updates", u32(HOST_UPDATES)),
+        ("remote_updates", u32(CLIENT_UPDATES)),
+        ("incoming_htlcs", u16(0)),
+        ("outgoing_htlcs", u16(1) + HTLC),
+        ("remote_sig_of_local", client_sig),
+        ("local_sig_of_remote", host_sig),
+    ], sig_hash=host_sig_hash.hex(), remote_sig_hash=client_sig_hash.hex()),
+    # the host's answer to the client's signature of the state above
+    vector("state_update", 65529, "state_update", [
+        ("blockday", u32(BLOCKDAY)),
+        ("local_updates", u32(HOST_UPDATES)),
+        ("remote_updates", u32(CLIENT_UPDATES)),
+        ("local_sig_of_remote", host_sig),
+    ]),
+]
+
+print(json.dumps({
+    "host_private_key": HOST_KEY.to_bytes(32, "big").hex(),
+    "host_node_id": pubkey(HOST_KEY).hex(),
+    "client_private_key": CLIENT_KEY.to_bytes(32, "big").hex(),
+    "client_node_id": pubkey(CLIENT_KEY).hex(),
+    "vectors": vectors,
+}, indent=2))
@@ -0,0 +1,56 @@
+package main
+
+import "sync"
+
+// calls blocked until something about key happens; any number can wait for the same key
+type waiters[K comparable, V any] struct {
+	mu      sync.Mutex
+	waiting map[K][]chan V
+}
+
+func newWaiters[K comparable, V any]() *waiters[K, V] {
+	return &waiters[K, V]{waiting: make(map[K][]chan V)}
+}
+
+// the returned channel gets the value notify is called with; remove it once done waiting
+func (w *waiters[K, V]) add(key K) chan V {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	waiter := make(chan V, 1)
+	w.waiting[key] = append(w.waiting[key], waiter)
+	return waiter
+}
+
+func (w *waiters[K, V]) remove(key K, waiter chan V) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	waiting := w.waiting[key]
+	for i, ch := range waiting {
+		if ch == waiter {
+			waiting = append(waiting[:i:i], waiting[i+1:]...)
+			break
+		}
+	}
+	if len(waiting) == 0 {
+		delete(w.waiting, key)
+	} else {
+		w.waiting[key] = waiting
+	}
+}
+
+// hands v to everyone waiting for key; tells whether someone was
+func (w *waiters[K, V]) notify(key K, v V) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	waiting, ok := w.waiting[key]
+	for _, waiter := range waiting {
+		// buffered and notified once since it's removed right after
+		waiter <- v
+	}
+	delete(w.waiting, key)
+
+	return ok
+}